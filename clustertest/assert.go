@@ -0,0 +1,87 @@
+package clustertest
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ashirwad-maker/quantumsync/crypto"
+)
+
+// pollInterval is the time waited between two checks of Eventually.
+const pollInterval = 20 * time.Millisecond
+
+// Eventually calls check until it returns nil, the test fails with the last error when it does
+// not within the timeout.
+func (c *Cluster) Eventually(timeout time.Duration, check func() error) {
+	c.t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		err := check()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			c.t.Fatalf("not within %s: %s", timeout, err)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// WaitConnected waits for every node that is up to be connected with the other nodes that are
+// up, except the ones it is partitioned from.
+func (c *Cluster) WaitConnected(timeout time.Duration) {
+	c.t.Helper()
+	c.Eventually(timeout, func() error {
+		running := c.Running()
+		for _, nd := range running {
+			want := 0
+			for _, other := range running {
+				if other != nd && !c.faults.isCut(nd.Addr, other.Addr) && !c.faults.isHole(linkKey(nd.Addr, other.Addr)) {
+					want++
+				}
+			}
+			have := 0
+			for _, peer := range nd.Peers() {
+				if peer.Connected {
+					have++
+				}
+			}
+			if have != want {
+				return fmt.Errorf("node %d is connected with %d peers, want %d", nd.Index, have, want)
+			}
+		}
+		return nil
+	})
+}
+
+// LatestVersion returns the latest version of the key on the local disk of the node. The node the
+// key was stored on keeps it under its name, the replicas under its hash.
+func (nd *Node) LatestVersion(key string) (string, bool) {
+	for _, name := range []string{key, crypto.HashKey(key)} {
+		versions, err := nd.ListVersions(name)
+		if err == nil && len(versions) > 0 {
+			return versions[len(versions)-1].ID, true
+		}
+	}
+	return "", false
+}
+
+// AssertConverged waits for every node that is up to hold the same latest version of the key.
+func (c *Cluster) AssertConverged(key string, timeout time.Duration) {
+	c.t.Helper()
+	c.Eventually(timeout, func() error {
+		var want string
+		for i, nd := range c.Running() {
+			have, ok := nd.LatestVersion(key)
+			if !ok {
+				return fmt.Errorf("node %d does not have (%s)", nd.Index, key)
+			}
+			if i == 0 {
+				want = have
+			} else if have != want {
+				return fmt.Errorf("node %d has version (%s) of (%s), node %d has (%s)", nd.Index, have, key, c.Running()[0].Index, want)
+			}
+		}
+		return nil
+	})
+}
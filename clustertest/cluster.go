@@ -0,0 +1,259 @@
+// Package clustertest runs clusters of FileServers inside a test, over a MemNetwork or over
+// loopback TCP, and injects faults between their nodes: partitions, slow links and corrupted
+// bytes. Nodes can be killed and restarted on the same storage root, and the assertions wait for
+// the cluster to converge.
+package clustertest
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ashirwad-maker/quantumsync/crypto"
+	"github.com/ashirwad-maker/quantumsync/node"
+	"github.com/ashirwad-maker/quantumsync/p2p"
+	"github.com/ashirwad-maker/quantumsync/store"
+)
+
+// Transport picks the network the nodes of a cluster talk over.
+type Transport int
+
+const (
+	Mem Transport = iota
+	TCP
+	QUIC
+)
+
+func (t Transport) String() string {
+	switch t {
+	case Mem:
+		return "mem"
+	case TCP:
+		return "tcp"
+	case QUIC:
+		return "quic"
+	}
+	return fmt.Sprintf("Transport(%d)", int(t))
+}
+
+// Opts configures a Cluster, the zero value runs the nodes over a MemNetwork.
+type Opts struct {
+	Transport Transport
+	// Configure is called with the options of a node every time it is started, to tune them.
+	Configure func(i int, opts *node.FileServerOpts)
+}
+
+// Cluster is a set of FileServers connected in a full mesh, node i dials the nodes before it.
+type Cluster struct {
+	Opts
+	Nodes []*Node
+
+	t       testing.TB
+	network *p2p.MemNetwork
+	faults  *faults
+}
+
+// Node is a member of the cluster, the FileServer is replaced every time it is restarted.
+type Node struct {
+	*node.FileServer
+	Index int
+	Addr  string
+	Root  string
+	ID    string
+
+	key   []byte
+	mu    sync.Mutex
+	errch chan error
+}
+
+// New starts a cluster of n nodes and waits for them to be connected, the nodes are stopped when
+// the test ends.
+func New(t testing.TB, n int, opts Opts) *Cluster {
+	t.Helper()
+	c := &Cluster{
+		Opts:   opts,
+		t:      t,
+		faults: newFaults(),
+	}
+	if opts.Transport == Mem {
+		c.network = p2p.NewMemNetwork()
+	}
+	for i := 0; i < n; i++ {
+		c.Nodes = append(c.Nodes, &Node{
+			Index: i,
+			Addr:  c.newAddr(i),
+			Root:  t.TempDir(),
+			ID:    crypto.GenerateID(),
+			key:   crypto.NewEncryptionKey(),
+		})
+	}
+	t.Cleanup(c.Close)
+
+	for _, nd := range c.Nodes {
+		c.start(nd)
+	}
+	c.WaitConnected(5 * time.Second)
+	return c
+}
+
+// newAddr returns the address of node i, it is kept when the node is restarted.
+func (c *Cluster) newAddr(i int) string {
+	if c.Transport == Mem {
+		return fmt.Sprintf("node%d", i)
+	}
+	if c.Transport == QUIC {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			c.t.Fatalf("free port: %s", err)
+		}
+		defer conn.Close()
+		return conn.LocalAddr().String()
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.t.Fatalf("free port: %s", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// start builds a FileServer for the node and starts it, it returns once the node listens.
+func (c *Cluster) start(nd *Node) {
+	listening := make(chan struct{})
+	var listenOnce sync.Once
+	tcpOpts := p2p.TCPTransportOpts{
+		ListenAddr:        nd.Addr,
+		HandshakeFunc:     node.Handshake(node.GobCodec{}),
+		Decoder:           p2p.DefaultDecoder{},
+		HeartbeatInterval: 100 * time.Millisecond,
+		IdleTimeout:       time.Second,
+	}
+	var base func(addr string) (net.Conn, error)
+	var listen func(addr string) (net.Listener, error)
+	switch c.Transport {
+	case Mem:
+		base = func(addr string) (net.Conn, error) {
+			return c.network.Dial(nd.Addr, addr)
+		}
+		listen = c.network.Listen
+	case QUIC:
+		base = func(addr string) (net.Conn, error) {
+			return p2p.DialQUIC(addr, nil)
+		}
+		listen = func(addr string) (net.Listener, error) {
+			return p2p.ListenQUIC(addr, nil)
+		}
+	default:
+		base = func(addr string) (net.Conn, error) {
+			return net.Dial("tcp", addr)
+		}
+		listen = func(addr string) (net.Listener, error) {
+			return net.Listen("tcp", addr)
+		}
+	}
+	tcpOpts.Listen = func(addr string) (net.Listener, error) {
+		l, err := listen(addr)
+		if err == nil {
+			listenOnce.Do(func() { close(listening) })
+		}
+		return l, err
+	}
+	tcpOpts.Dial = func(addr string) (net.Conn, error) {
+		return c.faults.dial(nd.Addr, addr, base)
+	}
+	tr := p2p.NewTCPTransport(tcpOpts)
+
+	var bootstrap []string
+	for _, other := range c.Nodes[:nd.Index] {
+		bootstrap = append(bootstrap, other.Addr)
+	}
+	opts := node.FileServerOpts{
+		EncKey:           nd.key,
+		StorageRoot:      nd.Root,
+		ID:               nd.ID,
+		PathTansformFunc: store.CASPathTransformFunc,
+		Transport:        tr,
+		BootstrapNodes:   bootstrap,
+		RedialInterval:   50 * time.Millisecond,
+		AckTimeout:       time.Second,
+	}
+	if c.Configure != nil {
+		c.Configure(nd.Index, &opts)
+	}
+	s := node.NewFileServer(opts)
+	tr.OnPeer = s.OnPeer
+	tr.OnPeerDisconnect = s.OnPeerDisconnect
+
+	errch := make(chan error, 1)
+	nd.mu.Lock()
+	nd.FileServer = s
+	nd.errch = errch
+	nd.mu.Unlock()
+	go func() {
+		errch <- s.Start()
+	}()
+
+	select {
+	case <-listening:
+	case err := <-errch:
+		c.t.Fatalf("node %d did not start: %v", nd.Index, err)
+	}
+}
+
+// Running reports whether the node is up.
+func (nd *Node) Running() bool {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+	return nd.errch != nil
+}
+
+// Kill stops node i right away, without telling its peers, and waits for it to be down.
+func (c *Cluster) Kill(i int) {
+	c.t.Helper()
+	nd := c.Nodes[i]
+	nd.mu.Lock()
+	errch := nd.errch
+	nd.errch = nil
+	nd.mu.Unlock()
+	if errch == nil {
+		return
+	}
+
+	// A crashed process drops its connections, even the one it was reading a message from.
+	nd.Stop()
+	nd.Transport.Close()
+	select {
+	case <-errch:
+	case <-time.After(5 * time.Second):
+		c.t.Fatalf("node %d did not stop", i)
+	}
+}
+
+// Restart starts node i again on the same address, storage root, ID and key, and waits for it
+// to be connected with the other nodes that are up.
+func (c *Cluster) Restart(i int) {
+	c.t.Helper()
+	c.Kill(i)
+	c.start(c.Nodes[i])
+	c.WaitConnected(5 * time.Second)
+}
+
+// Close stops every node that is up.
+func (c *Cluster) Close() {
+	for i := range c.Nodes {
+		c.Kill(i)
+	}
+}
+
+// Running returns the nodes that are up.
+func (c *Cluster) Running() []*Node {
+	var nodes []*Node
+	for _, nd := range c.Nodes {
+		if nd.Running() {
+			nodes = append(nodes, nd)
+		}
+	}
+	return nodes
+}
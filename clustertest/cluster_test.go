@@ -0,0 +1,126 @@
+package clustertest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ashirwad-maker/quantumsync/node"
+)
+
+func storeData(t *testing.T, nd *Node, key string, data string, consistency node.Consistency) (*node.StoreResult, error) {
+	t.Helper()
+	return nd.StoreWith(key, bytes.NewReader([]byte(data)), node.WriteOpts{Consistency: consistency})
+}
+
+func TestClusterReplication(t *testing.T) {
+	for _, transport := range []Transport{Mem, TCP, QUIC} {
+		t.Run(transport.String(), func(t *testing.T) {
+			c := New(t, 3, Opts{Transport: transport})
+
+			result, err := storeData(t, c.Nodes[2], "picture", "some jpeg bytes", node.ConsistencyAll)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Acks != 3 {
+				t.Errorf("want 3 acks have %d", result.Acks)
+			}
+			c.AssertConverged("picture", 2*time.Second)
+		})
+	}
+}
+
+func TestClusterPartition(t *testing.T) {
+	c := New(t, 3, Opts{})
+
+	// Node 2 dialed the others. A write that cannot reach enough of them is turned down before
+	// anything is written, the ones it can accept are hinted and replayed once the partition heals.
+	c.Partition([]int{0, 1}, []int{2})
+	c.WaitConnected(2 * time.Second)
+	if _, err := storeData(t, c.Nodes[2], "picture", "some jpeg bytes", node.ConsistencyAll); !errors.Is(err, node.ErrNotEnoughReplicas) {
+		t.Fatalf("want %s have %v", node.ErrNotEnoughReplicas, err)
+	}
+	if _, ok := c.Nodes[2].LatestVersion("picture"); ok {
+		t.Fatal("want nothing written by the write turned down")
+	}
+	if _, err := storeData(t, c.Nodes[2], "picture", "some jpeg bytes", node.ConsistencyOne); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Nodes[0].LatestVersion("picture"); ok {
+		t.Fatal("want the write kept from the other side of the partition")
+	}
+
+	c.Heal()
+	c.WaitConnected(2 * time.Second)
+	c.AssertConverged("picture", 2*time.Second)
+}
+
+func TestClusterBlackhole(t *testing.T) {
+	c := New(t, 2, Opts{})
+
+	// The connection stays open but nothing crosses it, the missed heartbeats drop the peer.
+	c.Blackhole(0, 1)
+	start := time.Now()
+	c.WaitConnected(3 * time.Second)
+	if took := time.Since(start); took < 500*time.Millisecond {
+		t.Errorf("want the peer dropped after the idle timeout, took %s", took)
+	}
+
+	c.Heal()
+	c.WaitConnected(2 * time.Second)
+	c.Eventually(time.Second, func() error {
+		for _, peer := range c.Nodes[1].Peers() {
+			if peer.RTT == 0 {
+				return fmt.Errorf("no round trip time measured with %s", peer.Addr)
+			}
+		}
+		return nil
+	})
+}
+
+func TestClusterKillRestart(t *testing.T) {
+	for _, transport := range []Transport{Mem, QUIC} {
+		t.Run(transport.String(), func(t *testing.T) {
+			c := New(t, 3, Opts{Transport: transport})
+			if _, err := storeData(t, c.Nodes[0], "before", "stored before the crash", node.ConsistencyAll); err != nil {
+				t.Fatal(err)
+			}
+
+			c.Kill(0)
+			if _, err := storeData(t, c.Nodes[1], "during", "stored while node 0 is down", node.ConsistencyQuorum); err != nil {
+				t.Fatal(err)
+			}
+			c.Restart(0)
+
+			// The restarted node finds its files on disk and gets the writes it missed from the hints.
+			c.AssertConverged("before", 2*time.Second)
+			c.AssertConverged("during", 2*time.Second)
+		})
+	}
+}
+
+func TestClusterSlowLink(t *testing.T) {
+	c := New(t, 2, Opts{})
+	c.SlowLink(0, 1, 100*time.Millisecond)
+
+	start := time.Now()
+	if _, err := storeData(t, c.Nodes[1], "picture", "some jpeg bytes", node.ConsistencyAll); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took < 100*time.Millisecond {
+		t.Errorf("want the store slowed down, it took %s", took)
+	}
+	c.AssertConverged("picture", 2*time.Second)
+}
+
+func TestClusterCorruptLink(t *testing.T) {
+	c := New(t, 2, Opts{})
+	c.CorruptLink(0, 1, 1)
+
+	if _, err := storeData(t, c.Nodes[1], "picture", "some jpeg bytes", node.ConsistencyAll); err == nil {
+		t.Fatal("want the store to fail over a corrupted link")
+	}
+	c.ResetLinks()
+}
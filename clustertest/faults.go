@@ -0,0 +1,240 @@
+package clustertest
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// faults holds the faults injected between the nodes, keyed by the pair of node addresses. Every
+// connection a node dials goes through it, so the faults apply whichever transport is used.
+type faults struct {
+	mu   sync.Mutex
+	cuts map[[2]string]struct{}
+	// holes are the links dropping everything silently, their connections stay open.
+	holes   map[[2]string]struct{}
+	latency map[[2]string]time.Duration
+	corrupt map[[2]string]float64
+	rand    *rand.Rand
+	conns   map[*faultConn]struct{}
+}
+
+func newFaults() *faults {
+	return &faults{
+		cuts:    make(map[[2]string]struct{}),
+		holes:   make(map[[2]string]struct{}),
+		latency: make(map[[2]string]time.Duration),
+		corrupt: make(map[[2]string]float64),
+		rand:    rand.New(rand.NewSource(1)),
+		conns:   make(map[*faultConn]struct{}),
+	}
+}
+
+func linkKey(a, b string) [2]string {
+	if b < a {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+func (f *faults) dial(from, addr string, base func(addr string) (net.Conn, error)) (net.Conn, error) {
+	f.mu.Lock()
+	_, cut := f.cuts[linkKey(from, addr)]
+	_, hole := f.holes[linkKey(from, addr)]
+	f.mu.Unlock()
+	if cut || hole {
+		return nil, fmt.Errorf("dial %s from %s: partitioned", addr, from)
+	}
+
+	conn, err := base(addr)
+	if err != nil {
+		return nil, err
+	}
+	fc := &faultConn{Conn: conn, faults: f, link: linkKey(from, addr)}
+	f.mu.Lock()
+	f.conns[fc] = struct{}{}
+	f.mu.Unlock()
+	return fc, nil
+}
+
+// cut partitions the links and closes the connections on them, the nodes see their peers go away.
+func (f *faults) cut(links [][2]string) {
+	f.mu.Lock()
+	cut := make(map[[2]string]bool)
+	for _, link := range links {
+		f.cuts[link] = struct{}{}
+		cut[link] = true
+	}
+	var closing []*faultConn
+	for fc := range f.conns {
+		if cut[fc.link] {
+			closing = append(closing, fc)
+		}
+	}
+	f.mu.Unlock()
+
+	for _, fc := range closing {
+		fc.Close()
+	}
+}
+
+func (f *faults) heal() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cuts = make(map[[2]string]struct{})
+	f.holes = make(map[[2]string]struct{})
+}
+
+func (f *faults) blackhole(link [2]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.holes[link] = struct{}{}
+}
+
+func (f *faults) isHole(link [2]string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.holes[link]
+	return ok
+}
+
+func (f *faults) isCut(a, b string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.cuts[linkKey(a, b)]
+	return ok
+}
+
+func (f *faults) setLatency(link [2]string, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if d == 0 {
+		delete(f.latency, link)
+		return
+	}
+	f.latency[link] = d
+}
+
+func (f *faults) setCorrupt(link [2]string, rate float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if rate == 0 {
+		delete(f.corrupt, link)
+		return
+	}
+	f.corrupt[link] = rate
+}
+
+func (f *faults) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latency = make(map[[2]string]time.Duration)
+	f.corrupt = make(map[[2]string]float64)
+}
+
+// apply delays the data crossing the link and flips a byte of it when it is picked for corruption.
+func (f *faults) apply(link [2]string, b []byte) {
+	f.mu.Lock()
+	latency := f.latency[link]
+	flip := -1
+	if rate := f.corrupt[link]; rate > 0 && len(b) > 0 && f.rand.Float64() < rate {
+		flip = f.rand.Intn(len(b))
+	}
+	f.mu.Unlock()
+
+	time.Sleep(latency)
+	if flip >= 0 {
+		b[flip] ^= 0xff
+	}
+}
+
+// faultConn is a connection dialed by a node, the faults of its link are applied on the writes
+// going out and the reads coming back, so both directions are covered from the dialer side.
+type faultConn struct {
+	net.Conn
+	faults    *faults
+	link      [2]string
+	closeOnce sync.Once
+}
+
+func (c *faultConn) Write(b []byte) (int, error) {
+	if c.faults.isCut(c.link[0], c.link[1]) {
+		return 0, fmt.Errorf("write to %s: partitioned", c.RemoteAddr())
+	}
+	if c.faults.isHole(c.link) {
+		return len(b), nil
+	}
+	// The caller keeps its buffer, the corruption happens on a copy.
+	data := append([]byte(nil), b...)
+	c.faults.apply(c.link, data)
+	return c.Conn.Write(data)
+}
+
+func (c *faultConn) Read(b []byte) (int, error) {
+	for {
+		n, err := c.Conn.Read(b)
+		if n > 0 && err == nil && c.faults.isHole(c.link) {
+			continue
+		}
+		if n > 0 {
+			c.faults.apply(c.link, b[:n])
+		}
+		return n, err
+	}
+}
+
+func (c *faultConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.faults.mu.Lock()
+		delete(c.faults.conns, c)
+		c.faults.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// Partition splits the cluster, the nodes of a group are cut from the nodes of the other groups
+// until Heal is called. The connections between them are closed and dialing fails, as when a
+// switch goes down. Nodes that are in no group keep talking to everyone.
+func (c *Cluster) Partition(groups ...[]int) {
+	var links [][2]string
+	for g, group := range groups {
+		for _, other := range groups[g+1:] {
+			for _, a := range group {
+				for _, b := range other {
+					links = append(links, linkKey(c.Nodes[a].Addr, c.Nodes[b].Addr))
+				}
+			}
+		}
+	}
+	c.faults.cut(links)
+}
+
+// Blackhole makes the link between nodes a and b drop everything without closing the connections,
+// as when the host of one of them loses power. The nodes only notice from the missing heartbeats.
+// Dialing fails until Heal is called.
+func (c *Cluster) Blackhole(a, b int) {
+	c.faults.blackhole(linkKey(c.Nodes[a].Addr, c.Nodes[b].Addr))
+}
+
+// Heal removes every partition and blackhole, the nodes redial the peers they lost.
+func (c *Cluster) Heal() {
+	c.faults.heal()
+}
+
+// SlowLink delays the data between nodes a and b by d in both directions, zero removes the delay.
+func (c *Cluster) SlowLink(a, b int, d time.Duration) {
+	c.faults.setLatency(linkKey(c.Nodes[a].Addr, c.Nodes[b].Addr), d)
+}
+
+// CorruptLink flips a byte in the given fraction of the reads and writes between nodes a and b,
+// zero stops it.
+func (c *Cluster) CorruptLink(a, b int, rate float64) {
+	c.faults.setCorrupt(linkKey(c.Nodes[a].Addr, c.Nodes[b].Addr), rate)
+}
+
+// ResetLinks removes the delays and the corruption of every link, the partitions are kept.
+func (c *Cluster) ResetLinks() {
+	c.faults.reset()
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ashirwad-maker/quantumsync/node"
+	"github.com/ashirwad-maker/quantumsync/p2p"
+)
+
+const usage = `usage: qs <command> [flags] [args]
+
+Commands:
+  serve [flags]         run a node, SIGHUP reloads its config
+  put [flags] <key> <file>  store a file, "-" reads it from stdin
+  get [flags] <key>     fetch a file to stdout
+  rm [flags] <key>      delete a file from the network
+  ls [flags]            list the keys stored on the node
+  peers [flags]         list the peers of the node
+  stat [flags] <key>    show the metadata and the versions of a file
+  status [flags]        show the peers, transfers, queues, store and recent errors of the node
+  disconnect [flags] <addr>  close the connection to a peer
+  repair [flags] <key>  send the latest version of a file to the peers that are behind
+
+The client commands talk to a running node through its control socket, or through
+its HTTP gateway with -addr. The admin commands, status, disconnect and repair, only
+go through the control socket. Run "qs <command> -h" for the flags of a command.
+`
+
+func runCLI(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return errors.New("no command given")
+	}
+
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "serve":
+		return runServe(args)
+	case "put":
+		return runPut(args)
+	case "get":
+		return runGet(args)
+	case "rm":
+		return runRm(args)
+	case "ls":
+		return runLs(args)
+	case "peers":
+		return runPeers(args)
+	case "stat":
+		return runStat(args)
+	case "status":
+		return runStatus(args)
+	case "disconnect":
+		return runDisconnect(args)
+	case "repair":
+		return runRepair(args)
+	case "help", "-h", "--help":
+		fmt.Fprint(os.Stdout, usage)
+		return nil
+	}
+	fmt.Fprint(os.Stderr, usage)
+	return fmt.Errorf("unknown command (%s)", cmd)
+}
+
+// shutdownTimeout is how long a node waits for the requests in flight when asked to stop.
+const shutdownTimeout = 30 * time.Second
+
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	configPath := fs.String("config", "", "config file (.yaml, .toml or .json), the flags given override it")
+	listen := fs.String("listen", ":3000", "address the node listens on for its peers")
+	bootstrap := fs.String("bootstrap", "", "comma separated addresses of the nodes to connect to")
+	root := fs.String("root", "", "storage root (default <port>quantumsyncnetwork)")
+	httpAddr := fs.String("http", "", "address of the HTTP gateway, disabled when empty")
+	socket := fs.String("socket", node.DefaultSocket(), "path of the local control socket")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// loadConfig is also called on SIGHUP, so the flags keep winning over the reloaded file.
+	loadConfig := func() (*node.Config, error) {
+		cfg, err := node.LoadConfig(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "listen":
+				cfg.Transport.ListenAddr = *listen
+			case "bootstrap":
+				cfg.Transport.Bootstrap = nil
+				if len(*bootstrap) > 0 {
+					cfg.Transport.Bootstrap = strings.Split(*bootstrap, ",")
+				}
+			case "root":
+				cfg.Store.Root = *root
+			case "http":
+				cfg.Gateway.HTTP = *httpAddr
+			case "socket":
+				cfg.Gateway.Socket = *socket
+			}
+		})
+		return cfg, cfg.Validate()
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	var logOutput io.Writer = os.Stderr
+	if len(cfg.Logging.Output) > 0 {
+		f, err := os.OpenFile(cfg.Logging.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		logOutput = f
+	}
+	// The level is changed on a reload, the other logging settings need a restart.
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(cfg.LogLevel())
+	logger := cfg.NewLogger(logOutput, logLevel)
+	slog.SetDefault(logger)
+
+	s, err := node.NewFromConfig(cfg, logger)
+	if err != nil {
+		return err
+	}
+
+	gateway := node.NewGateway(s, node.GatewayOpts{
+		ListenAddr:        cfg.Gateway.HTTP,
+		MaxObjectSize:     cfg.Limits.MaxObjectSize,
+		RequestsPerSecond: cfg.Limits.RequestsPerSecond,
+	})
+
+	// Only the users the socket mode lets in can control the node, the user running it by default.
+	l, err := p2p.ListenUnix(cfg.Gateway.Socket, os.FileMode(cfg.Gateway.SocketMode))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(cfg.Gateway.Socket)
+	go func() {
+		if err := gateway.ServeAdmin(l); err != nil {
+			logger.Error("control socket failed", "err", err)
+		}
+	}()
+	if len(cfg.Gateway.HTTP) > 0 {
+		go func() {
+			if err := gateway.ListenAndServe(); err != nil {
+				logger.Error("HTTP gateway failed", "err", err)
+			}
+		}()
+	}
+	var metricsServer *http.Server
+	if len(cfg.Gateway.Metrics) > 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", s.Metrics)
+		metricsServer = &http.Server{Addr: cfg.Gateway.Metrics, Handler: mux}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("metrics listener failed", "err", err)
+			}
+		}()
+	}
+
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		for sig := range sigch {
+			if sig != syscall.SIGHUP {
+				break
+			}
+			next, err := loadConfig()
+			if err != nil {
+				logger.Error("config reload failed", "err", err)
+				continue
+			}
+			s.SetBootstrapNodes(next.Transport.Bootstrap)
+			gateway.SetRateLimit(next.Limits.RequestsPerSecond)
+			s.SetBandwidthLimits(next.BandwidthLimits())
+			logLevel.Set(next.LogLevel())
+			if changed := cfg.NeedsRestart(next); len(changed) > 0 {
+				logger.Warn("config reloaded, some changes need a restart", "settings", strings.Join(changed, ", "))
+			} else {
+				logger.Info("config reloaded")
+			}
+		}
+		// The gateway goes first so the requests it is serving make it to the server in time.
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		logger.Info("shutting down, waiting for the requests in flight")
+		if err := gateway.Shutdown(ctx); err != nil {
+			logger.Error("gateway shutdown failed", "err", err)
+		}
+		if err := s.Shutdown(ctx); err != nil {
+			logger.Error("shutdown failed", "err", err)
+		}
+		if metricsServer != nil {
+			metricsServer.Close()
+		}
+	}()
+
+	if err := s.Start(); err != nil {
+		return err
+	}
+	// Start returns as soon as the server stops handling messages, the connections are closed and
+	// the store is flushed after that.
+	<-shutdown
+	return nil
+}
+
+// client talks to the gateway of a running node.
+type client struct {
+	base string
+	http *http.Client
+}
+
+func newClient(socket string, addr string) *client {
+	if len(addr) > 0 {
+		if !strings.Contains(addr, "://") {
+			addr = "http://" + addr
+		}
+		return &client{
+			base: strings.TrimRight(addr, "/"),
+			http: http.DefaultClient,
+		}
+	}
+	dialer := net.Dialer{}
+	return &client{
+		base: "http://qs",
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// do sends the request and turns the error responses of the gateway into errors.
+func (c *client) do(method string, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 400 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var e struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || len(e.Error) == 0 {
+		return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return nil, errors.New(e.Error)
+}
+
+func (c *client) getJSON(path string, v any) error {
+	resp, err := c.do(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// clientFlags are the flags shared by every client command.
+func clientFlags(name string) (*flag.FlagSet, func() *client) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	socket := fs.String("socket", node.DefaultSocket(), "path of the control socket of the node")
+	addr := fs.String("addr", "", "address of the HTTP gateway of the node, used instead of the socket")
+	return fs, func() *client { return newClient(*socket, *addr) }
+}
+
+// adminFlags are the flags of the admin commands, the HTTP gateway does not serve them.
+func adminFlags(name string) (*flag.FlagSet, func() *client) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	socket := fs.String("socket", node.DefaultSocket(), "path of the control socket of the node")
+	return fs, func() *client { return newClient(*socket, "") }
+}
+
+func objectPath(key string, query url.Values) string {
+	path := "/objects/" + url.PathEscape(key)
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	return path
+}
+
+func runPut(args []string) error {
+	fs, newClient := clientFlags("put")
+	consistency := fs.String("consistency", "", "number of replicas that have to write the file (one, quorum, all)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("usage: qs put [flags] <key> <file>")
+	}
+	key, file := fs.Arg(0), fs.Arg(1)
+
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	query := url.Values{}
+	if len(*consistency) > 0 {
+		query.Set("consistency", *consistency)
+	}
+	resp, err := newClient().do(http.MethodPut, objectPath(key, query), r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result node.StoreResultJSON
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	fmt.Printf("stored %s (%d bytes) as version %s, %d acks\n", result.Key, result.Size, result.Version, result.Acks)
+	for _, p := range result.Peers {
+		if len(p.Err) > 0 {
+			fmt.Printf("  %s: %s\n", p.Peer, p.Err)
+		}
+	}
+	return nil
+}
+
+func runGet(args []string) error {
+	fs, newClient := clientFlags("get")
+	consistency := fs.String("consistency", "", "number of replicas to read from (one, quorum, all)")
+	version := fs.String("version", "", "version to fetch, the latest by default")
+	out := fs.String("o", "", "file to write to instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: qs get [flags] <key>")
+	}
+
+	query := url.Values{}
+	if len(*consistency) > 0 {
+		query.Set("consistency", *consistency)
+	}
+	if len(*version) > 0 {
+		query.Set("version", *version)
+	}
+	resp, err := newClient().do(http.MethodGet, objectPath(fs.Arg(0), query), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var w io.Writer = os.Stdout
+	if len(*out) > 0 {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func runRm(args []string) error {
+	fs, newClient := clientFlags("rm")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: qs rm [flags] <key>")
+	}
+	resp, err := newClient().do(http.MethodDelete, objectPath(fs.Arg(0), nil), nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func runLs(args []string) error {
+	fs, newClient := clientFlags("ls")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var keys []string
+	if err := newClient().getJSON("/objects", &keys); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		fmt.Println(key)
+	}
+	return nil
+}
+
+func runPeers(args []string) error {
+	fs, newClient := clientFlags("peers")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var peers []node.PeerInfo
+	if err := newClient().getJSON("/peers", &peers); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDR\tDIRECTION\tSTATE\tRTT")
+	for _, p := range peers {
+		direction, state, rtt := "inbound", "connected", "-"
+		if p.Outbound {
+			direction = "outbound"
+		}
+		if !p.Connected {
+			state = "offline"
+		}
+		if p.RTT > 0 {
+			rtt = time.Duration(p.RTT).Round(time.Microsecond).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", p.Addr, direction, state, rtt)
+	}
+	return tw.Flush()
+}
+
+func runStat(args []string) error {
+	fs, newClient := clientFlags("stat")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: qs stat [flags] <key>")
+	}
+	key := fs.Arg(0)
+	c := newClient()
+
+	resp, err := c.do(http.MethodHead, objectPath(key, nil), nil)
+	if err != nil {
+		// HEAD responses have no body to read the error from.
+		return fmt.Errorf("stat %s: %w", key, err)
+	}
+	resp.Body.Close()
+
+	fmt.Printf("key:      %s\n", key)
+	fmt.Printf("size:     %d\n", resp.ContentLength)
+	fmt.Printf("version:  %s\n", resp.Header.Get("X-Qs-Version"))
+	fmt.Printf("modified: %s\n", resp.Header.Get("Last-Modified"))
+	if siblings := resp.Header.Get("X-Qs-Siblings"); len(siblings) > 0 {
+		fmt.Printf("siblings: %s\n", siblings)
+	}
+
+	var versions []node.VersionJSON
+	if err := c.getJSON("/versions/"+url.PathEscape(key), &versions); err != nil {
+		return err
+	}
+	fmt.Println("versions:")
+	for _, v := range versions {
+		fmt.Printf("  %s  %d bytes  %s\n", v.ID, v.Size, v.ModTime.Format("2006-01-02 15:04:05"))
+	}
+	return nil
+}
+
+func runStatus(args []string) error {
+	fs, newClient := adminFlags("status")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var status node.Status
+	if err := newClient().getJSON("/admin/status", &status); err != nil {
+		return err
+	}
+
+	fmt.Printf("node:    %s (%s)\n", status.Addr, status.ID)
+	fmt.Printf("store:   %d objects, %d bytes\n", status.Store.Objects, status.Store.Bytes)
+	fmt.Printf("queues:  %d messages in the inbox, %d bytes of hints\n", status.Queues.Inbox, status.Queues.HintBytes)
+
+	fmt.Println("\npeers:")
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "  ADDR\tDIRECTION\tSTATE\tRTT\tCONNECTED\tSENT\tRECEIVED\tINBOX\tHINTS")
+	for _, p := range status.Peers {
+		direction, state, rtt, since := "inbound", "connected", "-", "-"
+		if p.Outbound {
+			direction = "outbound"
+		}
+		if !p.Connected {
+			state = "offline"
+		}
+		if p.RTT > 0 {
+			rtt = time.Duration(p.RTT).Round(time.Microsecond).String()
+		}
+		if !p.ConnectedAt.IsZero() {
+			since = time.Since(p.ConnectedAt).Round(time.Second).String()
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\n", p.Addr, direction, state, rtt, since, p.BytesSent, p.BytesReceived, p.Inbox, p.Hints)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println("\ntransfers:")
+	tw = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "  PEER\tDIRECTION\tCLASS\tKEY\tPROGRESS\tELAPSED")
+	for _, t := range status.Transfers {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%d/%d\t%s\n", t.Peer, t.Direction, t.Class, t.Key, t.Bytes, t.Size, time.Since(t.Started).Round(time.Millisecond))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println("\nerrors:")
+	for _, e := range status.Errors {
+		fmt.Printf("  %s %-5s %s", e.Time.Format("2006-01-02 15:04:05"), e.Level, e.Message)
+		keys := make([]string, 0, len(e.Attrs))
+		for k := range e.Attrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Printf(" %s=%s", k, e.Attrs[k])
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func runDisconnect(args []string) error {
+	fs, newClient := adminFlags("disconnect")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: qs disconnect [flags] <addr>")
+	}
+	resp, err := newClient().do(http.MethodDelete, "/admin/peers/"+url.PathEscape(fs.Arg(0)), nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func runRepair(args []string) error {
+	fs, newClient := adminFlags("repair")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: qs repair [flags] <key>")
+	}
+	resp, err := newClient().do(http.MethodPost, "/admin/repair/"+url.PathEscape(fs.Arg(0)), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var res node.RepairJSON
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return err
+	}
+	if len(res.Repaired) == 0 {
+		fmt.Println("every replica is up to date")
+		return nil
+	}
+	for _, peer := range res.Repaired {
+		fmt.Printf("repaired %s\n", peer)
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ashirwad-maker/quantumsync/crypto"
+	"github.com/ashirwad-maker/quantumsync/node"
+	"github.com/ashirwad-maker/quantumsync/p2p"
+	"github.com/ashirwad-maker/quantumsync/store"
+)
+
+// newTestGateway returns the gateway of a node that is not connected to any peer.
+func newTestGateway(t *testing.T) *node.Gateway {
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		HandshakeFunc: p2p.NOPhandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	s := node.NewFileServer(node.FileServerOpts{
+		EncKey:           crypto.NewEncryptionKey(),
+		StorageRoot:      t.TempDir(),
+		PathTansformFunc: store.CASPathTransformFunc,
+		Transport:        tr,
+		Versioning:       true,
+	})
+	return node.NewGateway(s, node.GatewayOpts{})
+}
+
+// serveHTTP serves the gateway over HTTP and returns the -addr flag to reach it.
+func serveHTTP(t *testing.T, g *node.Gateway) string {
+	ts := httptest.NewServer(g)
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
+
+// serveSocket serves the gateway on a control socket, admin routes included as qs serve does,
+// and returns the -socket flag to reach it.
+func serveSocket(t *testing.T, g *node.Gateway) string {
+	path := filepath.Join(t.TempDir(), "qs.sock")
+	l, err := p2p.ListenUnix(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go g.ServeAdmin(l)
+	t.Cleanup(func() { l.Close() })
+	return path
+}
+
+// run runs the command line and returns what it printed on stdout.
+func run(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+	err = runCLI(args)
+	w.Close()
+	return <-out, err
+}
+
+func TestRunCLIArgs(t *testing.T) {
+	// The usage goes to stderr on errors, it is of no interest here.
+	stderr := os.Stderr
+	os.Stderr, _ = os.Open(os.DevNull)
+	defer func() { os.Stderr = stderr }()
+
+	if _, err := run(t); err == nil || err.Error() != "no command given" {
+		t.Errorf("want no command given have %v", err)
+	}
+	if _, err := run(t, "nope"); err == nil || err.Error() != "unknown command (nope)" {
+		t.Errorf("want an unknown command have %v", err)
+	}
+	if out, err := run(t, "help"); err != nil || !strings.HasPrefix(out, "usage: qs") {
+		t.Errorf("want the usage have (%v) %s", err, out)
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"put", "key"}, "usage: qs put [flags] <key> <file>"},
+		{[]string{"put", "key", "file", "other"}, "usage: qs put [flags] <key> <file>"},
+		{[]string{"get"}, "usage: qs get [flags] <key>"},
+		{[]string{"rm"}, "usage: qs rm [flags] <key>"},
+		{[]string{"stat", "a", "b"}, "usage: qs stat [flags] <key>"},
+		{[]string{"ls", "-nope"}, "flag provided but not defined: -nope"},
+		{[]string{"serve", "-nope"}, "flag provided but not defined: -nope"},
+		{[]string{"disconnect"}, "usage: qs disconnect [flags] <addr>"},
+		{[]string{"repair", "a", "b"}, "usage: qs repair [flags] <key>"},
+		// The admin commands do not go through the HTTP gateway.
+		{[]string{"status", "-addr", "127.0.0.1:8080"}, "flag provided but not defined: -addr"},
+	} {
+		if _, err := run(t, tc.args...); err == nil || err.Error() != tc.want {
+			t.Errorf("%v: want %s have %v", tc.args, tc.want, err)
+		}
+	}
+}
+
+func TestClientPaths(t *testing.T) {
+	if c := newClient("qs.sock", "127.0.0.1:8080/"); c.base != "http://127.0.0.1:8080" {
+		t.Errorf("want the scheme added and the slash trimmed have %s", c.base)
+	}
+	if c := newClient("qs.sock", "https://node:8443"); c.base != "https://node:8443" {
+		t.Errorf("want the address kept have %s", c.base)
+	}
+	if c := newClient("qs.sock", ""); c.base != "http://qs" {
+		t.Errorf("want the socket used have %s", c.base)
+	}
+	if path := objectPath("pictures/my picture", url.Values{"version": {"v1"}}); path != "/objects/pictures%2Fmy%20picture?version=v1" {
+		t.Errorf("want the key escaped have %s", path)
+	}
+}
+
+func TestClientCommands(t *testing.T) {
+	addr := serveHTTP(t, newTestGateway(t))
+	dir := t.TempDir()
+	file := filepath.Join(dir, "picture.jpg")
+	if err := os.WriteFile(file, []byte("some jpeg bytes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := run(t, "put", "-addr", addr, "-consistency", "one", "pictures/picture", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, "stored pictures/picture (15 bytes) as version ") || !strings.HasSuffix(out, ", 1 acks\n") {
+		t.Errorf("unexpected put output %q", out)
+	}
+	version := strings.TrimSuffix(strings.Fields(out)[6], ",")
+
+	// A put reads the file from stdin with "-".
+	stdin := os.Stdin
+	os.Stdin, _ = os.Open(file)
+	_, err = run(t, "put", "-addr", addr, "from stdin", "-")
+	os.Stdin.Close()
+	os.Stdin = stdin
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out, err := run(t, "get", "-addr", addr, "pictures/picture"); err != nil || out != "some jpeg bytes" {
+		t.Errorf("want some jpeg bytes have (%v) %s", err, out)
+	}
+	if out, err := run(t, "get", "-addr", addr, "from stdin"); err != nil || out != "some jpeg bytes" {
+		t.Errorf("want the file put from stdin have (%v) %s", err, out)
+	}
+	saved := filepath.Join(dir, "saved.jpg")
+	if _, err := run(t, "get", "-addr", addr, "-version", version, "-o", saved, "pictures/picture"); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(saved); string(b) != "some jpeg bytes" {
+		t.Errorf("want the version written to the file have %s", b)
+	}
+
+	if out, err := run(t, "ls", "-addr", addr); err != nil || out != "from stdin\npictures/picture\n" {
+		t.Errorf("want the 2 keys listed have (%v) %q", err, out)
+	}
+
+	out, err = run(t, "stat", "-addr", addr, "pictures/picture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"key:      pictures/picture\n", "size:     15\n", "version:  " + version + "\n", "versions:\n  " + version + "  15 bytes"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("want %q in the stat output have %s", want, out)
+		}
+	}
+
+	if out, err := run(t, "peers", "-addr", addr); err != nil || strings.TrimSpace(out) != "ADDR  DIRECTION  STATE  RTT" {
+		t.Errorf("want no peer listed have (%v) %q", err, out)
+	}
+
+	if _, err := run(t, "rm", "-addr", addr, "pictures/picture"); err != nil {
+		t.Fatal(err)
+	}
+	// The errors of the gateway are turned into the errors of the commands.
+	if _, err := run(t, "get", "-addr", addr, "pictures/picture"); err == nil {
+		t.Error("want an error getting a deleted file")
+	}
+	if _, err := run(t, "stat", "-addr", addr, "pictures/picture"); err == nil || !strings.HasPrefix(err.Error(), "stat pictures/picture:") {
+		t.Errorf("want an error from stat have %v", err)
+	}
+	if _, err := run(t, "get", "-addr", addr, "-consistency", "most", "from stdin"); err == nil || !strings.Contains(err.Error(), "most") {
+		t.Errorf("want the error of the gateway have %v", err)
+	}
+}
+
+func TestClientSocket(t *testing.T) {
+	socket := serveSocket(t, newTestGateway(t))
+	file := filepath.Join(t.TempDir(), "picture.jpg")
+	if err := os.WriteFile(file, []byte("some jpeg bytes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := run(t, "put", "-socket", socket, "picture", file); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := run(t, "get", "-socket", socket, "picture"); err != nil || out != "some jpeg bytes" {
+		t.Errorf("want some jpeg bytes have (%v) %s", err, out)
+	}
+	if out, err := run(t, "ls", "-socket", socket); err != nil || out != "picture\n" {
+		t.Errorf("want the key listed have (%v) %q", err, out)
+	}
+
+	// Without a node on the socket the commands fail.
+	if _, err := run(t, "ls", "-socket", filepath.Join(t.TempDir(), "none.sock")); err == nil {
+		t.Error("want an error without a node on the socket")
+	}
+}
+
+func TestAdminCommands(t *testing.T) {
+	g := newTestGateway(t)
+	addr := serveHTTP(t, g)
+	socket := serveSocket(t, g)
+	file := filepath.Join(t.TempDir(), "picture.jpg")
+	if err := os.WriteFile(file, []byte("some jpeg bytes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run(t, "put", "-addr", addr, "picture", file); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := run(t, "status", "-socket", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"node:    ", "store:   1 objects, ", "queues:  0 messages in the inbox, 0 bytes of hints\n", "\npeers:\n", "\ntransfers:\n", "\nerrors:\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("want %q in the status output have %s", want, out)
+		}
+	}
+
+	if _, err := run(t, "disconnect", "-socket", socket, "127.0.0.1:5000"); err == nil || !strings.Contains(err.Error(), "unknown peer") {
+		t.Errorf("want an unknown peer have %v", err)
+	}
+	if out, err := run(t, "repair", "-socket", socket, "picture"); err != nil || out != "every replica is up to date\n" {
+		t.Errorf("want every replica up to date have (%v) %q", err, out)
+	}
+	if _, err := run(t, "repair", "-socket", socket, "missing"); err == nil {
+		t.Error("want an error repairing a missing file")
+	}
+
+	// The HTTP gateway of the same node does not serve the admin routes.
+	resp, err := newClient("", addr).do(http.MethodGet, "/admin/status", nil)
+	if err == nil {
+		resp.Body.Close()
+		t.Error("want the admin routes left out of the HTTP gateway")
+	}
+}
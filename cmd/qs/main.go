@@ -0,0 +1,14 @@
+// Command qs runs a quantumsync node and talks to a running one, see "qs help".
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	if err := runCLI(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "qs:", err)
+		os.Exit(1)
+	}
+}
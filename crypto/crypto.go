@@ -1,4 +1,6 @@
-package main
+// Package crypto holds the encryption used by quantumsync, files travel between the nodes
+// encrypted with AES in CTR mode, the random IV is written in front of the data.
+package crypto
 
 import (
 	"crypto/aes"
@@ -9,18 +11,21 @@ import (
 	"io"
 )
 
-func generateID() string {
+// GenerateID returns a random 32 byte hex encoded ID.
+func GenerateID() string {
 	buf := make([]byte, 32)
 	io.ReadFull(rand.Reader, buf)
 	return hex.EncodeToString(buf)
 }
 
-func hashKey(key string) string {
+// HashKey is the md5 of the key, the name a file is known by on the peers.
+func HashKey(key string) string {
 	hash := md5.Sum([]byte(key))
 	return hex.EncodeToString(hash[:])
 }
 
-func newEncryptionKey() []byte {
+// NewEncryptionKey returns a random AES-256 key.
+func NewEncryptionKey() []byte {
 	keyBuf := make([]byte, 32)
 	io.ReadFull(rand.Reader, keyBuf)
 	return keyBuf
@@ -53,7 +58,7 @@ func copyStream(stream cipher.Stream, blockSize int, src io.Reader, dst io.Write
 
 // The function encrypts the data from an io.Reader and write the encrypted data on the io.Writer
 // using the AES encryption algorithm in CTR mode.
-func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+func CopyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return 0, err
@@ -76,7 +81,7 @@ func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 }
 
 // This function decrypts the data based on the key, which is unique to each server and is stored in EncKey
-func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+func CopyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return 0, err
@@ -1,4 +1,4 @@
-package main
+package crypto
 
 import (
 	"bytes"
@@ -9,15 +9,15 @@ func TestCopyEncrypt(t *testing.T) {
 	payLoad := "Hello World"
 	src := bytes.NewReader([]byte(payLoad))
 	dst := new(bytes.Buffer)
-	key := newEncryptionKey()
+	key := NewEncryptionKey()
 
-	_, err := copyEncrypt(key, src, dst)
+	_, err := CopyEncrypt(key, src, dst)
 	if err != nil {
 		t.Error(err)
 	}
 
 	out := new(bytes.Buffer)
-	nw, err := copyDecrypt(key, dst, out)
+	nw, err := CopyDecrypt(key, dst, out)
 	if err != nil {
 		t.Error(err)
 	}
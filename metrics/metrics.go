@@ -0,0 +1,411 @@
+// Package metrics keeps the counters, gauges and histograms of a node and writes them in the
+// Prometheus text format. A Registry is an http.Handler serving them, so it can be scraped by
+// Prometheus or read with curl.
+//
+// The metrics are made by the Registry and looked up by name, asking for a metric that already
+// exists returns it, so the parts of a node share a registry without coordinating. The methods of
+// a nil metric do nothing.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefBuckets are the upper bounds of the histogram buckets for latencies, in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds the metrics of a node.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+const (
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+)
+
+// family is a metric and its series, one per combination of label values.
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+	// fn gives the value of a gauge computed when scraped.
+	fn func() float64
+}
+
+type series struct {
+	values []string
+	metric any
+}
+
+// family returns the metric of that name, it is made the first time. Asking for an existing
+// name with another kind or other labels is a bug, it panics.
+func (r *Registry) family(name, help, kind string, buckets []float64, labels []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{
+			name:    name,
+			help:    help,
+			kind:    kind,
+			labels:  labels,
+			buckets: buckets,
+			series:  make(map[string]*series),
+		}
+		r.families[name] = f
+		return f
+	}
+	if f.kind != kind || strings.Join(f.labels, ",") != strings.Join(labels, ",") {
+		panic(fmt.Sprintf("metrics: %s registered as a %s with labels (%s)", name, f.kind, strings.Join(f.labels, ",")))
+	}
+	return f
+}
+
+// with returns the series of the label values, it is made the first time.
+func (r *Registry) with(f *family, values []string) any {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, %d values given", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		switch f.kind {
+		case kindCounter:
+			s.metric = &Counter{}
+		case kindGauge:
+			s.metric = &Gauge{}
+		case kindHistogram:
+			s.metric = newHistogram(f.buckets)
+		}
+		f.series[key] = s
+	}
+	return s.metric
+}
+
+func (r *Registry) Counter(name, help string) *Counter {
+	return r.with(r.family(name, help, kindCounter, nil, nil), nil).(*Counter)
+}
+
+func (r *Registry) CounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r: r, f: r.family(name, help, kindCounter, nil, labels)}
+}
+
+func (r *Registry) Gauge(name, help string) *Gauge {
+	return r.with(r.family(name, help, kindGauge, nil, nil), nil).(*Gauge)
+}
+
+func (r *Registry) GaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r: r, f: r.family(name, help, kindGauge, nil, labels)}
+}
+
+// GaugeFunc registers a gauge whose value is fn when scraped, registering it again replaces fn.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	f := r.family(name, help, kindGauge, nil, nil)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f.fn = fn
+}
+
+// Histogram returns a histogram with the given bucket upper bounds, DefBuckets when nil.
+func (r *Registry) Histogram(name, help string, buckets []float64) *Histogram {
+	return r.with(r.family(name, help, kindHistogram, sortedBuckets(buckets), nil), nil).(*Histogram)
+}
+
+func (r *Registry) HistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{r: r, f: r.family(name, help, kindHistogram, sortedBuckets(buckets), labels)}
+}
+
+func sortedBuckets(buckets []float64) []float64 {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return buckets
+}
+
+// Counter is a value that only goes up, like the number of bytes sent.
+type Counter struct {
+	bits atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds v, which must not be negative.
+func (c *Counter) Add(v float64) {
+	if c == nil {
+		return
+	}
+	addFloat(&c.bits, v)
+}
+
+func (c *Counter) Value() float64 {
+	if c == nil {
+		return 0
+	}
+	return math.Float64frombits(c.bits.Load())
+}
+
+// Gauge is a value that goes up and down, like the number of peers.
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+func (g *Gauge) Set(v float64) {
+	if g == nil {
+		return
+	}
+	g.bits.Store(math.Float64bits(v))
+}
+
+func (g *Gauge) Add(v float64) {
+	if g == nil {
+		return
+	}
+	addFloat(&g.bits, v)
+}
+
+func (g *Gauge) Inc() { g.Add(1) }
+func (g *Gauge) Dec() { g.Add(-1) }
+
+func (g *Gauge) Value() float64 {
+	if g == nil {
+		return 0
+	}
+	return math.Float64frombits(g.bits.Load())
+}
+
+func addFloat(bits *atomic.Uint64, v float64) {
+	for {
+		old := bits.Load()
+		if bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// Histogram counts the values observed in buckets, like the latencies of the requests.
+type Histogram struct {
+	buckets []float64
+	mu      sync.Mutex
+	// counts[i] is the number of values in bucket i alone, the last one is for the values above
+	// every bound. They are summed up when written.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	if h == nil {
+		return
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// ObserveSince observes the seconds gone by since start.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Count returns the number of values observed.
+func (h *Histogram) Count() uint64 {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+type CounterVec struct {
+	r *Registry
+	f *family
+}
+
+// With returns the counter of the label values, given in the order of the labels.
+func (v *CounterVec) With(values ...string) *Counter {
+	if v == nil {
+		return nil
+	}
+	return v.r.with(v.f, values).(*Counter)
+}
+
+type GaugeVec struct {
+	r *Registry
+	f *family
+}
+
+func (v *GaugeVec) With(values ...string) *Gauge {
+	if v == nil {
+		return nil
+	}
+	return v.r.with(v.f, values).(*Gauge)
+}
+
+type HistogramVec struct {
+	r *Registry
+	f *family
+}
+
+func (v *HistogramVec) With(values ...string) *Histogram {
+	if v == nil {
+		return nil
+	}
+	return v.r.with(v.f, values).(*Histogram)
+}
+
+// WriteTo writes every metric in the Prometheus text format, sorted by name and label values.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	type snapshot struct {
+		f      *family
+		fn     func() float64
+		series []*series
+	}
+	families := make([]snapshot, 0, len(names))
+	for _, name := range names {
+		f := r.families[name]
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		snap := snapshot{f: f, fn: f.fn}
+		for _, key := range keys {
+			snap.series = append(snap.series, f.series[key])
+		}
+		families = append(families, snap)
+	}
+	r.mu.Unlock()
+
+	// The gauge funcs are called without the lock, they might take a while.
+	buf := new(bytes.Buffer)
+	for _, snap := range families {
+		f := snap.f
+		if len(snap.series) == 0 && snap.fn == nil {
+			continue
+		}
+		fmt.Fprintf(buf, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(buf, "# TYPE %s %s\n", f.name, f.kind)
+		if snap.fn != nil {
+			writeSample(buf, f.name, nil, nil, "", "", snap.fn())
+		}
+		for _, s := range snap.series {
+			switch m := s.metric.(type) {
+			case *Counter:
+				writeSample(buf, f.name, f.labels, s.values, "", "", m.Value())
+			case *Gauge:
+				writeSample(buf, f.name, f.labels, s.values, "", "", m.Value())
+			case *Histogram:
+				m.mu.Lock()
+				var cumulative uint64
+				for i, bound := range m.buckets {
+					cumulative += m.counts[i]
+					writeSample(buf, f.name+"_bucket", f.labels, s.values, "le", formatFloat(bound), float64(cumulative))
+				}
+				writeSample(buf, f.name+"_bucket", f.labels, s.values, "le", "+Inf", float64(m.count))
+				writeSample(buf, f.name+"_sum", f.labels, s.values, "", "", m.sum)
+				writeSample(buf, f.name+"_count", f.labels, s.values, "", "", float64(m.count))
+				m.mu.Unlock()
+			}
+		}
+	}
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+func writeSample(w io.Writer, name string, labels, values []string, extra, extraValue string, v float64) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 || len(extra) > 0 {
+		b.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=\"%s\"", label, escapeLabel(values[i]))
+		}
+		if len(extra) > 0 {
+			if len(labels) > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=\"%s\"", extra, extraValue)
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(v))
+	b.WriteByte('\n')
+	io.WriteString(w, b.String())
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+// ContentType is the content type of the Prometheus text format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// ServeHTTP writes the metrics, it is meant to be served on /metrics.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.WriteTo(w)
+}
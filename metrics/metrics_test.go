@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryText(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("qs_messages_total", "Messages received.").Add(3)
+	requests := r.CounterVec("qs_requests_total", "Requests served.", "op", "result")
+	requests.With("store", "ok").Inc()
+	requests.With("get", "error").Inc()
+	// Asking again for the same metric returns it.
+	r.CounterVec("qs_requests_total", "Requests served.", "op", "result").With("store", "ok").Inc()
+	r.GaugeVec("qs_connections", "Open connections.", "direction").With("inbound").Set(2)
+	r.GaugeFunc("qs_disk_usage_bytes", "Bytes on disk.", func() float64 { return 1024 })
+	h := r.Histogram("qs_latency_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.1)
+	h.Observe(3)
+	r.CounterVec("qs_label_total", "Escaped \\ help.", "path").With("a\"b\\c\nd").Inc()
+
+	want := `# HELP qs_connections Open connections.
+# TYPE qs_connections gauge
+qs_connections{direction="inbound"} 2
+# HELP qs_disk_usage_bytes Bytes on disk.
+# TYPE qs_disk_usage_bytes gauge
+qs_disk_usage_bytes 1024
+# HELP qs_label_total Escaped \\ help.
+# TYPE qs_label_total counter
+qs_label_total{path="a\"b\\c\nd"} 1
+# HELP qs_latency_seconds Latency.
+# TYPE qs_latency_seconds histogram
+qs_latency_seconds_bucket{le="0.1"} 2
+qs_latency_seconds_bucket{le="1"} 2
+qs_latency_seconds_bucket{le="+Inf"} 3
+qs_latency_seconds_sum 3.15
+qs_latency_seconds_count 3
+# HELP qs_messages_total Messages received.
+# TYPE qs_messages_total counter
+qs_messages_total 3
+# HELP qs_requests_total Requests served.
+# TYPE qs_requests_total counter
+qs_requests_total{op="get",result="error"} 1
+qs_requests_total{op="store",result="ok"} 2
+`
+	buf := new(strings.Builder)
+	if _, err := r.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != want {
+		t.Errorf("want\n%s\nhave\n%s", want, buf)
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("want content type %s have %s", ContentType, ct)
+	}
+	if rec.Body.String() != want {
+		t.Errorf("want the same text served, have\n%s", rec.Body)
+	}
+}
+
+func TestRegistryMismatch(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("qs_total", "A counter.")
+	defer func() {
+		if recover() == nil {
+			t.Error("want a panic registering a counter as a gauge")
+		}
+	}()
+	r.Gauge("qs_total", "A gauge.")
+}
+
+func TestNilMetrics(t *testing.T) {
+	var c *Counter
+	var g *Gauge
+	var h *Histogram
+	var v *CounterVec
+	c.Inc()
+	g.Set(1)
+	h.Observe(1)
+	v.With("a").Inc()
+	if c.Value() != 0 || g.Value() != 0 || h.Count() != 0 {
+		t.Error("want nil metrics to stay at zero")
+	}
+}
@@ -0,0 +1,202 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ashirwad-maker/quantumsync/crypto"
+)
+
+// Status is what a node is up to, as served on GET /admin/status of the control socket.
+type Status struct {
+	Addr string `json:"addr"`
+	ID   string `json:"id"`
+	// Peers are the peers connected and the ones being redialed.
+	Peers []PeerInfo `json:"peers"`
+	// Transfers are the files being streamed to or from the peers.
+	Transfers []Transfer   `json:"transfers"`
+	Queues    QueueStats   `json:"queues"`
+	Store     StoreStats   `json:"store"`
+	Errors    []ErrorEntry `json:"errors"`
+}
+
+// QueueStats are the depths of the queues of the server.
+type QueueStats struct {
+	// Inbox is the number of messages of the peers waiting for a worker.
+	Inbox int `json:"inbox"`
+	// HintBytes is the size of the writes handed off for the peers that were unreachable.
+	HintBytes int64 `json:"hint_bytes"`
+}
+
+// StoreStats describe the files on the local disk.
+type StoreStats struct {
+	// Objects is the number of keys stored, Bytes the disk space taken by their versions.
+	Objects int   `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// ErrorEntry is a warning or an error logged by the server.
+type ErrorEntry struct {
+	Time    time.Time         `json:"time"`
+	Level   string            `json:"level"`
+	Message string            `json:"message"`
+	Attrs   map[string]string `json:"attrs,omitempty"`
+}
+
+// ErrUnknownPeer is returned for an address that is not one of the peers.
+var ErrUnknownPeer = errors.New("unknown peer")
+
+// Status reports the peers, the transfers in progress, the queues, the files stored and the last
+// warnings and errors logged.
+func (s *FileServer) Status() (*Status, error) {
+	keys, err := s.store.Keys()
+	if err != nil {
+		return nil, err
+	}
+	usage, err := s.store.DiskUsage()
+	if err != nil {
+		return nil, err
+	}
+	return &Status{
+		Addr:      s.Transport.Addr(),
+		ID:        s.store.ID,
+		Peers:     s.Peers(),
+		Transfers: s.transfers.list(),
+		Queues: QueueStats{
+			Inbox:     s.inbox.len(),
+			HintBytes: s.hints.Size(),
+		},
+		Store:  StoreStats{Objects: len(keys), Bytes: usage},
+		Errors: s.errors.list(),
+	}, nil
+}
+
+// DisconnectPeer closes the connection to the peer. A peer we dialed is redialed, as after any
+// other disconnect.
+func (s *FileServer) DisconnectPeer(addr string) error {
+	peer, ok := s.peer(addr)
+	if !ok {
+		return fmt.Errorf("%w (%s)", ErrUnknownPeer, addr)
+	}
+	s.log.Info("disconnecting peer", "peer", addr)
+	return peer.Close()
+}
+
+// Repair asks every peer connected for the latest version of the key and sends it to the ones
+// that are behind, or do not have the file, as a read does in the background. It returns the
+// addresses of the peers repaired.
+func (s *FileServer) Repair(key string) (_ []string, err error) {
+	defer s.metrics.observe("repair", time.Now(), &err)
+	ctx, span := s.startSpan(context.Background(), "repair", slog.String("key", crypto.HashKey(key)))
+	defer endSpan(span, &err)
+	if err := s.begin(); err != nil {
+		return nil, err
+	}
+	defer s.inflight.Done()
+
+	peers, _ := s.peerSnapshot()
+	replicas, _ := s.fetchAll(ctx, key, "", peers)
+	latest, err := s.store.LatestVersion(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.readRepair(ctx, key, latest.ID, replicas), nil
+}
+
+// maxErrorEntries is the number of warnings and errors kept for Status.
+const maxErrorEntries = 100
+
+// recentErrors keeps the last warnings and errors logged, whatever the level of the logger.
+type recentErrors struct {
+	mu      sync.Mutex
+	entries []ErrorEntry
+	// next is where the next entry goes once the ring is full.
+	next int
+}
+
+func (e *recentErrors) add(entry ErrorEntry) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.entries) < maxErrorEntries {
+		e.entries = append(e.entries, entry)
+		return
+	}
+	e.entries[e.next] = entry
+	e.next = (e.next + 1) % maxErrorEntries
+}
+
+// list returns the entries, oldest first.
+func (e *recentErrors) list() []ErrorEntry {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	list := make([]ErrorEntry, 0, len(e.entries))
+	list = append(list, e.entries[e.next:]...)
+	return append(list, e.entries[:e.next]...)
+}
+
+// errorsHandler hands the records to the handler of the logger and keeps the warnings and errors
+// in recent.
+type errorsHandler struct {
+	next   slog.Handler
+	recent *recentErrors
+	attrs  []slog.Attr
+	group  string
+}
+
+func (h *errorsHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelWarn || h.next.Enabled(ctx, level)
+}
+
+func (h *errorsHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		entry := ErrorEntry{Time: r.Time, Level: r.Level.String(), Message: r.Message, Attrs: make(map[string]string)}
+		for _, a := range h.attrs {
+			addAttr(entry.Attrs, "", a)
+		}
+		r.Attrs(func(a slog.Attr) bool {
+			addAttr(entry.Attrs, h.group, a)
+			return true
+		})
+		h.recent.add(entry)
+	}
+	if !h.next.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *errorsHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.next = h.next.WithAttrs(attrs)
+	h2.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, a := range attrs {
+		if len(h.group) > 0 {
+			a.Key = h.group + a.Key
+		}
+		h2.attrs = append(h2.attrs, a)
+	}
+	return &h2
+}
+
+func (h *errorsHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.next = h.next.WithGroup(name)
+	h2.group = h.group + name + "."
+	return &h2
+}
+
+// addAttr adds the attribute to m as a string, the groups are flattened into dotted keys.
+func addAttr(m map[string]string, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		for _, ga := range v.Group() {
+			addAttr(m, prefix+a.Key+".", ga)
+		}
+		return
+	}
+	m[prefix+a.Key] = v.String()
+}
@@ -0,0 +1,153 @@
+package node
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ashirwad-maker/quantumsync/crypto"
+	"github.com/ashirwad-maker/quantumsync/p2p"
+)
+
+func TestFileServerStatus(t *testing.T) {
+	network := p2p.NewMemNetwork()
+	newMemServer(t, network, ":3000")
+	time.Sleep(10 * time.Millisecond)
+	s2 := newMemServer(t, network, ":4000", ":3000")
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := s2.StoreWith("picture", strings.NewReader("some jpeg bytes"), WriteOpts{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+	// Logged below the level of the logger, the warnings are kept anyway.
+	s2.log.Warn("disk is slow", "peer", ":3000")
+
+	status, err := s2.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Addr != ":4000" || status.ID != s2.ID {
+		t.Errorf("want the address and the ID of the node have %s %s", status.Addr, status.ID)
+	}
+	if status.Store.Objects != 1 || status.Store.Bytes == 0 {
+		t.Errorf("want the file in the store stats have %+v", status.Store)
+	}
+	if len(status.Peers) != 1 {
+		t.Fatalf("want 1 peer have %d", len(status.Peers))
+	}
+	if p := status.Peers[0]; !p.Outbound || p.ConnectedAt.IsZero() || p.BytesSent == 0 || p.BytesReceived == 0 {
+		t.Errorf("want the stats of the connection have %+v", p)
+	}
+	if len(status.Transfers) != 0 {
+		t.Errorf("want no transfer once the write is done have %+v", status.Transfers)
+	}
+	if len(status.Errors) != 1 || status.Errors[0].Message != "disk is slow" || status.Errors[0].Attrs["peer"] != ":3000" || status.Errors[0].Attrs["node"] != ":4000" {
+		t.Errorf("want the warning in the recent errors have %+v", status.Errors)
+	}
+}
+
+func TestTransfers(t *testing.T) {
+	list := newTransfers()
+	tr := list.start(Transfer{Peer: ":3000", Key: "key", Direction: "send", Size: 10})
+	other := list.start(Transfer{Peer: ":4000", Key: "key", Direction: "receive", Size: 10})
+	defer other.done()
+
+	var buf bytes.Buffer
+	tr.writer(&buf).Write([]byte("hello"))
+	transfers := list.list()
+	if len(transfers) != 2 || transfers[0].ID != tr.ID || transfers[0].Bytes != 5 || transfers[1].Bytes != 0 {
+		t.Fatalf("want the progress of the 2 transfers have %+v", transfers)
+	}
+	tr.done()
+	if transfers := list.list(); len(transfers) != 1 || transfers[0].ID != other.ID {
+		t.Errorf("want the transfer done dropped have %+v", transfers)
+	}
+}
+
+func TestRecentErrors(t *testing.T) {
+	var recent recentErrors
+	for i := 0; i < maxErrorEntries+5; i++ {
+		recent.add(ErrorEntry{Message: string(rune('a' + i%26))})
+	}
+	entries := recent.list()
+	if len(entries) != maxErrorEntries {
+		t.Fatalf("want %d entries have %d", maxErrorEntries, len(entries))
+	}
+	// The 5 oldest were dropped.
+	if entries[0].Message != "f" || entries[len(entries)-1].Message != string(rune('a'+(maxErrorEntries+4)%26)) {
+		t.Errorf("want the entries oldest first have %s ... %s", entries[0].Message, entries[len(entries)-1].Message)
+	}
+}
+
+func TestFileServerDisconnectPeer(t *testing.T) {
+	network := p2p.NewMemNetwork()
+	s1 := newMemServer(t, network, ":3000")
+	time.Sleep(10 * time.Millisecond)
+	s2 := newMemServerWith(t, network, FileServerOpts{RedialInterval: 20 * time.Millisecond}, ":4000", ":3000")
+	time.Sleep(50 * time.Millisecond)
+
+	if err := s2.DisconnectPeer(":5000"); !errors.Is(err, ErrUnknownPeer) {
+		t.Fatalf("want ErrUnknownPeer have %v", err)
+	}
+	before := s2.Peers()[0].ConnectedAt
+	if err := s2.DisconnectPeer(":3000"); err != nil {
+		t.Fatal(err)
+	}
+
+	// s2 dialed s1, so it dials it again.
+	deadline := time.Now().Add(time.Second)
+	for {
+		peers := s2.Peers()
+		if len(peers) == 1 && peers[0].Connected && peers[0].ConnectedAt.After(before) && len(s1.Peers()) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want the peer redialed have %+v", peers)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFileServerRepair(t *testing.T) {
+	network := p2p.NewMemNetwork()
+	s1 := newMemServer(t, network, ":3000")
+	time.Sleep(10 * time.Millisecond)
+	s2 := newMemServer(t, network, ":4000", ":3000")
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := s2.StoreWith("picture", strings.NewReader("some jpeg bytes"), WriteOpts{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+	repaired, err := s2.Repair("picture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repaired) != 0 {
+		t.Errorf("want nothing repaired while the replicas agree have %v", repaired)
+	}
+
+	// The replica on s1 is lost, as when its disk was replaced.
+	if err := s1.store.Delete(crypto.HashKey("picture")); err != nil {
+		t.Fatal(err)
+	}
+	repaired, err = s2.Repair("picture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repaired) != 1 || repaired[0] != ":3000" {
+		t.Fatalf("want s1 repaired have %v", repaired)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !s1.hasLocal(crypto.HashKey("picture"), "") {
+		if time.Now().After(deadline) {
+			t.Fatal("want the file back on s1")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := s2.Repair("missing"); err == nil {
+		t.Error("want an error repairing a file nobody has")
+	}
+}
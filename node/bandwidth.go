@@ -0,0 +1,178 @@
+package node
+
+import (
+	"io"
+	"sync"
+)
+
+// TrafficClass tells the replication traffic asked for by the users from the one the nodes make
+// on their own, so the background traffic can be throttled harder.
+type TrafficClass int
+
+const (
+	// TrafficUser is the traffic of Store and Get.
+	TrafficUser TrafficClass = iota
+	// TrafficRepair is the traffic catching the replicas up, the hint replays and the read repairs.
+	TrafficRepair
+)
+
+func (c TrafficClass) String() string {
+	if c == TrafficRepair {
+		return "repair"
+	}
+	return "user"
+}
+
+// Rates are in bytes per second, zero means no limit.
+type Rates struct {
+	Upload   float64 `json:"upload"`
+	Download float64 `json:"download"`
+}
+
+// BandwidthLimits throttle the replication traffic. Every byte sent or received counts against
+// the global rates, the rates of its peer and the rates of its traffic class.
+type BandwidthLimits struct {
+	Global Rates `json:"global"`
+	Peer   Rates `json:"peer"`
+	User   Rates `json:"user"`
+	Repair Rates `json:"repair"`
+}
+
+func (l BandwidthLimits) class(c TrafficClass) Rates {
+	if c == TrafficRepair {
+		return l.Repair
+	}
+	return l.User
+}
+
+// throttleChunk is the most bytes read or written at once by a throttled stream, so a limiter
+// lets the bytes through in small steps rather than one burst per copy buffer.
+const throttleChunk = 16 * 1024
+
+type direction int
+
+const (
+	upload direction = iota
+	download
+)
+
+// limiterPair holds the upload and the download limiter of a scope.
+type limiterPair [2]*RateLimiter
+
+func newLimiterPair(r Rates) limiterPair {
+	return limiterPair{NewRateLimiter(r.Upload, 0), NewRateLimiter(r.Download, 0)}
+}
+
+func (p limiterPair) set(r Rates) {
+	p[upload].SetRate(r.Upload, 0)
+	p[download].SetRate(r.Download, 0)
+}
+
+// Bandwidth throttles the streams to and from the peers, its limits can be changed while they
+// are in use.
+type Bandwidth struct {
+	mu     sync.Mutex
+	limits BandwidthLimits
+	global limiterPair
+	class  map[TrafficClass]limiterPair
+	peers  map[string]limiterPair
+}
+
+func NewBandwidth(limits BandwidthLimits) *Bandwidth {
+	return &Bandwidth{
+		limits: limits,
+		global: newLimiterPair(limits.Global),
+		class: map[TrafficClass]limiterPair{
+			TrafficUser:   newLimiterPair(limits.User),
+			TrafficRepair: newLimiterPair(limits.Repair),
+		},
+		peers: make(map[string]limiterPair),
+	}
+}
+
+func (b *Bandwidth) Limits() BandwidthLimits {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limits
+}
+
+// SetLimits changes the limits, the streams in progress are throttled to them straight away.
+func (b *Bandwidth) SetLimits(limits BandwidthLimits) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limits = limits
+	b.global.set(limits.Global)
+	for c, p := range b.class {
+		p.set(limits.class(c))
+	}
+	for _, p := range b.peers {
+		p.set(limits.Peer)
+	}
+}
+
+// forget drops the limiters of a peer that went away.
+func (b *Bandwidth) forget(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.peers, addr)
+}
+
+func (b *Bandwidth) limiters(addr string, class TrafficClass, dir direction) []*RateLimiter {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	peer, ok := b.peers[addr]
+	if !ok {
+		peer = newLimiterPair(b.limits.Peer)
+		b.peers[addr] = peer
+	}
+	return []*RateLimiter{b.global[dir], b.class[class][dir], peer[dir]}
+}
+
+// Writer throttles the bytes written to the peer.
+func (b *Bandwidth) Writer(w io.Writer, addr string, class TrafficClass) io.Writer {
+	return &throttledWriter{w: w, limiters: b.limiters(addr, class, upload)}
+}
+
+// Reader throttles the bytes read from the peer.
+func (b *Bandwidth) Reader(r io.Reader, addr string, class TrafficClass) io.Reader {
+	return &throttledReader{r: r, limiters: b.limiters(addr, class, download)}
+}
+
+type throttledWriter struct {
+	w        io.Writer
+	limiters []*RateLimiter
+}
+
+func (t *throttledWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), throttleChunk)]
+		for _, l := range t.limiters {
+			l.WaitN(len(chunk))
+		}
+		n, err := t.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// throttledReader waits after a read for the bytes it got, the sender is held back by the
+// connection filling up in the meantime.
+type throttledReader struct {
+	r        io.Reader
+	limiters []*RateLimiter
+}
+
+func (t *throttledReader) Read(b []byte) (int, error) {
+	n, err := t.r.Read(b[:min(len(b), throttleChunk)])
+	if n > 0 {
+		for _, l := range t.limiters {
+			l.WaitN(n)
+		}
+	}
+	return n, err
+}
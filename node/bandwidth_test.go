@@ -0,0 +1,97 @@
+package node
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// timeCopy copies n bytes through the throttled writer and returns how long it took.
+func timeCopy(t *testing.T, w io.Writer, n int) time.Duration {
+	t.Helper()
+	start := time.Now()
+	if _, err := io.Copy(w, bytes.NewReader(make([]byte, n))); err != nil {
+		t.Fatal(err)
+	}
+	return time.Since(start)
+}
+
+func TestBandwidth(t *testing.T) {
+	// A second worth of bytes goes through in a burst, the rest at the rate.
+	b := NewBandwidth(BandwidthLimits{Peer: Rates{Upload: 100 << 10}})
+	if took := timeCopy(t, b.Writer(io.Discard, "peer", TrafficUser), 150<<10); took < 400*time.Millisecond {
+		t.Errorf("want the upload throttled, took %s", took)
+	}
+	// Every peer has its own limit, the downloads are not limited.
+	if took := timeCopy(t, b.Writer(io.Discard, "other peer", TrafficUser), 100<<10); took > 100*time.Millisecond {
+		t.Errorf("want the other peer not throttled, took %s", took)
+	}
+	start := time.Now()
+	if _, err := io.Copy(io.Discard, b.Reader(bytes.NewReader(make([]byte, 1<<20)), "peer", TrafficUser)); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > 100*time.Millisecond {
+		t.Errorf("want the download not throttled, took %s", took)
+	}
+
+	// The limits apply to the streams in progress once changed.
+	w := b.Writer(io.Discard, "peer", TrafficUser)
+	b.SetLimits(BandwidthLimits{})
+	if took := timeCopy(t, w, 1<<20); took > 100*time.Millisecond {
+		t.Errorf("want the limit lifted, took %s", took)
+	}
+}
+
+func TestBandwidthClass(t *testing.T) {
+	b := NewBandwidth(BandwidthLimits{Repair: Rates{Download: 100 << 10}})
+
+	start := time.Now()
+	if _, err := io.Copy(io.Discard, b.Reader(bytes.NewReader(make([]byte, 150<<10)), "peer", TrafficRepair)); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took < 400*time.Millisecond {
+		t.Errorf("want the repair download throttled, took %s", took)
+	}
+	if took := timeCopy(t, b.Writer(io.Discard, "peer", TrafficRepair), 1<<20); took > 100*time.Millisecond {
+		t.Errorf("want the repair upload not throttled, took %s", took)
+	}
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	l := NewRateLimiter(10, 0)
+	l.WaitN(10)
+
+	// Changing the rate keeps the bucket empty, there is no new burst.
+	l.SetRate(10, 0)
+	if l.Allow() {
+		t.Error("want no token right after the rate changed")
+	}
+
+	// A wait started on the old rate is woken up by the new one.
+	done := make(chan time.Duration)
+	go func() {
+		start := time.Now()
+		l.WaitN(10)
+		done <- time.Since(start)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	l.SetRate(0, 0)
+	if took := <-done; took > 500*time.Millisecond {
+		t.Errorf("want the wait cut short by the limit lifted, took %s", took)
+	}
+
+	// A slower rate makes the waits in progress longer.
+	l.SetRate(1000, 0)
+	l.WaitN(1000)
+	go func() {
+		start := time.Now()
+		l.WaitN(100)
+		done <- time.Since(start)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	l.SetRate(100, 100)
+	if took := <-done; took < 500*time.Millisecond {
+		t.Errorf("want the wait slowed down by the new rate, took %s", took)
+	}
+}
@@ -0,0 +1,515 @@
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/ashirwad-maker/quantumsync/p2p"
+	"github.com/ashirwad-maker/quantumsync/store"
+	"github.com/ashirwad-maker/quantumsync/trace"
+)
+
+// Codec encodes the messages the nodes exchange, every node of a network has to use the same.
+type Codec interface {
+	Encode(w io.Writer, msg *Message) error
+	Decode(r io.Reader, msg *Message) error
+}
+
+// GobCodec encodes the messages with encoding/gob, it is the default. The type descriptors are
+// sent along with every message, and only Go peers can read it.
+type GobCodec struct{}
+
+func (GobCodec) Encode(w io.Writer, msg *Message) error {
+	return gob.NewEncoder(w).Encode(msg)
+}
+
+func (GobCodec) Decode(r io.Reader, msg *Message) error {
+	return gob.NewDecoder(r).Decode(msg)
+}
+
+// ErrMessageTooLarge is returned for a message that encodes to more than p2p.MaxMessageSize,
+// the peers read a message in a single read of that size.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// encodeMessage encodes a message sent on its own as a p2p.IncomingMessage. The size is checked
+// here for every codec, as a message the peer only reads part of can not be decoded.
+func encodeMessage(codec Codec, msg *Message) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := codec.Encode(buf, msg); err != nil {
+		return nil, err
+	}
+	if buf.Len() > p2p.MaxMessageSize {
+		return nil, fmt.Errorf("%w: (%T) is %d bytes, at most %d fit", ErrMessageTooLarge, msg.Payload, buf.Len(), p2p.MaxMessageSize)
+	}
+	return buf.Bytes(), nil
+}
+
+// MessageType is the ID of a message in the BinaryCodec, the field number of the payload in the
+// Envelope of docs/quantumsync.proto.
+type MessageType uint64
+
+const (
+	TypeStoreFile  MessageType = 1
+	TypeGetFile    MessageType = 2
+	TypeStoreAck   MessageType = 3
+	TypeDeleteFile MessageType = 4
+	TypeGoodbye    MessageType = 5
+	TypeFileHeader MessageType = 6
+	TypeHello      MessageType = 7
+)
+
+// envelopeTrace is the field of the Envelope carrying the span context, out of the range of the
+// message types.
+const envelopeTrace = 15
+
+// BinaryCodec encodes the messages in the protobuf wire format, following the schema of
+// docs/quantumsync.proto, so peers in other languages can generate their code from it. The fields
+// unknown to the decoder are skipped, which lets the schema grow.
+type BinaryCodec struct{}
+
+// ErrUnknownMessage is returned by BinaryCodec.Decode for a message type it does not know.
+var ErrUnknownMessage = errors.New("unknown message type")
+
+// The wire types of protobuf.
+const (
+	wireVarint = 0
+	wire64     = 1
+	wireBytes  = 2
+	wire32     = 5
+)
+
+func (BinaryCodec) Encode(w io.Writer, msg *Message) error {
+	var e protoEncoder
+	switch v := msg.Payload.(type) {
+	case MessageStoreFile:
+		e.message(uint64(TypeStoreFile), encodeStoreFile(v))
+	case MessageGetFile:
+		var p protoEncoder
+		p.string(1, v.Key)
+		p.string(2, v.Version)
+		p.uint(3, v.ID)
+		e.message(uint64(TypeGetFile), p.buf)
+	case MessageStoreAck:
+		var p protoEncoder
+		p.string(1, v.Key)
+		p.string(2, v.Version)
+		p.int(3, v.Bytes)
+		p.string(4, v.Digest)
+		p.string(5, v.Err)
+		e.message(uint64(TypeStoreAck), p.buf)
+	case MessageDeleteFile:
+		var p protoEncoder
+		p.string(1, v.Key)
+		e.message(uint64(TypeDeleteFile), p.buf)
+	case MessageGoodbye:
+		e.message(uint64(TypeGoodbye), nil)
+	case fileHeader:
+		var p protoEncoder
+		p.int(1, v.Size)
+		p.string(2, v.Version)
+		if v.Meta != nil {
+			p.message(3, encodeVersionMeta(*v.Meta))
+		}
+		p.bool(4, v.Missing)
+		p.bool(5, v.Busy)
+		p.uint(6, v.ID)
+		e.message(uint64(TypeFileHeader), p.buf)
+	case MessageHello:
+		var p protoEncoder
+		p.string(1, v.ID)
+		e.message(uint64(TypeHello), p.buf)
+	default:
+		return fmt.Errorf("%w (%T)", ErrUnknownMessage, msg.Payload)
+	}
+	if msg.Trace.IsValid() {
+		var p protoEncoder
+		p.bytes(1, msg.Trace.TraceID[:])
+		p.bytes(2, msg.Trace.SpanID[:])
+		p.bool(3, msg.Trace.Sampled)
+		e.message(envelopeTrace, p.buf)
+	}
+	_, err := w.Write(e.buf)
+	return err
+}
+
+func encodeStoreFile(v MessageStoreFile) []byte {
+	var p protoEncoder
+	p.string(1, v.Key)
+	p.int(2, v.Size)
+	p.string(3, v.Version)
+	p.message(4, encodeVersionMeta(v.Meta))
+	p.bool(5, v.Repair)
+	return p.buf
+}
+
+func encodeVersionMeta(m store.VersionMeta) []byte {
+	var ts protoEncoder
+	ts.int(1, m.Timestamp.WallTime)
+	ts.uint(2, uint64(m.Timestamp.Logical))
+
+	var p protoEncoder
+	p.message(1, ts.buf)
+	p.string(2, m.Node)
+	// The entries of a map are sorted so that a message always encodes to the same bytes.
+	nodes := make([]string, 0, len(m.Clock))
+	for node := range m.Clock {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		var entry protoEncoder
+		entry.string(1, node)
+		entry.uint(2, m.Clock[node])
+		p.message(3, entry.buf)
+	}
+	return p.buf
+}
+
+// Decode reads the rest of r as one message.
+func (BinaryCodec) Decode(r io.Reader, msg *Message) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var payload any
+	var sc trace.SpanContext
+	err = decodeFields(b, func(num uint64, d *protoField) error {
+		if num == envelopeTrace {
+			return decodeFields(d.bytes, func(num uint64, d *protoField) error {
+				switch num {
+				case 1:
+					copy(sc.TraceID[:], d.bytes)
+				case 2:
+					copy(sc.SpanID[:], d.bytes)
+				case 3:
+					sc.Sampled = d.varint != 0
+				}
+				return nil
+			})
+		}
+		switch MessageType(num) {
+		case TypeStoreFile:
+			v, err := decodeStoreFile(d.bytes)
+			payload = v
+			return err
+		case TypeGetFile:
+			var v MessageGetFile
+			err := decodeFields(d.bytes, func(num uint64, d *protoField) error {
+				switch num {
+				case 1:
+					v.Key = d.string()
+				case 2:
+					v.Version = d.string()
+				case 3:
+					v.ID = d.varint
+				}
+				return nil
+			})
+			payload = v
+			return err
+		case TypeStoreAck:
+			var v MessageStoreAck
+			err := decodeFields(d.bytes, func(num uint64, d *protoField) error {
+				switch num {
+				case 1:
+					v.Key = d.string()
+				case 2:
+					v.Version = d.string()
+				case 3:
+					v.Bytes = int64(d.varint)
+				case 4:
+					v.Digest = d.string()
+				case 5:
+					v.Err = d.string()
+				}
+				return nil
+			})
+			payload = v
+			return err
+		case TypeDeleteFile:
+			var v MessageDeleteFile
+			err := decodeFields(d.bytes, func(num uint64, d *protoField) error {
+				if num == 1 {
+					v.Key = d.string()
+				}
+				return nil
+			})
+			payload = v
+			return err
+		case TypeGoodbye:
+			payload = MessageGoodbye{}
+		case TypeHello:
+			var v MessageHello
+			err := decodeFields(d.bytes, func(num uint64, d *protoField) error {
+				if num == 1 {
+					v.ID = d.string()
+				}
+				return nil
+			})
+			payload = v
+			return err
+		case TypeFileHeader:
+			var v fileHeader
+			err := decodeFields(d.bytes, func(num uint64, d *protoField) error {
+				switch num {
+				case 1:
+					v.Size = int64(d.varint)
+				case 2:
+					v.Version = d.string()
+				case 3:
+					meta, err := decodeVersionMeta(d.bytes)
+					v.Meta = &meta
+					return err
+				case 4:
+					v.Missing = d.varint != 0
+				case 5:
+					v.Busy = d.varint != 0
+				case 6:
+					v.ID = d.varint
+				}
+				return nil
+			})
+			payload = v
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if payload == nil {
+		return ErrUnknownMessage
+	}
+	msg.Payload = payload
+	msg.Trace = sc
+	return nil
+}
+
+func decodeStoreFile(b []byte) (MessageStoreFile, error) {
+	var v MessageStoreFile
+	err := decodeFields(b, func(num uint64, d *protoField) error {
+		switch num {
+		case 1:
+			v.Key = d.string()
+		case 2:
+			v.Size = int64(d.varint)
+		case 3:
+			v.Version = d.string()
+		case 4:
+			meta, err := decodeVersionMeta(d.bytes)
+			v.Meta = meta
+			return err
+		case 5:
+			v.Repair = d.varint != 0
+		}
+		return nil
+	})
+	return v, err
+}
+
+func decodeVersionMeta(b []byte) (store.VersionMeta, error) {
+	var m store.VersionMeta
+	err := decodeFields(b, func(num uint64, d *protoField) error {
+		switch num {
+		case 1:
+			return decodeFields(d.bytes, func(num uint64, d *protoField) error {
+				switch num {
+				case 1:
+					m.Timestamp.WallTime = int64(d.varint)
+				case 2:
+					m.Timestamp.Logical = uint32(d.varint)
+				}
+				return nil
+			})
+		case 2:
+			m.Node = d.string()
+		case 3:
+			var node string
+			var counter uint64
+			err := decodeFields(d.bytes, func(num uint64, d *protoField) error {
+				switch num {
+				case 1:
+					node = d.string()
+				case 2:
+					counter = d.varint
+				}
+				return nil
+			})
+			if m.Clock == nil {
+				m.Clock = make(store.VectorClock)
+			}
+			m.Clock[node] = counter
+			return err
+		}
+		return nil
+	})
+	return m, err
+}
+
+// protoEncoder appends fields in the protobuf wire format, the fields holding their zero value
+// are left out as proto3 does.
+type protoEncoder struct {
+	buf []byte
+}
+
+func (e *protoEncoder) tag(num uint64, wireType uint64) {
+	e.buf = binary.AppendUvarint(e.buf, num<<3|wireType)
+}
+
+func (e *protoEncoder) uint(num uint64, v uint64) {
+	if v == 0 {
+		return
+	}
+	e.tag(num, wireVarint)
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+// int encodes an int64 as protobuf does, a negative number takes ten bytes.
+func (e *protoEncoder) int(num uint64, v int64) {
+	e.uint(num, uint64(v))
+}
+
+func (e *protoEncoder) bool(num uint64, v bool) {
+	if v {
+		e.uint(num, 1)
+	}
+}
+
+func (e *protoEncoder) string(num uint64, v string) {
+	if len(v) == 0 {
+		return
+	}
+	e.tag(num, wireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *protoEncoder) bytes(num uint64, v []byte) {
+	e.string(num, string(v))
+}
+
+// message embeds an encoded message, it is written even when empty as its presence can matter.
+func (e *protoEncoder) message(num uint64, v []byte) {
+	e.tag(num, wireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// protoField is a field read off the wire, varint holds the numbers and bytes the strings and
+// the embedded messages.
+type protoField struct {
+	varint uint64
+	bytes  []byte
+}
+
+func (f *protoField) string() string {
+	return string(f.bytes)
+}
+
+var errMalformed = errors.New("malformed message")
+
+// decodeFields calls fn with every field of the encoded message.
+func decodeFields(b []byte, fn func(num uint64, f *protoField) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errMalformed
+		}
+		b = b[n:]
+		num, wireType := tag>>3, tag&7
+		if num == 0 || num > math.MaxInt32 {
+			return errMalformed
+		}
+
+		var f protoField
+		switch wireType {
+		case wireVarint:
+			if f.varint, n = binary.Uvarint(b); n <= 0 {
+				return errMalformed
+			}
+			b = b[n:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return errMalformed
+			}
+			f.bytes = b[n : n+int(size)]
+			b = b[n+int(size):]
+		case wire64:
+			if len(b) < 8 {
+				return errMalformed
+			}
+			f.varint = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case wire32:
+			if len(b) < 4 {
+				return errMalformed
+			}
+			f.varint = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			return fmt.Errorf("%w: wire type %d", errMalformed, wireType)
+		}
+		if err := fn(num, &f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMessageFrame writes the message encoded by the codec and length prefixed, so raw bytes
+// can follow it on the same stream.
+func writeMessageFrame(w io.Writer, codec Codec, msg *Message) (int64, error) {
+	buf := new(bytes.Buffer)
+	if err := codec.Encode(buf, msg); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(buf.Len())); err != nil {
+		return 0, err
+	}
+	n, err := w.Write(buf.Bytes())
+	return int64(4 + n), err
+}
+
+func readMessageFrame(r io.Reader, codec Codec, msg *Message) error {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	return codec.Decode(bytes.NewReader(buf), msg)
+}
+
+// writeHeader writes the fileHeader of a reply to MessageGetFile. The gob codec keeps sending the
+// bare header the nodes before the codecs expect, the others send it as a message.
+func writeHeader(w io.Writer, codec Codec, hdr fileHeader) (int64, error) {
+	if _, ok := codec.(GobCodec); ok {
+		return writeFrame(w, hdr)
+	}
+	return writeMessageFrame(w, codec, &Message{Payload: hdr})
+}
+
+func readHeader(r io.Reader, codec Codec, hdr *fileHeader) error {
+	if _, ok := codec.(GobCodec); ok {
+		return readFrame(r, hdr)
+	}
+	var msg Message
+	if err := readMessageFrame(r, codec, &msg); err != nil {
+		return err
+	}
+	v, ok := msg.Payload.(fileHeader)
+	if !ok {
+		return fmt.Errorf("want a file header have (%T)", msg.Payload)
+	}
+	*hdr = v
+	return nil
+}
@@ -0,0 +1,207 @@
+package node
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ashirwad-maker/quantumsync/crypto"
+	"github.com/ashirwad-maker/quantumsync/p2p"
+	"github.com/ashirwad-maker/quantumsync/store"
+	"github.com/ashirwad-maker/quantumsync/trace"
+)
+
+func testMessages() []Message {
+	meta := store.VersionMeta{
+		Timestamp: store.Timestamp{WallTime: 1700000000000000000, Logical: 3},
+		Node:      "node-a",
+		Clock:     store.VectorClock{"node-a": 4, "node-b": 1},
+	}
+	return []Message{
+		{Payload: MessageStoreFile{Key: "picture", Size: 1040, Version: "v1", Meta: meta}},
+		{Payload: MessageStoreFile{Key: "picture", Size: 1040, Version: "v1", Meta: meta, Repair: true}},
+		{Payload: MessageGetFile{Key: "picture", Version: "v1", ID: 7}},
+		{Payload: MessageGetFile{Key: "picture"}, Trace: trace.SpanContext{TraceID: trace.TraceID{1, 2}, SpanID: trace.SpanID{3}, Sampled: true}},
+		{Payload: MessageStoreAck{Key: "picture", Version: "v1", Bytes: 1040, Digest: "ab12", Err: "disk full"}},
+		{Payload: MessageDeleteFile{Key: "picture"}},
+		{Payload: MessageGoodbye{}},
+		{Payload: MessageHello{ID: "node-a"}},
+		{Payload: fileHeader{Size: 1040, Version: "v1", Meta: &meta, ID: 7}},
+		{Payload: fileHeader{Version: "v1", Missing: true}},
+		{Payload: fileHeader{Version: "v1", Busy: true}},
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{GobCodec{}, BinaryCodec{}} {
+		for _, msg := range testMessages() {
+			buf := new(bytes.Buffer)
+			if err := codec.Encode(buf, &msg); err != nil {
+				t.Fatalf("%T: %s", codec, err)
+			}
+			var have Message
+			if err := codec.Decode(buf, &have); err != nil {
+				t.Fatalf("%T: %s", codec, err)
+			}
+			if !reflect.DeepEqual(have, msg) {
+				t.Errorf("%T: want %+v have %+v", codec, msg, have)
+			}
+		}
+	}
+}
+
+func TestBinaryCodecWire(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := (BinaryCodec{}).Encode(buf, &Message{Payload: MessageGetFile{Key: "a", Version: "v1"}}); err != nil {
+		t.Fatal(err)
+	}
+	// Field 2 (GetFile) of the envelope, holding the key "a" (field 1) and the version "v1" (field 2).
+	want := []byte{0x12, 0x07, 0x0a, 0x01, 'a', 0x12, 0x02, 'v', '1'}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("want % x have % x", want, buf.Bytes())
+	}
+
+	// The ID of the request is field 3.
+	buf.Reset()
+	if err := (BinaryCodec{}).Encode(buf, &Message{Payload: MessageGetFile{Key: "a", ID: 42}}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x12, 0x05, 0x0a, 0x01, 'a', 0x18, 0x2a}; !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("want % x have % x", want, buf.Bytes())
+	}
+
+	// The fields a newer node might add are skipped.
+	unknown := []byte{0x12, 0x0e, 0x0a, 0x01, 'a', 0x28, 0x2a, 0x22, 0x01, 'x', 0x12, 0x02, 'v', '1', 0x78, 0x01}
+	var msg Message
+	if err := (BinaryCodec{}).Decode(bytes.NewReader(unknown), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if want := (MessageGetFile{Key: "a", Version: "v1"}); msg.Payload != want {
+		t.Errorf("want %+v have %+v", want, msg.Payload)
+	}
+
+	if err := (BinaryCodec{}).Decode(bytes.NewReader([]byte{0x42, 0x00}), &msg); !errors.Is(err, ErrUnknownMessage) {
+		t.Errorf("want %s have %v", ErrUnknownMessage, err)
+	}
+	if err := (BinaryCodec{}).Decode(bytes.NewReader([]byte{0x12, 0x07, 0x0a}), &msg); err == nil {
+		t.Error("want an error for a truncated message")
+	}
+}
+
+func TestBinaryCodecSize(t *testing.T) {
+	for _, msg := range testMessages() {
+		gob, binary := new(bytes.Buffer), new(bytes.Buffer)
+		if err := (GobCodec{}).Encode(gob, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := (BinaryCodec{}).Encode(binary, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if binary.Len() >= gob.Len() {
+			t.Errorf("%T: want the binary encoding smaller than gob, have %d and %d bytes", msg.Payload, binary.Len(), gob.Len())
+		}
+	}
+}
+
+func TestFileServerBinaryCodec(t *testing.T) {
+	network := p2p.NewMemNetwork()
+	s1 := newMemServerWith(t, network, FileServerOpts{Codec: BinaryCodec{}}, ":3000")
+	time.Sleep(10 * time.Millisecond)
+	s2 := newMemServerWith(t, network, FileServerOpts{Codec: BinaryCodec{}}, ":4000", ":3000")
+	time.Sleep(50 * time.Millisecond)
+
+	result, err := s2.StoreWith("picture", bytes.NewReader([]byte("some jpeg bytes")), WriteOpts{Consistency: ConsistencyAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Acks != 2 {
+		t.Errorf("want 2 acks have %d", result.Acks)
+	}
+	if !s1.store.Has(crypto.HashKey("picture")) {
+		t.Error("want the file replicated to the peer")
+	}
+
+	// The peer answers the read with a file header framed by its length, followed by its copy of
+	// the file. The messages before it went in a single read, encodeMessage turns down the ones
+	// encoding to more than p2p.MaxMessageSize, 2048 bytes.
+	obj, err := s2.GetWith("picture", ReadOpts{Consistency: ConsistencyAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "some jpeg bytes" {
+		t.Errorf("want %q have %q", "some jpeg bytes", b)
+	}
+}
+
+func TestFileServerCodecMismatch(t *testing.T) {
+	network := p2p.NewMemNetwork()
+	s1 := newMemServerWith(t, network, FileServerOpts{}, ":3000")
+	time.Sleep(10 * time.Millisecond)
+	s2 := newMemServerWith(t, network, FileServerOpts{Codec: BinaryCodec{}}, ":4000", ":3000")
+	time.Sleep(50 * time.Millisecond)
+
+	// The handshake keeps the nodes from talking past each other.
+	if n := len(s1.peerList()) + len(s2.peerList()); n != 0 {
+		t.Errorf("want the nodes not connected, have %d peers", n)
+	}
+}
+
+// bigClock returns the vector clock of a key written by n nodes over time.
+func bigClock(n int) store.VectorClock {
+	clock := store.VectorClock{}
+	for i := 0; i < n; i++ {
+		clock[fmt.Sprintf("node-%03d", i)] = uint64(i + 1)
+	}
+	return clock
+}
+
+func TestEncodeMessageTooLarge(t *testing.T) {
+	for _, codec := range []Codec{GobCodec{}, BinaryCodec{}} {
+		for _, msg := range testMessages() {
+			if _, err := encodeMessage(codec, &msg); err != nil {
+				t.Errorf("%T: %s", codec, err)
+			}
+		}
+
+		msg := Message{Payload: MessageStoreFile{Key: "picture", Version: "v1", Meta: store.VersionMeta{Node: "node-000", Clock: bigClock(200)}}}
+		if _, err := encodeMessage(codec, &msg); !errors.Is(err, ErrMessageTooLarge) {
+			t.Errorf("%T: want %s have %v", codec, ErrMessageTooLarge, err)
+		}
+	}
+}
+
+func TestFileServerMessageTooLarge(t *testing.T) {
+	network := p2p.NewMemNetwork()
+	s1 := newMemServer(t, network, ":3000")
+	time.Sleep(10 * time.Millisecond)
+	s2 := newMemServer(t, network, ":4000", ":3000")
+	time.Sleep(50 * time.Millisecond)
+
+	// The next write of the key has seen this version, its clock is too large to be sent.
+	meta := &store.VersionMeta{Timestamp: store.Timestamp{WallTime: 1}, Node: s2.store.ID, Clock: bigClock(200)}
+	if _, err := s2.store.WriteVersion("picture", store.FormatVersionID(meta.Timestamp, meta.Node), meta, bytes.NewReader([]byte("old jpeg bytes"))); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := s2.StoreWith("picture", bytes.NewReader([]byte("some jpeg bytes")), WriteOpts{Consistency: ConsistencyOne})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Peers) != 1 || !errors.Is(result.Peers[0].Err, ErrMessageTooLarge) {
+		t.Errorf("want the message to the peer turned down have %+v", result.Peers)
+	}
+	if result.Acks != 1 {
+		t.Errorf("want the write acked by s2 alone have %d acks", result.Acks)
+	}
+	if s1.store.Has(crypto.HashKey("picture")) {
+		t.Error("want nothing written on the peer")
+	}
+}
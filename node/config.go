@@ -0,0 +1,659 @@
+package node
+
+import (
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ashirwad-maker/quantumsync/crypto"
+	"github.com/ashirwad-maker/quantumsync/p2p"
+	"github.com/ashirwad-maker/quantumsync/store"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the settings of a node, LoadConfig reads it from a YAML, TOML or JSON file.
+// Every setting can also be set with an environment variable named after its section and key,
+// QS_TRANSPORT_LISTEN_ADDR sets transport.listen_addr for example. Lists are comma separated.
+type Config struct {
+	Transport   TransportConfig   `yaml:"transport" toml:"transport" json:"transport"`
+	Store       StoreConfig       `yaml:"store" toml:"store" json:"store"`
+	Crypto      CryptoConfig      `yaml:"crypto" toml:"crypto" json:"crypto"`
+	Replication ReplicationConfig `yaml:"replication" toml:"replication" json:"replication"`
+	Logging     LoggingConfig     `yaml:"logging" toml:"logging" json:"logging"`
+	Tracing     TracingConfig     `yaml:"tracing" toml:"tracing" json:"tracing"`
+	Limits      LimitsConfig      `yaml:"limits" toml:"limits" json:"limits"`
+	Gateway     GatewayConfig     `yaml:"gateway" toml:"gateway" json:"gateway"`
+}
+
+type TransportConfig struct {
+	// Network is "tcp", "unix" for nodes on the same host, the listen address and the bootstrap
+	// nodes are then the paths of their sockets, or "ws" to go through HTTP proxies, the bootstrap
+	// nodes can then also be ws:// or wss:// URLs, or "quic" to run over UDP with a stream per
+	// message.
+	Network    string `yaml:"network" toml:"network" json:"network"`
+	ListenAddr string `yaml:"listen_addr" toml:"listen_addr" json:"listen_addr"`
+	// Bootstrap are the nodes dialed on start, the ones added on a reload are dialed then.
+	Bootstrap []string `yaml:"bootstrap" toml:"bootstrap" json:"bootstrap"`
+	// Handshake is run on every new connection, "version" agrees on the protocol version with the
+	// peer and drops the incompatible ones, "none" talks to the nodes from before the handshake.
+	Handshake string `yaml:"handshake" toml:"handshake" json:"handshake"`
+	// Decoder reads the messages off the connections, only "default" reads the framing the peers
+	// write, p2p.GOBDecoder can not.
+	Decoder string `yaml:"decoder" toml:"decoder" json:"decoder"`
+	// Codec encodes the messages, "gob" or "binary" for the compact encoding of docs/protocol.md,
+	// all the nodes of a network have to use the same.
+	Codec string `yaml:"codec" toml:"codec" json:"codec"`
+	// SocketMode is the permissions of the unix socket of the node, who can connect to it.
+	SocketMode FileMode `yaml:"socket_mode" toml:"socket_mode" json:"socket_mode"`
+	// HeartbeatInterval is how often the peers are pinged, a peer nothing was heard from for
+	// IdleTimeout (three heartbeats when zero) is dropped. Zero disables the heartbeats.
+	HeartbeatInterval Duration `yaml:"heartbeat_interval" toml:"heartbeat_interval" json:"heartbeat_interval"`
+	IdleTimeout       Duration `yaml:"idle_timeout" toml:"idle_timeout" json:"idle_timeout"`
+	// ReadTimeout and WriteTimeout bound every read and write on the connections, zero means no limit.
+	ReadTimeout  Duration `yaml:"read_timeout" toml:"read_timeout" json:"read_timeout"`
+	WriteTimeout Duration `yaml:"write_timeout" toml:"write_timeout" json:"write_timeout"`
+	// MaxInbound and MaxOutbound limit the peers accepted and dialed, MaxConnsPerIP the peers
+	// accepted from one IP address, zero means no limit. Allow and Deny are CIDRs filtering the
+	// peers accepted, Deny wins and an empty Allow lets in every address not denied.
+	MaxInbound    int      `yaml:"max_inbound" toml:"max_inbound" json:"max_inbound"`
+	MaxOutbound   int      `yaml:"max_outbound" toml:"max_outbound" json:"max_outbound"`
+	MaxConnsPerIP int      `yaml:"max_conns_per_ip" toml:"max_conns_per_ip" json:"max_conns_per_ip"`
+	Allow         []string `yaml:"allow" toml:"allow" json:"allow"`
+	Deny          []string `yaml:"deny" toml:"deny" json:"deny"`
+}
+
+type StoreConfig struct {
+	// Root defaults to <port>quantumsyncnetwork.
+	Root string `yaml:"root" toml:"root" json:"root"`
+	// PathTransform lays the keys out on disk, "cas" or "default".
+	PathTransform string   `yaml:"path_transform" toml:"path_transform" json:"path_transform"`
+	Versioning    bool     `yaml:"versioning" toml:"versioning" json:"versioning"`
+	MaxVersions   int      `yaml:"max_versions" toml:"max_versions" json:"max_versions"`
+	MaxVersionAge Duration `yaml:"max_version_age" toml:"max_version_age" json:"max_version_age"`
+	KeepSiblings  bool     `yaml:"keep_siblings" toml:"keep_siblings" json:"keep_siblings"`
+}
+
+type CryptoConfig struct {
+	// Key is the hex encoded encryption key of the node. KeyFile is a file holding it instead,
+	// a new key is written to it if it does not exist. Without either a new key is made on every start.
+	Key     string `yaml:"key" toml:"key" json:"key"`
+	KeyFile string `yaml:"key_file" toml:"key_file" json:"key_file"`
+}
+
+// ReplicationConfig maps onto the FileServerOpts of the same name, zero values keep their defaults.
+type ReplicationConfig struct {
+	ReadConsistency  Consistency `yaml:"read_consistency" toml:"read_consistency" json:"read_consistency"`
+	WriteConsistency Consistency `yaml:"write_consistency" toml:"write_consistency" json:"write_consistency"`
+	AckTimeout       Duration    `yaml:"ack_timeout" toml:"ack_timeout" json:"ack_timeout"`
+	MaxHintBytes     int64       `yaml:"max_hint_bytes" toml:"max_hint_bytes" json:"max_hint_bytes"`
+	HintTTL          Duration    `yaml:"hint_ttl" toml:"hint_ttl" json:"hint_ttl"`
+	RedialInterval   Duration    `yaml:"redial_interval" toml:"redial_interval" json:"redial_interval"`
+	Workers          int         `yaml:"workers" toml:"workers" json:"workers"`
+	InboxSize        int         `yaml:"inbox_size" toml:"inbox_size" json:"inbox_size"`
+}
+
+type LoggingConfig struct {
+	// Level is "debug", "info", "warn", "error" or "off".
+	Level string `yaml:"level" toml:"level" json:"level"`
+	// Format is "text" for key=value lines or "json" for a JSON object per line.
+	Format string `yaml:"format" toml:"format" json:"format"`
+	// Output is the file the logs are appended to, stderr when empty.
+	Output string `yaml:"output" toml:"output" json:"output"`
+}
+
+type TracingConfig struct {
+	// Endpoint is the URL of the OpenTelemetry collector the spans are posted to over OTLP/HTTP,
+	// as http://localhost:4318/v1/traces. Tracing is off when empty.
+	Endpoint string `yaml:"endpoint" toml:"endpoint" json:"endpoint"`
+	// Service is the service.name of the spans.
+	Service string `yaml:"service" toml:"service" json:"service"`
+}
+
+type LimitsConfig struct {
+	// MaxObjectSize is the largest file the gateway takes, zero means no limit.
+	MaxObjectSize int64 `yaml:"max_object_size" toml:"max_object_size" json:"max_object_size"`
+	// RequestsPerSecond limits the requests served by the gateway, zero means no limit.
+	RequestsPerSecond float64 `yaml:"requests_per_second" toml:"requests_per_second" json:"requests_per_second"`
+	// The rest throttle the replication traffic, in bytes per second, zero means no limit. The
+	// upload and download limits are for the whole node, the peer ones for every peer, the repair
+	// ones for the hint replays and read repairs and the user ones for the rest.
+	UploadBytesPerSecond         float64 `yaml:"upload_bytes_per_second" toml:"upload_bytes_per_second" json:"upload_bytes_per_second"`
+	DownloadBytesPerSecond       float64 `yaml:"download_bytes_per_second" toml:"download_bytes_per_second" json:"download_bytes_per_second"`
+	PeerUploadBytesPerSecond     float64 `yaml:"peer_upload_bytes_per_second" toml:"peer_upload_bytes_per_second" json:"peer_upload_bytes_per_second"`
+	PeerDownloadBytesPerSecond   float64 `yaml:"peer_download_bytes_per_second" toml:"peer_download_bytes_per_second" json:"peer_download_bytes_per_second"`
+	UserUploadBytesPerSecond     float64 `yaml:"user_upload_bytes_per_second" toml:"user_upload_bytes_per_second" json:"user_upload_bytes_per_second"`
+	UserDownloadBytesPerSecond   float64 `yaml:"user_download_bytes_per_second" toml:"user_download_bytes_per_second" json:"user_download_bytes_per_second"`
+	RepairUploadBytesPerSecond   float64 `yaml:"repair_upload_bytes_per_second" toml:"repair_upload_bytes_per_second" json:"repair_upload_bytes_per_second"`
+	RepairDownloadBytesPerSecond float64 `yaml:"repair_download_bytes_per_second" toml:"repair_download_bytes_per_second" json:"repair_download_bytes_per_second"`
+}
+
+type GatewayConfig struct {
+	// HTTP is the address of the HTTP gateway, disabled when empty.
+	HTTP   string `yaml:"http" toml:"http" json:"http"`
+	Socket string `yaml:"socket" toml:"socket" json:"socket"`
+	// SocketMode is the permissions of the control socket, who can run the qs commands.
+	SocketMode FileMode `yaml:"socket_mode" toml:"socket_mode" json:"socket_mode"`
+	// Metrics is the address Prometheus scrapes /metrics on, disabled when empty.
+	Metrics string `yaml:"metrics" toml:"metrics" json:"metrics"`
+}
+
+// reloadableSettings are picked up by a running node on SIGHUP, the others need a restart.
+var reloadableSettings = map[string]bool{
+	"transport.bootstrap":                     true,
+	"logging.level":                           true,
+	"limits.requests_per_second":              true,
+	"limits.upload_bytes_per_second":          true,
+	"limits.download_bytes_per_second":        true,
+	"limits.peer_upload_bytes_per_second":     true,
+	"limits.peer_download_bytes_per_second":   true,
+	"limits.user_upload_bytes_per_second":     true,
+	"limits.user_download_bytes_per_second":   true,
+	"limits.repair_upload_bytes_per_second":   true,
+	"limits.repair_download_bytes_per_second": true,
+}
+
+// Duration is a time.Duration written as "1m30s" in the config.
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// FileMode is a file permission written in octal as "0660" in the config.
+type FileMode os.FileMode
+
+func (m FileMode) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%04o", uint32(m))), nil
+}
+
+func (m *FileMode) UnmarshalText(b []byte) error {
+	v, err := strconv.ParseUint(string(b), 8, 32)
+	if err != nil || v > 0777 {
+		return fmt.Errorf("invalid file mode (%s), want an octal permission like 0600", b)
+	}
+	*m = FileMode(v)
+	return nil
+}
+
+// DefaultConfig returns the settings used for everything the config file leaves out.
+func DefaultConfig() *Config {
+	return &Config{
+		Transport: TransportConfig{
+			Network:    "tcp",
+			ListenAddr: ":3000",
+			Handshake:  "version",
+			Decoder:    "default",
+			Codec:      "gob",
+			SocketMode: FileMode(p2p.DefaultSocketMode),
+
+			HeartbeatInterval: Duration(5 * time.Second),
+			ReadTimeout:       Duration(30 * time.Second),
+			WriteTimeout:      Duration(30 * time.Second),
+
+			MaxInbound:  256,
+			MaxOutbound: 256,
+		},
+		Store:   StoreConfig{PathTransform: "cas"},
+		Logging: LoggingConfig{Level: "info", Format: "text"},
+		Tracing: TracingConfig{Service: "quantumsync"},
+		Gateway: GatewayConfig{Socket: DefaultSocket(), SocketMode: FileMode(p2p.DefaultSocketMode)},
+	}
+}
+
+// DefaultSocket is the control socket of a node, $QS_SOCKET or qs.sock in the current folder.
+func DefaultSocket() string {
+	if socket := os.Getenv("QS_SOCKET"); len(socket) > 0 {
+		return socket
+	}
+	return "qs.sock"
+}
+
+// LoadConfig reads the config file on top of the defaults, applies the environment overrides
+// and validates the result. An empty path only uses the defaults and the environment.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	if len(path) > 0 {
+		if err := cfg.readFile(path); err != nil {
+			return nil, fmt.Errorf("config %s: %w", path, err)
+		}
+	}
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readFile decodes the file according to its extension, unknown keys are an error so that a
+// typo does not go unnoticed.
+func (c *Config) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		return nil
+	case ".json":
+		return decodeJSON(f, c)
+	case ".toml":
+		dec := toml.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		return dec.Decode(c)
+	default:
+		return fmt.Errorf("unknown config format (%s), use .yaml, .toml or .json", ext)
+	}
+}
+
+func decodeJSON(r io.Reader, c *Config) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	return dec.Decode(c)
+}
+
+// eachSetting calls fn with the name, as in "store.max_versions", and the value of every setting.
+func (c *Config) eachSetting(fn func(name string, v reflect.Value)) {
+	sections := reflect.ValueOf(c).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		prefix := settingName(sections.Type().Field(i))
+		for j := 0; j < section.NumField(); j++ {
+			fn(prefix+"."+settingName(section.Type().Field(j)), section.Field(j))
+		}
+	}
+}
+
+func settingName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	return name
+}
+
+// envName is the environment variable overriding the setting.
+func envName(setting string) string {
+	return "QS_" + strings.ToUpper(strings.ReplaceAll(setting, ".", "_"))
+}
+
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	var errs []error
+	c.eachSetting(func(name string, v reflect.Value) {
+		env := envName(name)
+		s, ok := lookup(env)
+		if !ok {
+			return
+		}
+		if err := setSetting(v, s); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", env, err))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+func setSetting(v reflect.Value, s string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported setting type (%s)", v.Type())
+	}
+	return nil
+}
+
+// Validate checks every setting and reports all the invalid ones at once.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(setting string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", setting, err))
+		}
+	}
+
+	check("transport.network", oneOf(c.Transport.Network, "tcp", "unix", "ws", "quic"))
+	validatePeerAddr := validateAddr
+	switch c.Transport.Network {
+	case "unix":
+		validatePeerAddr = validatePath
+		check("transport.listen_addr", validatePath(c.Transport.ListenAddr))
+	case "ws":
+		validatePeerAddr = validateWSAddr
+		check("transport.listen_addr", validateAddr(c.Transport.ListenAddr))
+	default:
+		check("transport.listen_addr", validateAddr(c.Transport.ListenAddr))
+	}
+	for i, addr := range c.Transport.Bootstrap {
+		check(fmt.Sprintf("transport.bootstrap[%d]", i), validatePeerAddr(addr))
+	}
+	check("transport.handshake", oneOf(c.Transport.Handshake, "version", "none"))
+	check("transport.decoder", oneOf(c.Transport.Decoder, "default"))
+	check("transport.codec", oneOf(c.Transport.Codec, "gob", "binary"))
+	check("transport.heartbeat_interval", notNegative(int64(c.Transport.HeartbeatInterval)))
+	check("transport.idle_timeout", notNegative(int64(c.Transport.IdleTimeout)))
+	check("transport.read_timeout", notNegative(int64(c.Transport.ReadTimeout)))
+	check("transport.write_timeout", notNegative(int64(c.Transport.WriteTimeout)))
+	check("transport.max_inbound", notNegative(int64(c.Transport.MaxInbound)))
+	check("transport.max_outbound", notNegative(int64(c.Transport.MaxOutbound)))
+	check("transport.max_conns_per_ip", notNegative(int64(c.Transport.MaxConnsPerIP)))
+	_, err := p2p.ParsePrefixes(c.Transport.Allow)
+	check("transport.allow", err)
+	_, err = p2p.ParsePrefixes(c.Transport.Deny)
+	check("transport.deny", err)
+
+	check("store.path_transform", oneOf(c.Store.PathTransform, "cas", "default"))
+	check("store.max_versions", notNegative(int64(c.Store.MaxVersions)))
+	check("store.max_version_age", notNegative(int64(c.Store.MaxVersionAge)))
+
+	if len(c.Crypto.Key) > 0 {
+		if len(c.Crypto.KeyFile) > 0 {
+			errs = append(errs, errors.New("crypto: key and key_file can not both be set"))
+		}
+		_, err := decodeKey(c.Crypto.Key)
+		check("crypto.key", err)
+	}
+
+	check("replication.read_consistency", validConsistency(c.Replication.ReadConsistency))
+	check("replication.write_consistency", validConsistency(c.Replication.WriteConsistency))
+	check("replication.ack_timeout", notNegative(int64(c.Replication.AckTimeout)))
+	check("replication.max_hint_bytes", notNegative(c.Replication.MaxHintBytes))
+	check("replication.hint_ttl", notNegative(int64(c.Replication.HintTTL)))
+	check("replication.redial_interval", notNegative(int64(c.Replication.RedialInterval)))
+	check("replication.workers", notNegative(int64(c.Replication.Workers)))
+	check("replication.inbox_size", notNegative(int64(c.Replication.InboxSize)))
+
+	check("logging.level", oneOf(c.Logging.Level, "debug", "info", "warn", "error", "off"))
+	check("logging.format", oneOf(c.Logging.Format, "text", "json"))
+	if len(c.Tracing.Endpoint) > 0 {
+		check("tracing.endpoint", validateHTTPURL(c.Tracing.Endpoint))
+	}
+
+	check("limits.max_object_size", notNegative(c.Limits.MaxObjectSize))
+	// None of the rates of the limits can be negative.
+	c.eachSetting(func(name string, v reflect.Value) {
+		if strings.HasPrefix(name, "limits.") && v.Kind() == reflect.Float64 && v.Float() < 0 {
+			errs = append(errs, fmt.Errorf("%s: must not be negative (%g)", name, v.Float()))
+		}
+	})
+
+	if len(c.Gateway.HTTP) > 0 {
+		check("gateway.http", validateAddr(c.Gateway.HTTP))
+	}
+	if len(c.Gateway.Metrics) > 0 {
+		check("gateway.metrics", validateAddr(c.Gateway.Metrics))
+	}
+	if len(c.Gateway.Socket) == 0 {
+		errs = append(errs, errors.New("gateway.socket: must be set"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address (%s), want host:port or :port", addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port (%s)", port)
+	}
+	return nil
+}
+
+func validatePath(path string) error {
+	if len(path) == 0 {
+		return errors.New("must be the path of a socket")
+	}
+	return nil
+}
+
+// validateWSAddr takes a host:port or a ws:// or wss:// URL.
+func validateWSAddr(addr string) error {
+	if !strings.HasPrefix(addr, "ws://") && !strings.HasPrefix(addr, "wss://") {
+		return validateAddr(addr)
+	}
+	if u, err := url.Parse(addr); err != nil || len(u.Host) == 0 {
+		return fmt.Errorf("invalid URL (%s)", addr)
+	}
+	return nil
+}
+
+func validateHTTPURL(addr string) error {
+	u, err := url.Parse(addr)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return fmt.Errorf("invalid URL (%s), want http:// or https://", addr)
+	}
+	return nil
+}
+
+func oneOf(v string, values ...string) error {
+	for _, value := range values {
+		if v == value {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown value (%s), want one of %s", v, strings.Join(values, ", "))
+}
+
+func notNegative(n int64) error {
+	if n < 0 {
+		return fmt.Errorf("must not be negative (%d)", n)
+	}
+	return nil
+}
+
+func validConsistency(c Consistency) error {
+	_, err := ParseConsistency(c.String())
+	return err
+}
+
+// decodeKey decodes a hex encoded key, it has to be a valid AES key.
+func decodeKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("key is not hex encoded: %w", err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("key is %d bytes, want 16, 24 or 32", len(key))
+}
+
+// NeedsRestart returns the settings that differ between the configs and can not be reloaded.
+func (c *Config) NeedsRestart(next *Config) []string {
+	values := map[string]reflect.Value{}
+	next.eachSetting(func(name string, v reflect.Value) {
+		values[name] = v
+	})
+
+	var changed []string
+	c.eachSetting(func(name string, v reflect.Value) {
+		if reloadableSettings[name] {
+			return
+		}
+		if !reflect.DeepEqual(v.Interface(), values[name].Interface()) {
+			changed = append(changed, name)
+		}
+	})
+	return changed
+}
+
+// storageRoot is Store.Root, or the default derived from the listen address, the name of the
+// socket without its extension for the unix network.
+func (c *Config) storageRoot() string {
+	if len(c.Store.Root) > 0 {
+		return c.Store.Root
+	}
+	if c.Transport.Network == "unix" {
+		name := filepath.Base(c.Transport.ListenAddr)
+		return strings.TrimSuffix(name, filepath.Ext(name)) + "quantumsyncnetwork"
+	}
+	_, port, _ := net.SplitHostPort(c.Transport.ListenAddr)
+	return port + "quantumsyncnetwork"
+}
+
+// encryptionKey returns the key of the node, reading or creating the key file if there is one.
+func (c *Config) encryptionKey() ([]byte, error) {
+	if len(c.Crypto.Key) > 0 {
+		return decodeKey(c.Crypto.Key)
+	}
+	if len(c.Crypto.KeyFile) == 0 {
+		return crypto.NewEncryptionKey(), nil
+	}
+
+	b, err := os.ReadFile(c.Crypto.KeyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		key := crypto.NewEncryptionKey()
+		if err := os.WriteFile(c.Crypto.KeyFile, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := decodeKey(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", c.Crypto.KeyFile, err)
+	}
+	return key, nil
+}
+
+func (c *Config) pathTransformFunc() store.PathTansformFunc {
+	if c.Store.PathTransform == "default" {
+		return store.DefaultPathTransformFunc
+	}
+	return store.CASPathTransformFunc
+}
+
+func (c *Config) handshake() p2p.HandshakeFunc {
+	if c.Transport.Handshake == "none" {
+		return p2p.NOPhandshakeFunc
+	}
+	return Handshake(c.codec())
+}
+
+func (c *Config) codec() Codec {
+	if c.Transport.Codec == "binary" {
+		return BinaryCodec{}
+	}
+	return GobCodec{}
+}
+
+// LogLevel returns the level of logging.level, nothing is logged at the one of off.
+func (c *Config) LogLevel() slog.Level {
+	switch c.Logging.Level {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	case "off":
+		return slog.Level(math.MaxInt)
+	}
+	return slog.LevelInfo
+}
+
+// NewLogger returns a logger writing to w in logging.format, the level is looked at on every
+// record so a slog.LevelVar can change it while running.
+func (c *Config) NewLogger(w io.Writer, level slog.Leveler) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if c.Logging.Format == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// BandwidthLimits returns the limits of the replication traffic.
+func (c *Config) BandwidthLimits() BandwidthLimits {
+	l := c.Limits
+	return BandwidthLimits{
+		Global: Rates{Upload: l.UploadBytesPerSecond, Download: l.DownloadBytesPerSecond},
+		Peer:   Rates{Upload: l.PeerUploadBytesPerSecond, Download: l.PeerDownloadBytesPerSecond},
+		User:   Rates{Upload: l.UserUploadBytesPerSecond, Download: l.UserDownloadBytesPerSecond},
+		Repair: Rates{Upload: l.RepairUploadBytesPerSecond, Download: l.RepairDownloadBytesPerSecond},
+	}
+}
+
+func (c *Config) fileServerOpts(key []byte, transport p2p.Transport) FileServerOpts {
+	return FileServerOpts{
+		EncKey:           key,
+		StorageRoot:      c.storageRoot(),
+		PathTansformFunc: c.pathTransformFunc(),
+		Transport:        transport,
+		BootstrapNodes:   c.Transport.Bootstrap,
+		MaxHintBytes:     c.Replication.MaxHintBytes,
+		HintTTL:          time.Duration(c.Replication.HintTTL),
+		RedialInterval:   time.Duration(c.Replication.RedialInterval),
+		Versioning:       c.Store.Versioning,
+		MaxVersions:      c.Store.MaxVersions,
+		MaxVersionAge:    time.Duration(c.Store.MaxVersionAge),
+		KeepSiblings:     c.Store.KeepSiblings,
+		ReadConsistency:  c.Replication.ReadConsistency,
+		WriteConsistency: c.Replication.WriteConsistency,
+		AckTimeout:       time.Duration(c.Replication.AckTimeout),
+		Workers:          c.Replication.Workers,
+		InboxSize:        c.Replication.InboxSize,
+		Codec:            c.codec(),
+		Bandwidth:        c.BandwidthLimits(),
+	}
+}
@@ -0,0 +1,314 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var configFiles = map[string]string{
+	"qs.yaml": `
+transport:
+  listen_addr: ":4000"
+  bootstrap: [":3000", ":5000"]
+store:
+  versioning: true
+  max_version_age: 24h
+replication:
+  write_consistency: quorum
+limits:
+  requests_per_second: 2.5
+`,
+	"qs.toml": `
+# a node with two peers
+[transport]
+listen_addr = ":4000"
+bootstrap = [":3000", ':5000']
+
+[store]
+versioning = true
+max_version_age = "24h" # a day
+
+[replication]
+write_consistency = "quorum"
+
+[limits]
+requests_per_second = 2.5
+`,
+	"qs.json": `{
+	"transport": {"listen_addr": ":4000", "bootstrap": [":3000", ":5000"]},
+	"store": {"versioning": true, "max_version_age": "24h"},
+	"replication": {"write_consistency": "quorum"},
+	"limits": {"requests_per_second": 2.5}
+}`,
+}
+
+func writeConfig(t *testing.T, name string, data string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	want := DefaultConfig()
+	want.Transport.ListenAddr = ":4000"
+	want.Transport.Bootstrap = []string{":3000", ":5000"}
+	want.Store.Versioning = true
+	want.Store.MaxVersionAge = Duration(24 * time.Hour)
+	want.Replication.WriteConsistency = ConsistencyQuorum
+	want.Limits.RequestsPerSecond = 2.5
+
+	for name, data := range configFiles {
+		cfg, err := LoadConfig(writeConfig(t, name, data))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !reflect.DeepEqual(cfg, want) {
+			t.Errorf("%s: want %+v have %+v", name, want, cfg)
+		}
+		if root := cfg.storageRoot(); root != "4000quantumsyncnetwork" {
+			t.Errorf("%s: want storage root 4000quantumsyncnetwork have %s", name, root)
+		}
+	}
+}
+
+func TestLoadConfigUnknownKey(t *testing.T) {
+	for _, name := range []string{"qs.yaml", "qs.json", "qs.toml"} {
+		data := strings.Replace(configFiles[name], "versioning", "versionning", 1)
+		if _, err := LoadConfig(writeConfig(t, name, data)); err == nil {
+			t.Errorf("%s: want an error for an unknown key", name)
+		}
+	}
+}
+
+func TestLoadConfigTOML(t *testing.T) {
+	path := writeConfig(t, "qs.toml", `
+transport.network = "ws"
+transport.listen_addr = ":4000"
+transport.bootstrap = [
+  ":3000",
+  "ws://qs.example.com/qs#peers", # a comment in the array
+]
+transport.socket_mode = "0660"
+store = { versioning = true, max_versions = 3 }
+
+[limits]
+requests_per_second = 10
+`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Transport.ListenAddr != ":4000" || !reflect.DeepEqual(cfg.Transport.Bootstrap, []string{":3000", "ws://qs.example.com/qs#peers"}) {
+		t.Errorf("unexpected transport %+v", cfg.Transport)
+	}
+	if cfg.Transport.SocketMode != 0660 {
+		t.Errorf("socket mode: want 0660 have %04o", cfg.Transport.SocketMode)
+	}
+	if !cfg.Store.Versioning || cfg.Store.MaxVersions != 3 {
+		t.Errorf("unexpected store %+v", cfg.Store)
+	}
+	if cfg.Limits.RequestsPerSecond != 10 {
+		t.Errorf("requests per second: want 10 have %v", cfg.Limits.RequestsPerSecond)
+	}
+
+	// Unknown keys are turned down however they are written.
+	for _, data := range []string{
+		"transport.listen_adr = \":4000\"",
+		"store = { versioning = true, max_version = 3 }",
+		"[storage]\nversioning = true",
+		"[[transport]]\nlisten_addr = \":4000\"",
+	} {
+		if _, err := LoadConfig(writeConfig(t, "qs.toml", data)); err == nil {
+			t.Errorf("want an error for %q", data)
+		}
+	}
+}
+
+func TestConfigEnv(t *testing.T) {
+	env := map[string]string{
+		"QS_TRANSPORT_BOOTSTRAP":          ":3000, :5000",
+		"QS_STORE_MAX_VERSIONS":           "3",
+		"QS_REPLICATION_ACK_TIMEOUT":      "2s",
+		"QS_REPLICATION_READ_CONSISTENCY": "all",
+	}
+	cfg := DefaultConfig()
+	err := cfg.applyEnv(func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.Transport.Bootstrap, []string{":3000", ":5000"}) {
+		t.Errorf("bootstrap: have %v", cfg.Transport.Bootstrap)
+	}
+	if cfg.Store.MaxVersions != 3 {
+		t.Errorf("max versions: want 3 have %d", cfg.Store.MaxVersions)
+	}
+	if cfg.Replication.AckTimeout != Duration(2*time.Second) {
+		t.Errorf("ack timeout: want 2s have %s", time.Duration(cfg.Replication.AckTimeout))
+	}
+	if cfg.Replication.ReadConsistency != ConsistencyAll {
+		t.Errorf("read consistency: want all have %s", cfg.Replication.ReadConsistency)
+	}
+
+	err = cfg.applyEnv(func(name string) (string, bool) {
+		return "lots", name == "QS_STORE_MAX_VERSIONS"
+	})
+	if err == nil || !strings.Contains(err.Error(), "QS_STORE_MAX_VERSIONS") {
+		t.Errorf("want an error naming the variable, have %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Transport.ListenAddr = "3000"
+	cfg.Transport.Decoder = "protobuf"
+	cfg.Transport.Codec = "json"
+	cfg.Transport.IdleTimeout = Duration(-time.Second)
+	cfg.Limits.RepairUploadBytesPerSecond = -1
+	cfg.Transport.Deny = []string{"10.0.0.0/8", "10.0.0.300"}
+	cfg.Store.MaxVersions = -1
+	cfg.Replication.InboxSize = -1
+	cfg.Logging.Format = "xml"
+	cfg.Gateway.Metrics = "localhost"
+	cfg.Tracing.Endpoint = "localhost:4318"
+	cfg.Crypto.Key = "abcd"
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("want an error")
+	}
+	for _, setting := range []string{"transport.listen_addr", "transport.decoder", "transport.codec", "transport.idle_timeout", "limits.repair_upload_bytes_per_second", "transport.deny", "store.max_versions", "replication.inbox_size", "logging.format", "gateway.metrics", "tracing.endpoint", "crypto.key"} {
+		if !strings.Contains(err.Error(), setting) {
+			t.Errorf("want an error for %s, have %s", setting, err)
+		}
+	}
+}
+
+func TestConfigDecoder(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Transport.Decoder = "gob"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "transport.decoder") {
+		t.Errorf("want the gob decoder turned down, have %v", err)
+	}
+}
+
+func TestConfigUnix(t *testing.T) {
+	path := writeConfig(t, "qs.yaml", `
+transport:
+  network: unix
+  listen_addr: /run/qs/sidecar.sock
+  bootstrap: [/run/qs/other.sock]
+  socket_mode: 0660
+`)
+	t.Setenv("QS_GATEWAY_SOCKET_MODE", "0666")
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Transport.SocketMode != 0660 {
+		t.Errorf("transport socket mode: want 0660 have %04o", cfg.Transport.SocketMode)
+	}
+	if cfg.Gateway.SocketMode != 0666 {
+		t.Errorf("gateway socket mode: want 0666 have %04o", cfg.Gateway.SocketMode)
+	}
+	if root := cfg.storageRoot(); root != "sidecarquantumsyncnetwork" {
+		t.Errorf("want storage root sidecarquantumsyncnetwork have %s", root)
+	}
+
+	cfg.Transport.Network = "tcp"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "transport.listen_addr") {
+		t.Errorf("want a socket path refused as a tcp address, have %v", err)
+	}
+	var mode FileMode
+	if err := mode.UnmarshalText([]byte("0999")); err == nil {
+		t.Error("want an error for a mode that is not octal")
+	}
+}
+
+func TestConfigWS(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Transport.Network = "ws"
+	cfg.Transport.Bootstrap = []string{":3000", "wss://qs.example.com/qs"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Transport.Bootstrap = []string{"wss://"}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "transport.bootstrap[0]") {
+		t.Errorf("want an error for a URL without a host, have %v", err)
+	}
+}
+
+func TestConfigKeyFile(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Crypto.KeyFile = filepath.Join(t.TempDir(), "qs.key")
+
+	key, err := cfg.encryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := cfg.encryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != string(again) {
+		t.Error("want the key written to the key file to be read back")
+	}
+}
+
+func TestConfigNeedsRestart(t *testing.T) {
+	cfg := DefaultConfig()
+	next := DefaultConfig()
+	next.Transport.Bootstrap = []string{":5000"}
+	next.Limits.RequestsPerSecond = 10
+	if changed := cfg.NeedsRestart(next); len(changed) > 0 {
+		t.Errorf("want no restart, have %v", changed)
+	}
+
+	next.Store.Root = "elsewhere"
+	if changed := cfg.NeedsRestart(next); !reflect.DeepEqual(changed, []string{"store.root"}) {
+		t.Errorf("want a restart for store.root, have %v", changed)
+	}
+}
+
+func TestConfigLogger(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Logging.Level = "warn"
+	cfg.Logging.Format = "json"
+	level := new(slog.LevelVar)
+	level.Set(cfg.LogLevel())
+	buf := new(bytes.Buffer)
+	logger := cfg.NewLogger(buf, level)
+
+	logger.Info("peer connected", "peer", ":3000")
+	if buf.Len() > 0 {
+		t.Errorf("want nothing logged below warn, have %s", buf)
+	}
+	logger.Warn("handshake failed", "peer", ":3000")
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["msg"] != "handshake failed" || record["peer"] != ":3000" {
+		t.Errorf("unexpected record %v", record)
+	}
+
+	// Off drops everything, even the errors.
+	cfg.Logging.Level = "off"
+	level.Set(cfg.LogLevel())
+	buf.Reset()
+	logger.Error("accept failed")
+	if buf.Len() > 0 {
+		t.Errorf("want nothing logged when off, have %s", buf)
+	}
+}
@@ -0,0 +1,88 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Consistency is the number of replicas that have to take part in a Store or Get before it
+// succeeds. The replicas are this node plus every peer it knows of, connected or not.
+type Consistency int
+
+const (
+	// ConsistencyOne is satisfied by a single replica, the node itself.
+	ConsistencyOne Consistency = iota
+	// ConsistencyQuorum needs a majority of the replicas.
+	ConsistencyQuorum
+	// ConsistencyAll needs every replica.
+	ConsistencyAll
+)
+
+var ErrNotEnoughReplicas = errors.New("not enough replicas")
+
+// required returns how many of the n replicas are needed.
+func (c Consistency) required(n int) int {
+	switch c {
+	case ConsistencyQuorum:
+		return n/2 + 1
+	case ConsistencyAll:
+		return n
+	}
+	return 1
+}
+
+func (c Consistency) String() string {
+	switch c {
+	case ConsistencyOne:
+		return "one"
+	case ConsistencyQuorum:
+		return "quorum"
+	case ConsistencyAll:
+		return "all"
+	}
+	return fmt.Sprintf("Consistency(%d)", int(c))
+}
+
+// ParseConsistency parses the name of a consistency level, as returned by String.
+func ParseConsistency(s string) (Consistency, error) {
+	switch strings.ToLower(s) {
+	case "", "one":
+		return ConsistencyOne, nil
+	case "quorum":
+		return ConsistencyQuorum, nil
+	case "all":
+		return ConsistencyAll, nil
+	}
+	return 0, fmt.Errorf("unknown consistency level (%s)", s)
+}
+
+// ReadOpts are the per call options of GetWith.
+type ReadOpts struct {
+	// Version asks for a specific version of the file, empty asks for the latest.
+	Version     string
+	Consistency Consistency
+	// Context carries the span the read is part of, nil starts a new trace.
+	Context context.Context
+}
+
+// WriteOpts are the per call options of StoreWith.
+type WriteOpts struct {
+	Consistency Consistency
+	// Context carries the span the write is part of, nil starts a new trace.
+	Context context.Context
+}
+
+func (c Consistency) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *Consistency) UnmarshalText(b []byte) error {
+	v, err := ParseConsistency(string(b))
+	if err != nil {
+		return err
+	}
+	*c = v
+	return nil
+}
@@ -0,0 +1,246 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ashirwad-maker/quantumsync/crypto"
+	"github.com/ashirwad-maker/quantumsync/p2p"
+	"github.com/ashirwad-maker/quantumsync/store"
+)
+
+func TestConsistencyRequired(t *testing.T) {
+	for _, tc := range []struct {
+		c    Consistency
+		n    int
+		want int
+	}{
+		{ConsistencyOne, 3, 1},
+		{ConsistencyQuorum, 1, 1},
+		{ConsistencyQuorum, 2, 2},
+		{ConsistencyQuorum, 3, 2},
+		{ConsistencyQuorum, 4, 3},
+		{ConsistencyAll, 3, 3},
+	} {
+		if have := tc.c.required(tc.n); have != tc.want {
+			t.Errorf("%s of %d: want %d have %d", tc.c, tc.n, tc.want, have)
+		}
+	}
+}
+
+// waitOffline waits for the peer to be listed as offline on s.
+func waitOffline(t *testing.T, s *FileServer, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		for _, p := range s.Peers() {
+			if p.Addr == addr && !p.Connected {
+				return
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%s never went offline", addr)
+}
+
+func TestFileServerQuorumUnmet(t *testing.T) {
+	network := p2p.NewMemNetwork()
+	s1 := newMemServer(t, network, ":3000")
+	time.Sleep(10 * time.Millisecond)
+	s2 := newMemServerWith(t, network, FileServerOpts{RedialInterval: time.Hour}, ":4000", ":3000")
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s1.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitOffline(t, s2, ":3000")
+
+	// Of the 2 replicas a quorum needs both, only s2 is reachable.
+	_, err := s2.StoreWith("picture", strings.NewReader("some jpeg bytes"), WriteOpts{Consistency: ConsistencyQuorum})
+	if !errors.Is(err, ErrNotEnoughReplicas) {
+		t.Fatalf("want %s have %v", ErrNotEnoughReplicas, err)
+	}
+	if s2.store.HasVersion("picture", "") {
+		t.Error("want nothing written by a write turned down")
+	}
+	if s2.hints.Size() != 0 {
+		t.Error("want nothing handed off by a write turned down")
+	}
+
+	// ONE is met by s2 alone, the write is handed off for s1.
+	result, err := s2.StoreWith("picture", strings.NewReader("some jpeg bytes"), WriteOpts{Consistency: ConsistencyOne})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Acks != 1 || len(result.Peers) != 1 || !result.Peers[0].Hinted {
+		t.Errorf("want the write acked by s2 and handed off for s1 have %+v", result)
+	}
+
+	if _, err := s2.GetWith("picture", ReadOpts{Consistency: ConsistencyAll}); !errors.Is(err, ErrNotEnoughReplicas) {
+		t.Errorf("want %s reading with ALL have %v", ErrNotEnoughReplicas, err)
+	}
+	obj, err := s2.GetWith("picture", ReadOpts{Consistency: ConsistencyOne})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(obj)
+	obj.Close()
+	if string(b) != "some jpeg bytes" {
+		t.Errorf("want some jpeg bytes have %s", b)
+	}
+}
+
+func TestFileServerReadRepair(t *testing.T) {
+	network := p2p.NewMemNetwork()
+	s1 := newMemServer(t, network, ":3000")
+	time.Sleep(10 * time.Millisecond)
+	s2 := newMemServer(t, network, ":4000", ":3000")
+	time.Sleep(50 * time.Millisecond)
+
+	first, err := s2.StoreWith("picture", strings.NewReader("some jpeg bytes"), WriteOpts{Consistency: ConsistencyAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A newer version only s2 has, s1 missed it and is stale.
+	meta, err := s2.newVersionMeta("picture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := store.FormatVersionID(meta.Timestamp, meta.Node)
+	if _, err := s2.store.WriteVersion("picture", latest, meta, bytes.NewReader([]byte("newer jpeg bytes"))); err != nil {
+		t.Fatal(err)
+	}
+	hash := crypto.HashKey("picture")
+	if v, _ := s1.store.LatestVersion(hash); v.ID != first.Version {
+		t.Fatalf("want s1 on the first version have %s", v.ID)
+	}
+
+	obj, err := s2.GetWith("picture", ReadOpts{Consistency: ConsistencyAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(obj)
+	obj.Close()
+	if string(b) != "newer jpeg bytes" || obj.Version != latest {
+		t.Errorf("want the newer version have (%s) %s", obj.Version, b)
+	}
+
+	// The read sends the newer version to s1 in the background.
+	deadline := time.Now().Add(time.Second)
+	for {
+		if v, _ := s1.store.LatestVersion(hash); v.ID == latest {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("want the stale replica on s1 repaired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Shutdown waits for the repairs in flight.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s2.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileServerReadBusy(t *testing.T) {
+	network := p2p.NewMemNetwork()
+	// s1 turns down every message of its peers as busy.
+	tr := p2p.NewMemTransport(network, p2p.TCPTransportOpts{
+		ListenAddr:    ":3000",
+		HandshakeFunc: Handshake(nil),
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	s1 := NewFileServer(FileServerOpts{
+		EncKey:           crypto.NewEncryptionKey(),
+		StorageRoot:      t.TempDir(),
+		PathTansformFunc: store.CASPathTransformFunc,
+		Transport:        tr,
+	})
+	s1.inbox = newInbox(0)
+	tr.OnPeer = s1.OnPeer
+	tr.OnPeerDisconnect = s1.OnPeerDisconnect
+	go s1.Start()
+	t.Cleanup(s1.Stop)
+	time.Sleep(10 * time.Millisecond)
+	s2 := newMemServer(t, network, ":4000", ":3000")
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := s2.StoreWith("picture", strings.NewReader("some jpeg bytes"), WriteOpts{Consistency: ConsistencyOne}); err != nil {
+		t.Fatal(err)
+	}
+
+	// s2 has the file, but a quorum of 2 needs s1 to answer as well.
+	if _, err := s2.GetWith("picture", ReadOpts{Consistency: ConsistencyQuorum}); !errors.Is(err, ErrNotEnoughReplicas) {
+		t.Errorf("want %s with the peer busy have %v", ErrNotEnoughReplicas, err)
+	}
+	obj, err := s2.GetWith("picture", ReadOpts{Consistency: ConsistencyOne})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj.Close()
+}
+
+func TestFileServerReadPeerFails(t *testing.T) {
+	network := p2p.NewMemNetwork()
+	s1 := newMemServer(t, network, ":3000")
+	time.Sleep(10 * time.Millisecond)
+	newMemServer(t, network, ":4000", ":3000")
+	time.Sleep(10 * time.Millisecond)
+	s3 := newMemServer(t, network, ":5000", ":3000", ":4000")
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := s3.StoreWith("picture", strings.NewReader("some jpeg bytes"), WriteOpts{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+	// s1 gets a newer version that s3 can not write, a folder is in the way of its metadata, so
+	// fetching it fails before the file is read.
+	hash := crypto.HashKey("picture")
+	meta, err := s1.newVersionMeta(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := store.FormatVersionID(meta.Timestamp, meta.Node)
+	if _, err := s1.store.WriteVersion(hash, version, meta, strings.NewReader("newer jpeg bytes")); err != nil {
+		t.Fatal(err)
+	}
+	versions := fmt.Sprintf("%s/%s/%s.versions", s3.store.Root, s3.store.ID, store.CASPathTransformFunc("picture").FullPath())
+	if err := os.MkdirAll(fmt.Sprintf("%s/.%s.meta", versions, version), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only s2 and s3 make it, which is a quorum but not all of them.
+	if _, err := s3.GetWith("picture", ReadOpts{Consistency: ConsistencyAll}); !errors.Is(err, ErrNotEnoughReplicas) {
+		t.Errorf("want %s with a peer failing have %v", ErrNotEnoughReplicas, err)
+	}
+	obj, err := s3.GetWith("picture", ReadOpts{Consistency: ConsistencyQuorum})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(obj)
+	obj.Close()
+	if string(b) != "some jpeg bytes" {
+		t.Errorf("want some jpeg bytes have %s", b)
+	}
+
+	// The streams of every peer were read to the end, they all still take writes.
+	result, err := s3.StoreWith("picture", strings.NewReader("other jpeg bytes"), WriteOpts{Consistency: ConsistencyAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Acks != 3 {
+		t.Errorf("want 3 acks have %d: %+v", result.Acks, result.Peers)
+	}
+}
@@ -0,0 +1,424 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ashirwad-maker/quantumsync/store"
+	"github.com/ashirwad-maker/quantumsync/trace"
+)
+
+// Gateway exposes a FileServer over HTTP, so it can be used without linking it in.
+//
+//	PUT    /objects/{key}  stores the request body
+//	GET    /objects/{key}  streams the file, Range requests are supported
+//	HEAD   /objects/{key}  returns the metadata of the file
+//	DELETE /objects/{key}  deletes the file
+//	GET    /objects        lists the keys stored on the node
+//	GET    /versions/{key} lists the versions of the file stored on the node
+//	GET    /peers          lists the peers
+//	GET    /health         reports if the node is up
+//
+// The admin routes have no authentication, they are only served by ServeAdmin on the control
+// socket, where the mode of the socket decides who gets in:
+//
+//	GET    /admin/status        reports the peers, transfers, queues, store and recent errors
+//	DELETE /admin/peers/{addr}  disconnects the peer
+//	POST   /admin/repair/{key}  repairs the replicas of the file that are behind
+//
+// The object requests take the "consistency" query parameter (one, quorum, all), without it
+// the read and write consistency of the server are used, the reads also take "version" to ask
+// for a specific version.
+type Gateway struct {
+	GatewayOpts
+	server  *FileServer
+	mux     *http.ServeMux
+	admin   *http.ServeMux // the admin routes on top of the ones of mux
+	limiter *RateLimiter
+
+	mu          sync.Mutex
+	httpServers []*http.Server
+}
+
+// GatewayOpts configures a Gateway.
+type GatewayOpts struct {
+	ListenAddr string
+	// MaxObjectSize caps the size of the files that can be stored, zero means no limit.
+	MaxObjectSize int64
+	// RequestsPerSecond limits the requests served, zero means no limit. SetRateLimit changes it.
+	RequestsPerSecond float64
+}
+
+// NewGateway returns the gateway of the server, it is an http.Handler.
+func NewGateway(s *FileServer, opts GatewayOpts) *Gateway {
+	g := &Gateway{
+		GatewayOpts: opts,
+		server:      s,
+		mux:         http.NewServeMux(),
+		admin:       http.NewServeMux(),
+		limiter:     NewRateLimiter(opts.RequestsPerSecond, 0),
+	}
+	g.mux.HandleFunc("PUT /objects/{key...}", g.handlePut)
+	g.mux.HandleFunc("GET /objects/{key...}", g.handleGet)
+	g.mux.HandleFunc("DELETE /objects/{key...}", g.handleDelete)
+	g.mux.HandleFunc("GET /objects", g.handleList)
+	g.mux.HandleFunc("GET /versions/{key...}", g.handleVersions)
+	g.mux.HandleFunc("GET /peers", g.handlePeers)
+	g.mux.HandleFunc("GET /health", g.handleHealth)
+	g.admin.HandleFunc("GET /admin/status", g.handleStatus)
+	g.admin.HandleFunc("DELETE /admin/peers/{addr...}", g.handleDisconnect)
+	g.admin.HandleFunc("POST /admin/repair/{key...}", g.handleRepair)
+	g.admin.Handle("/", g.mux)
+	return g
+}
+
+// ServeHTTP serves every route but the admin ones.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.serveMux(g.mux, w, r)
+}
+
+// AdminHandler serves the admin routes along with the others. It is what ServeAdmin serves,
+// never hand it to a server reachable from the network.
+func (g *Gateway) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.serveMux(g.admin, w, r)
+	})
+}
+
+func (g *Gateway) serveMux(mux *http.ServeMux, w http.ResponseWriter, r *http.Request) {
+	if !g.limiter.Allow() {
+		writeError(w, http.StatusTooManyRequests, errors.New("rate limit exceeded"))
+		return
+	}
+	mux.ServeHTTP(w, r)
+}
+
+// SetRateLimit changes the number of requests per second served, zero means no limit.
+func (g *Gateway) SetRateLimit(rps float64) {
+	g.limiter.SetRate(rps, 0)
+}
+
+// ListenAndServe blocks serving the gateway on ListenAddr until Close is called.
+func (g *Gateway) ListenAndServe() error {
+	l, err := net.Listen("tcp", g.ListenAddr)
+	if err != nil {
+		return err
+	}
+	g.server.log.Info("HTTP gateway listening", "addr", g.ListenAddr)
+	return g.Serve(l)
+}
+
+// Serve blocks serving the gateway on the listener until Close is called.
+func (g *Gateway) Serve(l net.Listener) error {
+	return g.serve(l, g)
+}
+
+// ServeAdmin is Serve with the admin routes, it is how the gateway is served on the local
+// control socket. Only the users the socket lets in should reach the listener.
+func (g *Gateway) ServeAdmin(l net.Listener) error {
+	return g.serve(l, g.AdminHandler())
+}
+
+func (g *Gateway) serve(l net.Listener, h http.Handler) error {
+	srv := &http.Server{Handler: h}
+	g.mu.Lock()
+	g.httpServers = append(g.httpServers, srv)
+	g.mu.Unlock()
+
+	err := srv.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops the gateway from taking new requests and waits for the ones being served to
+// finish, or for the context to be done.
+func (g *Gateway) Shutdown(ctx context.Context) error {
+	g.mu.Lock()
+	servers := g.httpServers
+	g.httpServers = nil
+	g.mu.Unlock()
+
+	var err error
+	for _, srv := range servers {
+		if e := srv.Shutdown(ctx); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (g *Gateway) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var err error
+	for _, srv := range g.httpServers {
+		if e := srv.Close(); e != nil {
+			err = e
+		}
+	}
+	g.httpServers = nil
+	return err
+}
+
+func (g *Gateway) handlePut(w http.ResponseWriter, r *http.Request) {
+	c, err := consistencyOf(r, g.server.WriteConsistency)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	defer r.Body.Close()
+
+	body := r.Body
+	if g.MaxObjectSize > 0 {
+		if r.ContentLength > g.MaxObjectSize {
+			writeError(w, http.StatusRequestEntityTooLarge, errObjectTooLarge)
+			return
+		}
+		body = http.MaxBytesReader(w, body, g.MaxObjectSize)
+	}
+
+	result, err := g.server.StoreWith(r.PathValue("key"), body, WriteOpts{Consistency: c, Context: traceContext(r)})
+	if err != nil && result == nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+
+	status := http.StatusCreated
+	if err != nil {
+		status = statusOf(err)
+	}
+	writeJSON(w, status, newStoreResultJSON(result, err))
+}
+
+// handleGet serves GET and HEAD, http.ServeContent takes care of the Range and HEAD requests.
+func (g *Gateway) handleGet(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	c, err := consistencyOf(r, g.server.ReadConsistency)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	key := r.PathValue("key")
+	obj, err := g.server.GetWith(key, ReadOpts{Version: q.Get("version"), Consistency: c, Context: traceContext(r)})
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	defer obj.Close()
+
+	h := w.Header()
+	h.Set("ETag", `"`+obj.Version+`"`)
+	h.Set("X-Qs-Version", obj.Version)
+	h.Set("Content-Type", "application/octet-stream")
+	if len(obj.Siblings) > 0 {
+		siblings := make([]string, len(obj.Siblings))
+		for i, v := range obj.Siblings {
+			siblings[i] = v.ID
+		}
+		h.Set("X-Qs-Siblings", strings.Join(siblings, ","))
+	}
+
+	var modTime time.Time
+	if obj.Meta != nil {
+		modTime = time.Unix(0, obj.Meta.Timestamp.WallTime)
+	}
+	if rs, ok := obj.ReadCloser.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, key, modTime, rs)
+		return
+	}
+	h.Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, obj)
+}
+
+func (g *Gateway) handleDelete(w http.ResponseWriter, r *http.Request) {
+	if err := g.server.Delete(r.PathValue("key")); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *Gateway) handleList(w http.ResponseWriter, r *http.Request) {
+	keys, err := g.server.store.Keys()
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
+
+func (g *Gateway) handleVersions(w http.ResponseWriter, r *http.Request) {
+	versions, err := g.server.ListVersions(r.PathValue("key"))
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	res := make([]VersionJSON, len(versions))
+	for i, v := range versions {
+		res[i] = VersionJSON{ID: v.ID, Size: v.Size, ModTime: v.ModTime}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (g *Gateway) handlePeers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, g.server.Peers())
+}
+
+func (g *Gateway) handleHealth(w http.ResponseWriter, r *http.Request) {
+	peers := 0
+	for _, p := range g.server.Peers() {
+		if p.Connected {
+			peers++
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"status": "ok",
+		"addr":   g.server.Transport.Addr(),
+		"peers":  peers,
+	})
+}
+
+func (g *Gateway) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := g.server.Status()
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (g *Gateway) handleDisconnect(w http.ResponseWriter, r *http.Request) {
+	if err := g.server.DisconnectPeer(r.PathValue("addr")); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *Gateway) handleRepair(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	repaired, err := g.server.Repair(key)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	if repaired == nil {
+		repaired = []string{}
+	}
+	writeJSON(w, http.StatusOK, RepairJSON{Key: key, Repaired: repaired})
+}
+
+// RepairJSON is the body of the response to a repair.
+type RepairJSON struct {
+	Key string `json:"key"`
+	// Repaired are the peers that were sent the latest version.
+	Repaired []string `json:"repaired"`
+}
+
+// VersionJSON is an entry of the GET /versions response.
+type VersionJSON struct {
+	ID      string    `json:"id"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// PeerResultJSON is the outcome of a PUT on a single peer.
+type PeerResultJSON struct {
+	Peer   string `json:"peer"`
+	Bytes  int64  `json:"bytes"`
+	Digest string `json:"digest,omitempty"`
+	Hinted bool   `json:"hinted,omitempty"`
+	Err    string `json:"error,omitempty"`
+}
+
+// StoreResultJSON is the body of the response to a PUT.
+type StoreResultJSON struct {
+	Key     string           `json:"key"`
+	Version string           `json:"version"`
+	Size    int64            `json:"size"`
+	Acks    int              `json:"acks"`
+	Peers   []PeerResultJSON `json:"peers"`
+	Err     string           `json:"error,omitempty"`
+}
+
+func newStoreResultJSON(result *StoreResult, err error) StoreResultJSON {
+	res := StoreResultJSON{
+		Key:     result.Key,
+		Version: result.Version,
+		Size:    result.Size,
+		Acks:    result.Acks,
+		Peers:   make([]PeerResultJSON, len(result.Peers)),
+	}
+	for i, p := range result.Peers {
+		res.Peers[i] = PeerResultJSON{Peer: p.Peer, Bytes: p.Bytes, Digest: p.Digest, Hinted: p.Hinted}
+		if p.Err != nil {
+			res.Peers[i].Err = p.Err.Error()
+		}
+	}
+	if err != nil {
+		res.Err = err.Error()
+	}
+	return res
+}
+
+var errObjectTooLarge = errors.New("object is too large")
+
+// traceContext returns the context of the request, the spans of the server continue the trace of
+// the client when it sent a traceparent header.
+func traceContext(r *http.Request) context.Context {
+	sc, err := trace.ParseTraceparent(r.Header.Get("traceparent"))
+	if err != nil {
+		return r.Context()
+	}
+	return trace.ContextWithRemote(r.Context(), sc)
+}
+
+// consistencyOf returns the consistency asked for by the request, def when it does not ask for one.
+func consistencyOf(r *http.Request, def Consistency) (Consistency, error) {
+	s := r.URL.Query().Get("consistency")
+	if len(s) == 0 {
+		return def, nil
+	}
+	return ParseConsistency(s)
+}
+
+func statusOf(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, ErrUnknownPeer):
+		return http.StatusNotFound
+	case errors.Is(err, store.ErrInvalidVersion), errors.Is(err, store.ErrInvalidKey):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrNotEnoughReplicas):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
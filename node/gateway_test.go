@@ -0,0 +1,232 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ashirwad-maker/quantumsync/crypto"
+	"github.com/ashirwad-maker/quantumsync/p2p"
+	"github.com/ashirwad-maker/quantumsync/store"
+)
+
+// newGateway returns the gateway of a node that is not connected to any peer.
+func newGateway(t *testing.T) *Gateway {
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    ":0",
+		HandshakeFunc: p2p.NOPhandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	s := NewFileServer(FileServerOpts{
+		EncKey:           crypto.NewEncryptionKey(),
+		StorageRoot:      t.TempDir(),
+		PathTansformFunc: store.CASPathTransformFunc,
+		Transport:        tr,
+		Versioning:       true,
+	})
+	return NewGateway(s, GatewayOpts{})
+}
+
+func newTestGateway(t *testing.T) *httptest.Server {
+	ts := httptest.NewServer(newGateway(t))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func doRequest(t *testing.T, method, url string, body string, header http.Header) (*http.Response, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+func TestGatewayObjects(t *testing.T) {
+	ts := newTestGateway(t)
+	url := ts.URL + "/objects/pictures/myspecialpicture"
+
+	resp, body := doRequest(t, http.MethodPut, url, "some jpeg bytes", nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("want %d have %d: %s", http.StatusCreated, resp.StatusCode, body)
+	}
+	var result StoreResultJSON
+	if err := json.Unmarshal([]byte(body), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Size != 15 || result.Acks != 1 || len(result.Version) == 0 {
+		t.Errorf("unexpected store result %+v", result)
+	}
+
+	resp, body = doRequest(t, http.MethodGet, url, "", nil)
+	if resp.StatusCode != http.StatusOK || body != "some jpeg bytes" {
+		t.Errorf("want some jpeg bytes have (%d) %s", resp.StatusCode, body)
+	}
+	if v := resp.Header.Get("X-Qs-Version"); v != result.Version {
+		t.Errorf("want version %s have %s", result.Version, v)
+	}
+
+	resp, body = doRequest(t, http.MethodGet, url, "", http.Header{"Range": {"bytes=5-8"}})
+	if resp.StatusCode != http.StatusPartialContent || body != "jpeg" {
+		t.Errorf("want jpeg have (%d) %s", resp.StatusCode, body)
+	}
+
+	resp, body = doRequest(t, http.MethodHead, url, "", nil)
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != 15 || len(body) != 0 {
+		t.Errorf("unexpected HEAD response (%d) length %d", resp.StatusCode, resp.ContentLength)
+	}
+
+	// The first version is still around after it is overwritten.
+	doRequest(t, http.MethodPut, url, "other jpeg bytes", nil)
+	resp, body = doRequest(t, http.MethodGet, url+"?version="+result.Version, "", nil)
+	if resp.StatusCode != http.StatusOK || body != "some jpeg bytes" {
+		t.Errorf("want some jpeg bytes have (%d) %s", resp.StatusCode, body)
+	}
+	// The version ends up in the path of the file, so only the IDs the nodes make are taken.
+	resp, body = doRequest(t, http.MethodGet, url+"?version=../../../../../../../../etc/passwd", "", nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("want %d for a version out of the root have (%d) %s", http.StatusBadRequest, resp.StatusCode, body)
+	}
+
+	resp, _ = doRequest(t, http.MethodDelete, url, "", nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("want %d have %d", http.StatusNoContent, resp.StatusCode)
+	}
+	resp, _ = doRequest(t, http.MethodGet, url, "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("want %d have %d", http.StatusNotFound, resp.StatusCode)
+	}
+
+	resp, _ = doRequest(t, http.MethodGet, url+"?consistency=most", "", nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("want %d have %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestGatewayHealth(t *testing.T) {
+	ts := newTestGateway(t)
+
+	resp, body := doRequest(t, http.MethodGet, ts.URL+"/health", "", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"status":"ok"`) {
+		t.Errorf("unexpected health response (%d) %s", resp.StatusCode, body)
+	}
+
+	resp, body = doRequest(t, http.MethodGet, ts.URL+"/peers", "", nil)
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(body) != "[]" {
+		t.Errorf("unexpected peers response (%d) %s", resp.StatusCode, body)
+	}
+}
+
+func TestGatewayAdmin(t *testing.T) {
+	g := newGateway(t)
+	public := httptest.NewServer(g)
+	t.Cleanup(public.Close)
+	ts := httptest.NewServer(g.AdminHandler())
+	t.Cleanup(ts.Close)
+
+	// The admin routes have no authentication, they are not served with the others.
+	for _, req := range [][2]string{
+		{http.MethodGet, "/admin/status"},
+		{http.MethodDelete, "/admin/peers/127.0.0.1:5000"},
+		{http.MethodPost, "/admin/repair/picture"},
+	} {
+		if resp, body := doRequest(t, req[0], public.URL+req[1], "", nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("want %d for %s %s on the public gateway have (%d) %s", http.StatusNotFound, req[0], req[1], resp.StatusCode, body)
+		}
+	}
+
+	// The admin handler serves the other routes as well.
+	resp, body := doRequest(t, http.MethodPut, ts.URL+"/objects/picture", "some jpeg bytes", nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("want %d have (%d) %s", http.StatusCreated, resp.StatusCode, body)
+	}
+
+	resp, body = doRequest(t, http.MethodGet, ts.URL+"/admin/status", "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status response (%d) %s", resp.StatusCode, body)
+	}
+	var status Status
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Store.Objects != 1 || len(status.Peers) != 0 {
+		t.Errorf("want the file and no peer have %+v", status)
+	}
+
+	resp, body = doRequest(t, http.MethodDelete, ts.URL+"/admin/peers/127.0.0.1:5000", "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("want %d disconnecting an unknown peer have %d: %s", http.StatusNotFound, resp.StatusCode, body)
+	}
+
+	resp, body = doRequest(t, http.MethodPost, ts.URL+"/admin/repair/picture", "", nil)
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(body) != `{"key":"picture","repaired":[]}` {
+		t.Errorf("unexpected repair response (%d) %s", resp.StatusCode, body)
+	}
+	resp, body = doRequest(t, http.MethodPost, ts.URL+"/admin/repair/missing", "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("want %d repairing a missing file have %d: %s", http.StatusNotFound, resp.StatusCode, body)
+	}
+}
+
+func TestGatewayConsistency(t *testing.T) {
+	network := p2p.NewMemNetwork()
+	s1 := newMemServer(t, network, ":3000")
+	time.Sleep(10 * time.Millisecond)
+	s2 := newMemServerWith(t, network, FileServerOpts{
+		RedialInterval:   time.Hour,
+		ReadConsistency:  ConsistencyAll,
+		WriteConsistency: ConsistencyAll,
+	}, ":4000", ":3000")
+	time.Sleep(50 * time.Millisecond)
+	ts := httptest.NewServer(NewGateway(s2, GatewayOpts{}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s1.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitOffline(t, s2, ":3000")
+
+	// Without the parameter the consistency of the server is used, s1 is needed.
+	if resp, body := doRequest(t, http.MethodPut, ts.URL+"/objects/picture", "some jpeg bytes", nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("put: want 503 have %d %s", resp.StatusCode, body)
+	}
+	if resp, body := doRequest(t, http.MethodPut, ts.URL+"/objects/picture?consistency=one", "some jpeg bytes", nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("put with one: want 201 have %d %s", resp.StatusCode, body)
+	}
+	if resp, body := doRequest(t, http.MethodGet, ts.URL+"/objects/picture", "", nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("get: want 503 have %d %s", resp.StatusCode, body)
+	}
+	if resp, body := doRequest(t, http.MethodGet, ts.URL+"/objects/picture?consistency=one", "", nil); resp.StatusCode != http.StatusOK || body != "some jpeg bytes" {
+		t.Errorf("get with one: want 200 have %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestGatewayKeyTraversal(t *testing.T) {
+	ts := newTestGateway(t)
+	for _, path := range []string{"/objects/..%2F..%2Fsecret", "/objects/a%2F..%2F..%2F..%2Fsecret", "/objects/%2Fetc%2Fpasswd"} {
+		for _, method := range []string{http.MethodPut, http.MethodGet, http.MethodDelete} {
+			resp, body := doRequest(t, method, ts.URL+path, "evil", nil)
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("want %d for %s %s have (%d) %s", http.StatusBadRequest, method, path, resp.StatusCode, body)
+			}
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package node
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ashirwad-maker/quantumsync/store"
+)
+
+const (
+	defaultHintFolderName = "hints"
+	defaultMaxHintBytes   = 64 << 20 // 64MB
+	defaultHintTTL        = 24 * time.Hour
+)
+
+var ErrHintQueueFull = errors.New("hint queue is full")
+
+// Hint is a write that could not be delivered to a peer when Store was called.
+// It is parked on disk and handed over once the peer connects again (hinted handoff).
+type Hint struct {
+	Peer    string
+	Msg     MessageStoreFile
+	Created time.Time
+
+	path string
+}
+
+// HintQueueOpts configures a HintQueue, the zero values keep their defaults.
+type HintQueueOpts struct {
+	// Root is the folder holding one sub folder of pending hints per peer.
+	Root string
+	// MaxBytes caps the total size of all the hints on disk, once reached new hints are rejected.
+	MaxBytes int64
+	// TTL is how long a hint is kept around, expired hints are dropped instead of being replayed.
+	TTL time.Duration
+}
+
+// HintQueue is the durable queue of hints, every hint is stored in its own file as
+// a length prefixed gob header followed by the (already encrypted) payload.
+type HintQueue struct {
+	HintQueueOpts
+
+	mu   sync.Mutex
+	seq  uint64
+	size int64
+}
+
+// NewHintQueue returns the hint queue kept under opts.Root.
+func NewHintQueue(opts HintQueueOpts) *HintQueue {
+	if len(opts.Root) == 0 {
+		opts.Root = filepath.Join(store.DefaultFolderName, defaultHintFolderName)
+	}
+	if opts.MaxBytes == 0 {
+		opts.MaxBytes = defaultMaxHintBytes
+	}
+	if opts.TTL == 0 {
+		opts.TTL = defaultHintTTL
+	}
+	q := &HintQueue{
+		HintQueueOpts: opts,
+	}
+	// Hints survive a restart, so account for whatever is already on disk.
+	q.size, _ = q.diskUsage()
+	return q
+}
+
+// Add parks the payload of msg for the given peer.
+func (q *HintQueue) Add(peer string, msg MessageStoreFile, r io.Reader) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.expire()
+
+	// The header is stored along with the payload, so it counts towards the cap too.
+	header := new(bytes.Buffer)
+	if _, err := writeFrame(header, hintHeader{Msg: msg, Created: time.Now()}); err != nil {
+		return err
+	}
+	if q.size+int64(header.Len())+msg.Size > q.MaxBytes {
+		return ErrHintQueueFull
+	}
+
+	dir := q.peerDir(peer)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	q.seq++
+	now := time.Now()
+	name := fmt.Sprintf("%020d-%06d.hint", now.UnixNano(), q.seq)
+	path := filepath.Join(dir, name)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	n, err := writeHint(f, header.Bytes(), r)
+	f.Close()
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	q.size += n
+	return nil
+}
+
+// Pending returns the hints parked for the peer, oldest first.
+func (q *HintQueue) Pending(peer string) ([]*Hint, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.expire()
+	return q.list(peer)
+}
+
+// Replay hands every pending hint of the peer to fn in the order they were added.
+// A hint is removed once fn returns without error, on the first error the replay stops
+// and the remaining hints stay on disk for the next time the peer connects.
+func (q *HintQueue) Replay(peer string, fn func(h *Hint, r io.Reader) error) error {
+	hints, err := q.Pending(peer)
+	if err != nil {
+		return err
+	}
+	for _, h := range hints {
+		if err := q.replayOne(h, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Size returns the number of bytes currently held by the queue.
+func (q *HintQueue) Size() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+func (q *HintQueue) replayOne(h *Hint, fn func(h *Hint, r io.Reader) error) error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := readHintHeader(f); err != nil {
+		f.Close()
+		return err
+	}
+	err = fn(h, io.LimitReader(f, h.Msg.Size))
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.remove(h.path, fi.Size())
+}
+
+func (q *HintQueue) list(peer string) ([]*Hint, error) {
+	dir := q.peerDir(peer)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The file names start with a zero padded timestamp, so sorting them gives the insertion order.
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	hints := make([]*Hint, 0, len(entries))
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		hdr, err := readHintHeader(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("corrupt hint (%s): %w", path, err)
+		}
+		hints = append(hints, &Hint{
+			Peer:    peer,
+			Msg:     hdr.Msg,
+			Created: hdr.Created,
+			path:    path,
+		})
+	}
+	return hints, nil
+}
+
+// expire drops every hint older than the TTL. It has to be called with q.mu held.
+func (q *HintQueue) expire() {
+	cutoff := time.Now().Add(-q.TTL).UnixNano()
+	peers, err := os.ReadDir(q.Root)
+	if err != nil {
+		return
+	}
+	for _, p := range peers {
+		dir := filepath.Join(q.Root, p.Name())
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			created, ok := hintCreated(e.Name())
+			if !ok || created >= cutoff {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			q.remove(filepath.Join(dir, e.Name()), info.Size())
+		}
+	}
+}
+
+func (q *HintQueue) remove(path string, size int64) error {
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	q.size -= size
+	// Drop the peer folder once it is empty, an error here only means there are hints left.
+	os.Remove(filepath.Dir(path))
+	return nil
+}
+
+func (q *HintQueue) diskUsage() (int64, error) {
+	var size int64
+	err := filepath.Walk(q.Root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	return size, err
+}
+
+// Peer addresses contain ':' (and for IPv6 '[' ']') so they are escaped before being used as a folder name.
+// The IDs come from the peers, "." and ".." are escaped as well to stay a folder of their own.
+func (q *HintQueue) peerDir(peer string) string {
+	name := url.PathEscape(peer)
+	if name == "." || name == ".." {
+		name = strings.ReplaceAll(name, ".", "%2E")
+	}
+	return filepath.Join(q.Root, name)
+}
+
+func hintCreated(name string) (int64, bool) {
+	ts, _, ok := strings.Cut(name, "-")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(ts, 10, 64)
+	return n, err == nil
+}
+
+type hintHeader struct {
+	Msg     MessageStoreFile
+	Created time.Time
+}
+
+// writeHint writes the header frame followed by the payload, it returns the bytes written.
+func writeHint(w io.Writer, header []byte, r io.Reader) (int64, error) {
+	nh, err := w.Write(header)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return 0, err
+	}
+	return int64(nh) + n, nil
+}
+
+func readHintHeader(r io.Reader) (hintHeader, error) {
+	var hdr hintHeader
+	err := readFrame(r, &hdr)
+	return hdr, err
+}
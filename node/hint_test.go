@@ -0,0 +1,217 @@
+package node
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ashirwad-maker/quantumsync/crypto"
+	"github.com/ashirwad-maker/quantumsync/p2p"
+	"github.com/ashirwad-maker/quantumsync/store"
+)
+
+func TestHintQueueReplay(t *testing.T) {
+	q := NewHintQueue(HintQueueOpts{Root: t.TempDir()})
+	peer := "127.0.0.1:3000"
+
+	for i := 0; i < 3; i++ {
+		data := []byte(fmt.Sprintf("hinted data %d", i))
+		msg := MessageStoreFile{Key: fmt.Sprintf("key_%d", i), Size: int64(len(data))}
+		if err := q.Add(peer, msg, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	err := q.Replay(peer, func(h *Hint, r io.Reader) error {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		got = append(got, h.Msg.Key+"="+string(b))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"key_0=hinted data 0", "key_1=hinted data 1", "key_2=hinted data 2"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("want %v have %v", want, got)
+	}
+	if q.Size() != 0 {
+		t.Errorf("expected the queue to be empty, have %d bytes", q.Size())
+	}
+}
+
+func TestHintQueueReplayError(t *testing.T) {
+	q := NewHintQueue(HintQueueOpts{Root: t.TempDir()})
+	peer := "127.0.0.1:3000"
+	data := []byte("some jpeg bytes")
+	if err := q.Add(peer, MessageStoreFile{Key: "key", Size: int64(len(data))}, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Replay(peer, func(*Hint, io.Reader) error { return io.ErrClosedPipe }); err == nil {
+		t.Error("expected the replay error to be returned")
+	}
+	hints, err := q.Pending(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hints) != 1 {
+		t.Errorf("expected the hint to be kept after a failed replay, have %d hints", len(hints))
+	}
+}
+
+func TestHintQueueLimits(t *testing.T) {
+	root := t.TempDir()
+	data := []byte("some jpeg bytes")
+	msg := MessageStoreFile{Key: "key", Size: int64(len(data))}
+
+	// The header is stored with the payload, so room for the payload alone is not enough.
+	q := NewHintQueue(HintQueueOpts{Root: t.TempDir(), MaxBytes: int64(len(data)) + 1})
+	if err := q.Add("peer", msg, bytes.NewReader(data)); err != ErrHintQueueFull {
+		t.Errorf("want %v have %v", ErrHintQueueFull, err)
+	}
+
+	q = NewHintQueue(HintQueueOpts{Root: root})
+	if err := q.Add("peer", msg, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	hints, err := q.Pending("peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(hints[0].path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Size() != info.Size() {
+		t.Errorf("want the size of the hint on disk %d have %d", info.Size(), q.Size())
+	}
+
+	// A cap fitting exactly one hint takes no more.
+	q = NewHintQueue(HintQueueOpts{Root: root, MaxBytes: info.Size()})
+	if err := q.Add("peer", msg, bytes.NewReader(data)); err != ErrHintQueueFull {
+		t.Errorf("want %v have %v", ErrHintQueueFull, err)
+	}
+
+	// A queue opened on the same root picks up the hints left on disk.
+	q = NewHintQueue(HintQueueOpts{Root: root, TTL: time.Millisecond})
+	if q.Size() == 0 {
+		t.Error("expected the hints on disk to be accounted for")
+	}
+	time.Sleep(5 * time.Millisecond)
+	hints, err = q.Pending("peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hints) != 0 {
+		t.Errorf("expected the hints to be expired, have %d", len(hints))
+	}
+	if _, err := os.Stat(filepath.Join(root, "peer")); !os.IsNotExist(err) {
+		t.Error("expected the empty peer folder to be removed")
+	}
+}
+
+// newHintMessage returns the message of a new version of the key written by s, as Store sends it.
+func newHintMessage(t *testing.T, s *FileServer, key string, data []byte) MessageStoreFile {
+	t.Helper()
+	meta, err := s.newVersionMeta(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return MessageStoreFile{
+		Key:     crypto.HashKey(key),
+		Size:    int64(len(data)) + 16,
+		Version: store.FormatVersionID(meta.Timestamp, meta.Node),
+		Meta:    *meta,
+	}
+}
+
+func TestFileServerHintInboundPeer(t *testing.T) {
+	network := p2p.NewMemNetwork()
+	s1 := newMemServer(t, network, ":3000")
+	time.Sleep(10 * time.Millisecond)
+	s2 := newMemServerWith(t, network, FileServerOpts{RedialInterval: 10 * time.Millisecond}, ":4000", ":3000")
+	time.Sleep(50 * time.Millisecond)
+
+	peers := s1.Peers()
+	if len(peers) != 1 || peers[0].Outbound {
+		t.Fatalf("want s2 connected to s1 have %+v", peers)
+	}
+	addr := peers[0].Addr
+	if keys := s1.hintKeys(addr); len(keys) != 1 || keys[0] != s2.store.ID {
+		t.Fatalf("want the hints of s2 kept under its ID have %v", keys)
+	}
+
+	// The write could not be sent to s2, it reconnects from another address.
+	data := []byte("some jpeg bytes")
+	msg := newHintMessage(t, s1, "picture", data)
+	if !s1.addHint(addr, msg, data) {
+		t.Fatal("want the write handed off")
+	}
+	if err := s1.DisconnectPeer(addr); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for !s2.store.HasVersion(msg.Key, msg.Version) || s1.hints.Size() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("want the hint replayed to s2 and dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if peers := s1.Peers(); len(peers) != 1 || peers[0].Addr == addr {
+		t.Errorf("want s2 back from another address have %+v", peers)
+	}
+}
+
+func TestFileServerHintReplayBusy(t *testing.T) {
+	network := p2p.NewMemNetwork()
+	// s1 turns down every write of its peers as busy.
+	tr := p2p.NewMemTransport(network, p2p.TCPTransportOpts{
+		ListenAddr:    ":3000",
+		HandshakeFunc: Handshake(nil),
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	s1 := NewFileServer(FileServerOpts{
+		EncKey:           crypto.NewEncryptionKey(),
+		StorageRoot:      t.TempDir(),
+		PathTansformFunc: store.CASPathTransformFunc,
+		Transport:        tr,
+	})
+	s1.inbox = newInbox(0)
+	tr.OnPeer = s1.OnPeer
+	tr.OnPeerDisconnect = s1.OnPeerDisconnect
+	go s1.Start()
+	t.Cleanup(s1.Stop)
+	time.Sleep(10 * time.Millisecond)
+	s2 := newMemServer(t, network, ":4000", ":3000")
+	time.Sleep(50 * time.Millisecond)
+
+	data := []byte("some jpeg bytes")
+	msg := newHintMessage(t, s2, "picture", data)
+	if !s2.addHint(":3000", msg, data) {
+		t.Fatal("want the write handed off")
+	}
+	peer, ok := s2.peer(":3000")
+	if !ok {
+		t.Fatal("want s2 connected to s1")
+	}
+
+	// The hint is only dropped once acked, s1 turned it down.
+	s2.replayHints(peer, s1.store.ID)
+	if n := s2.pendingHints(":3000"); n != 1 {
+		t.Errorf("want the hint kept have %d", n)
+	}
+	if s1.store.HasVersion(msg.Key, msg.Version) {
+		t.Error("want nothing written by a busy peer")
+	}
+}
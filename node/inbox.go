@@ -0,0 +1,158 @@
+package node
+
+import "sync"
+
+// inbox queues the messages of every peer until a worker handles them. The messages of a peer
+// are handled one at a time and in the order they came in, as the stream following a StoreFile
+// is read from the connection of the peer. The messages of a multiplexed peer came with their
+// stream, they are handled as they come. The peers with messages waiting take turns, so a peer
+// sending a lot of them does not hold up the others.
+type inbox struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// size is the number of messages a peer can have waiting, not counting the one handled.
+	size   int
+	queues map[string]*peerQueue
+	// ready are the peers with messages waiting that no worker is handling, in turn.
+	ready  []*peerQueue
+	closed bool
+}
+
+type peerQueue struct {
+	from string
+	msgs []*Message
+	// handling is the number of messages of the peer the workers handle, one at most unless the
+	// peer is multiplexed.
+	handling    int
+	multiplexed bool
+}
+
+// isReady reports whether a worker can take the next message of the peer.
+func (q *peerQueue) isReady() bool {
+	return len(q.msgs) > 0 && (q.handling == 0 || q.multiplexed)
+}
+
+func newInbox(size int) *inbox {
+	b := &inbox{
+		size:   size,
+		queues: make(map[string]*peerQueue),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// push queues the message, it returns false when the peer already has size messages waiting.
+func (b *inbox) push(from string, msg *Message) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[from]
+	if !ok {
+		q = &peerQueue{from: from, multiplexed: msg.stream != nil}
+		b.queues[from] = q
+	}
+	if len(q.msgs) >= b.size {
+		return false
+	}
+	q.msgs = append(q.msgs, msg)
+	if len(q.msgs) == 1 && q.isReady() {
+		b.ready = append(b.ready, q)
+		b.cond.Signal()
+	}
+	return true
+}
+
+// next waits for a message to handle, done has to be called with the peer once it is handled.
+// It returns false once the inbox is closed.
+func (b *inbox) next() (string, *Message, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(b.ready) == 0 && !b.closed {
+		b.cond.Wait()
+	}
+	if b.closed {
+		return "", nil, false
+	}
+	q := b.ready[0]
+	b.ready = b.ready[1:]
+	msg := q.msgs[0]
+	q.msgs = q.msgs[1:]
+	q.handling++
+	// The next message of a multiplexed peer can go to another worker, after the other peers.
+	if q.isReady() {
+		b.ready = append(b.ready, q)
+		b.cond.Signal()
+	}
+	return q.from, msg, true
+}
+
+// done puts the peer back at the end of the line when it has more messages waiting.
+func (b *inbox) done(from string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[from]
+	if !ok {
+		return
+	}
+	q.handling--
+	if len(q.msgs) == 0 {
+		if q.handling == 0 {
+			delete(b.queues, from)
+		}
+		return
+	}
+	if !q.multiplexed {
+		b.ready = append(b.ready, q)
+		b.cond.Signal()
+	}
+}
+
+// forget drops the messages waiting from a peer that went away, the one handled is finished.
+func (b *inbox) forget(from string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[from]
+	if !ok {
+		return
+	}
+	if q.isReady() {
+		for i, r := range b.ready {
+			if r == q {
+				b.ready = append(b.ready[:i], b.ready[i+1:]...)
+				break
+			}
+		}
+	}
+	q.msgs = nil
+	if q.handling == 0 {
+		delete(b.queues, from)
+	}
+}
+
+// len returns the number of messages waiting.
+func (b *inbox) len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, q := range b.queues {
+		n += len(q.msgs)
+	}
+	return n
+}
+
+// waiting returns the number of messages of the peer waiting.
+func (b *inbox) waiting(from string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if q, ok := b.queues[from]; ok {
+		return len(q.msgs)
+	}
+	return 0
+}
+
+// close wakes the workers up and makes them return, the messages waiting are dropped.
+func (b *inbox) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.cond.Broadcast()
+}
@@ -0,0 +1,162 @@
+package node
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ashirwad-maker/quantumsync/p2p"
+)
+
+func TestInbox(t *testing.T) {
+	b := newInbox(2)
+	msg := func(key string) *Message {
+		return &Message{Payload: MessageDeleteFile{Key: key}}
+	}
+	b.push("a", msg("a1"))
+	b.push("a", msg("a2"))
+	if b.push("a", msg("a3")) {
+		t.Error("want the third message of a turned down")
+	}
+	b.push("b", msg("b1"))
+
+	// The peers take turns, a message of a peer is only handed out once the previous one is done.
+	var order []string
+	for i := 0; i < 3; i++ {
+		from, m, ok := b.next()
+		if !ok {
+			t.Fatal("want a message")
+		}
+		order = append(order, m.Payload.(MessageDeleteFile).Key)
+		if i == 0 {
+			if !b.push("a", msg("a3")) {
+				t.Error("want room for a message of a once one was handed out")
+			}
+		}
+		b.done(from)
+	}
+	if want := []string{"a1", "b1", "a2"}; !equalStrings(order, want) {
+		t.Errorf("want %v have %v", want, order)
+	}
+
+	// The messages of a peer that went away are dropped.
+	b.forget("a")
+	done := make(chan bool)
+	go func() {
+		_, _, ok := b.next()
+		done <- ok
+	}()
+	select {
+	case <-done:
+		t.Fatal("want nothing left to handle")
+	case <-time.After(20 * time.Millisecond):
+	}
+	b.close()
+	if ok := <-done; ok {
+		t.Error("want next to return false once closed")
+	}
+}
+
+func TestInboxMultiplexed(t *testing.T) {
+	b := newInbox(4)
+	msg := func(key string) *Message {
+		return &Message{Payload: MessageDeleteFile{Key: key}, stream: io.NopCloser(bytes.NewReader(nil))}
+	}
+	b.push("a", msg("a1"))
+	b.push("a", msg("a2"))
+	b.push("b", &Message{Payload: MessageDeleteFile{Key: "b1"}})
+
+	// The messages of a multiplexed peer came with their stream, they are handed out without
+	// waiting for the previous one, taking turns with the other peers.
+	var order []string
+	for i := 0; i < 3; i++ {
+		_, m, ok := b.next()
+		if !ok {
+			t.Fatal("want a message")
+		}
+		order = append(order, m.Payload.(MessageDeleteFile).Key)
+	}
+	if want := []string{"a1", "b1", "a2"}; !equalStrings(order, want) {
+		t.Errorf("want %v have %v", want, order)
+	}
+	b.done("a")
+	b.done("b")
+	b.done("a")
+	if n := b.len(); n != 0 {
+		t.Errorf("want nothing waiting have %d", n)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReplyBusy(t *testing.T) {
+	network := p2p.NewMemNetwork()
+	l, err := network.Listen("node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dialed := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := network.Dial("peer", "node")
+		dialed <- conn
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := <-dialed
+
+	s := newTestServer(t)
+	s.inbox = newInbox(1)
+	from := conn.RemoteAddr().String()
+	s.peers[from] = p2p.NewTCPPeer(conn, false)
+
+	// Nobody handles the inbox, so the requests past the first one are turned down.
+	s.dispatch(from, &Message{Payload: MessageGetFile{Key: "first"}})
+	s.dispatch(from, &Message{Payload: MessageGetFile{Key: "second"}})
+
+	kind := make([]byte, 1)
+	if _, err := io.ReadFull(remote, kind); err != nil || kind[0] != p2p.IncomingStream {
+		t.Fatalf("want a stream have %v %v", kind, err)
+	}
+	var hdr fileHeader
+	if err := readHeader(remote, s.Codec, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	if !hdr.Busy {
+		t.Errorf("want a busy header have %+v", hdr)
+	}
+
+	// The file following a StoreFile turned down is read, then the ack tells why.
+	s.dispatch(from, &Message{Payload: MessageStoreFile{Key: "key", Version: "v1", Size: 4}})
+	remote.Write([]byte("data"))
+	if _, err := io.ReadFull(remote, kind); err != nil || kind[0] != p2p.IncomingMessage {
+		t.Fatalf("want a message have %v %v", kind, err)
+	}
+	buf := make([]byte, 2048)
+	n, err := remote.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg Message
+	if err := s.Codec.Decode(bytes.NewReader(buf[:n]), &msg); err != nil {
+		t.Fatal(err)
+	}
+	ack, ok := msg.Payload.(MessageStoreAck)
+	if !ok || ack.Version != "v1" || ack.Err != ErrPeerBusy.Error() {
+		t.Errorf("want a busy ack of v1 have %+v", msg.Payload)
+	}
+}
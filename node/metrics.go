@@ -0,0 +1,61 @@
+package node
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ashirwad-maker/quantumsync/metrics"
+)
+
+// serverMetrics are the metrics of a FileServer, the transport and the store keep their own.
+type serverMetrics struct {
+	requests      *metrics.CounterVec
+	latency       *metrics.HistogramVec
+	replicated    *metrics.CounterVec
+	messages      *metrics.CounterVec
+	messageErrors *metrics.CounterVec
+	busy          *metrics.CounterVec
+}
+
+func newServerMetrics(r *metrics.Registry, s *FileServer) *serverMetrics {
+	// The gauges are worked out when scraped, a restarted server replaces the ones of the last.
+	r.GaugeFunc("qs_peers_connected", "Peers connected.", func() float64 {
+		peers, _ := s.peerSnapshot()
+		return float64(len(peers))
+	})
+	r.GaugeFunc("qs_peers_offline", "Peers we dialed that went away and are being redialed.", func() float64 {
+		_, offline := s.peerSnapshot()
+		return float64(len(offline))
+	})
+	r.GaugeFunc("qs_inbox_messages", "Messages of the peers waiting for a worker.", func() float64 {
+		return float64(s.inbox.len())
+	})
+	r.GaugeFunc("qs_hint_bytes", "Bytes of the writes handed off for the offline peers.", func() float64 {
+		return float64(s.hints.Size())
+	})
+	return &serverMetrics{
+		requests:      r.CounterVec("qs_requests_total", "Store, Get and Delete requests, by result.", "op", "result"),
+		latency:       r.HistogramVec("qs_request_duration_seconds", "Latency of the Store, Get and Delete requests.", nil, "op"),
+		replicated:    r.CounterVec("qs_replication_bytes_total", "Bytes of the files sent to and received from the peers, by traffic class.", "direction", "class"),
+		messages:      r.CounterVec("qs_messages_handled_total", "Messages of the peers handled, by type.", "type"),
+		messageErrors: r.CounterVec("qs_message_errors_total", "Messages of the peers that failed, by type.", "type"),
+		busy:          r.CounterVec("qs_busy_replies_total", "Messages of the peers turned down as too many were waiting, by type.", "type"),
+	}
+}
+
+// observe counts a request of the API that started at start and ended with *err.
+func (m *serverMetrics) observe(op string, start time.Time, err *error) {
+	result := "ok"
+	if *err != nil {
+		result = "error"
+	}
+	m.requests.With(op, result).Inc()
+	m.latency.With(op).ObserveSince(start)
+}
+
+// messageType names the type of a message in the logs and the metrics, StoreFile for a
+// MessageStoreFile.
+func messageType(msg *Message) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", msg.Payload), "node.Message")
+}
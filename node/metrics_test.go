@@ -0,0 +1,54 @@
+package node
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ashirwad-maker/quantumsync/metrics"
+	"github.com/ashirwad-maker/quantumsync/p2p"
+)
+
+func TestFileServerMetrics(t *testing.T) {
+	network := p2p.NewMemNetwork()
+	reg := metrics.NewRegistry()
+	s1 := newMemServer(t, network, ":3000")
+	time.Sleep(10 * time.Millisecond)
+	s2 := newMemServerWith(t, network, FileServerOpts{Metrics: reg}, ":4000", ":3000")
+	time.Sleep(50 * time.Millisecond)
+
+	data := "some jpeg bytes"
+	if _, err := s2.StoreWith("picture", strings.NewReader(data), WriteOpts{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s2.GetWith("missing", ReadOpts{}); err == nil {
+		t.Fatal("want an error getting a missing file")
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := reg.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`qs_requests_total{op="store",result="ok"} 1`,
+		`qs_requests_total{op="get",result="error"} 1`,
+		`qs_request_duration_seconds_count{op="store"} 1`,
+		`qs_store_writes_total 1`,
+		`qs_peers_connected 1`,
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("want %s in\n%s", line, buf)
+		}
+	}
+	// The file is sent to the peer encrypted, it is a little larger.
+	if n := s2.metrics.replicated.With("sent", TrafficUser.String()).Value(); n < float64(len(data)) {
+		t.Errorf("want at least %d bytes replicated have %g", len(data), n)
+	}
+	if s1.Metrics == reg {
+		t.Error("want the servers not given a registry to make their own")
+	}
+	if n := s1.metrics.messages.With("StoreFile").Value(); n != 1 {
+		t.Errorf("want 1 StoreFile handled by the peer have %g", n)
+	}
+}
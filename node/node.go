@@ -0,0 +1,176 @@
+// Package node runs a quantumsync node: a FileServer that stores files on the local disk and
+// replicates them to its peers, and the Gateway that exposes it over HTTP.
+//
+// MakeServer builds a node over TCP with the default settings, NewFromConfig builds it from a
+// Config. The storage lives in the store package and the encryption in the crypto package.
+package node
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ashirwad-maker/quantumsync/crypto"
+	"github.com/ashirwad-maker/quantumsync/metrics"
+	"github.com/ashirwad-maker/quantumsync/p2p"
+	"github.com/ashirwad-maker/quantumsync/store"
+	"github.com/ashirwad-maker/quantumsync/trace"
+)
+
+// MakeServer builds a node listening on listenAddr that stores its files in
+// <port>quantumsyncnetwork and connects to the given nodes once started.
+func MakeServer(listenAddr string, nodes ...string) *FileServer {
+	return MakeServerWithRoot(listenAddr, strings.TrimPrefix(listenAddr, ":")+"quantumsyncnetwork", nodes...)
+}
+
+// MakeServerWithRoot is MakeServer with the storage root given.
+func MakeServerWithRoot(listenAddr string, root string, nodes ...string) *FileServer {
+	defaults := DefaultConfig().Transport
+	reg := metrics.NewRegistry()
+	tcpOpts := p2p.TCPTransportOpts{
+		ListenAddr:        listenAddr,
+		HandshakeFunc:     Handshake(GobCodec{}),
+		Decoder:           p2p.DefaultDecoder{},
+		HeartbeatInterval: time.Duration(defaults.HeartbeatInterval),
+		ReadTimeout:       time.Duration(defaults.ReadTimeout),
+		WriteTimeout:      time.Duration(defaults.WriteTimeout),
+		MaxInbound:        defaults.MaxInbound,
+		MaxOutbound:       defaults.MaxOutbound,
+		Metrics:           reg,
+	}
+	tcpTransport := p2p.NewTCPTransport(tcpOpts)
+
+	fileServerOpts := FileServerOpts{
+		EncKey:           crypto.NewEncryptionKey(),
+		StorageRoot:      root,
+		PathTansformFunc: store.CASPathTransformFunc,
+		Transport:        tcpTransport,
+		BootstrapNodes:   nodes,
+		Metrics:          reg,
+	}
+	s := NewFileServer(fileServerOpts)
+	tcpTransport.OnPeer = s.OnPeer
+	tcpTransport.OnPeerDisconnect = s.OnPeerDisconnect
+
+	return s
+}
+
+// NewFromConfig builds the node described by the config, which should have been validated. The
+// logs of the node go to logger, nil drops them.
+func NewFromConfig(cfg *Config, logger *slog.Logger) (*FileServer, error) {
+	key, err := cfg.encryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	allow, err := p2p.ParsePrefixes(cfg.Transport.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := p2p.ParsePrefixes(cfg.Transport.Deny)
+	if err != nil {
+		return nil, err
+	}
+	// The transport, the server and the store count in the same registry, served on gateway.metrics.
+	reg := metrics.NewRegistry()
+	tcpOpts := p2p.TCPTransportOpts{
+		ListenAddr:        cfg.Transport.ListenAddr,
+		HandshakeFunc:     cfg.handshake(),
+		Decoder:           p2p.DefaultDecoder{},
+		HeartbeatInterval: time.Duration(cfg.Transport.HeartbeatInterval),
+		IdleTimeout:       time.Duration(cfg.Transport.IdleTimeout),
+		ReadTimeout:       time.Duration(cfg.Transport.ReadTimeout),
+		WriteTimeout:      time.Duration(cfg.Transport.WriteTimeout),
+		MaxInbound:        cfg.Transport.MaxInbound,
+		MaxOutbound:       cfg.Transport.MaxOutbound,
+		MaxConnsPerIP:     cfg.Transport.MaxConnsPerIP,
+		Allow:             allow,
+		Deny:              deny,
+		Logger:            logger,
+		Metrics:           reg,
+	}
+	var tcpTransport *p2p.TCPTransport
+	switch cfg.Transport.Network {
+	case "unix":
+		tcpTransport = p2p.NewUnixTransport(p2p.UnixTransportOpts{
+			TCPTransportOpts: tcpOpts,
+			Mode:             os.FileMode(cfg.Transport.SocketMode),
+		}).TCPTransport
+	case "ws":
+		tcpTransport = p2p.NewWSTransport(p2p.WSTransportOpts{TCPTransportOpts: tcpOpts}).TCPTransport
+	case "quic":
+		tcpTransport = p2p.NewQUICTransport(p2p.QUICTransportOpts{TCPTransportOpts: tcpOpts}).TCPTransport
+	default:
+		tcpTransport = p2p.NewTCPTransport(tcpOpts)
+	}
+
+	opts := cfg.fileServerOpts(key, tcpTransport)
+	opts.Logger = logger
+	opts.Metrics = reg
+	var exporter *trace.OTLPExporter
+	if len(cfg.Tracing.Endpoint) > 0 {
+		exporter = trace.NewOTLPExporter(trace.OTLPExporterOpts{
+			Endpoint: cfg.Tracing.Endpoint,
+			Service:  cfg.Tracing.Service,
+			Logger:   logger,
+		})
+		opts.Tracer = trace.NewTracer(trace.TracerOpts{Exporter: exporter})
+	}
+	s := NewFileServer(opts)
+	tcpTransport.OnPeer = s.OnPeer
+	tcpTransport.OnPeerDisconnect = s.OnPeerDisconnect
+	if exporter != nil {
+		s.flushTraces = exporter.Shutdown
+	}
+
+	return s, nil
+}
+
+// ProtocolVersion is the version of the messages the nodes exchange, it goes up with the changes
+// the older nodes can not read. MinProtocolVersion is the oldest one still spoken, so the nodes
+// of a cluster can be upgraded one at a time.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// Handshake returns the handshake agreeing on the protocol version with the peers. The peers
+// have to use the same codec, the binary one is a feature required by the nodes using it.
+// Multiplexing is only offered by the transports that can do it, QUIC for now.
+func Handshake(codec Codec) p2p.HandshakeFunc {
+	opts := p2p.VersionHandshakeOpts{
+		MinVersion: MinProtocolVersion,
+		MaxVersion: ProtocolVersion,
+		Features:   p2p.FeatureHeartbeat | p2p.FeatureMultiplexing,
+	}
+	if _, ok := codec.(BinaryCodec); ok {
+		opts.Required = p2p.FeatureBinaryCodec
+	}
+	return p2p.VersionHandshake(opts)
+}
+
+// nodeIDFile keeps the ID of the node in its storage root.
+const nodeIDFile = ".id"
+
+// loadNodeID reads the ID of the node from the storage root, it is created the first time.
+func loadNodeID(root string) (string, error) {
+	if len(root) == 0 {
+		root = store.DefaultFolderName
+	}
+	path := filepath.Join(root, nodeIDFile)
+	b, err := os.ReadFile(path)
+	if id := strings.TrimSpace(string(b)); err == nil && len(id) > 0 {
+		return id, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return "", err
+	}
+	id := crypto.GenerateID()
+	return id, os.WriteFile(path, []byte(id+"\n"), 0644)
+}
@@ -0,0 +1,116 @@
+package node
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket, it refills at rate tokens per second up to burst tokens.
+// A rate of zero or less means no limit. The rate can be changed while it is in use.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// refilled counts the tokens ever refilled, a WaitN is done once it reaches the tokens it is
+	// owed. changed is closed by SetRate to wake up the WaitN sleeping on the previous rate.
+	refilled float64
+	changed  chan struct{}
+}
+
+// NewRateLimiter returns a limiter of rate tokens per second, see SetRate for the burst.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	l := &RateLimiter{}
+	l.SetRate(rate, burst)
+	return l
+}
+
+// SetRate changes the rate and the burst of the limiter, a burst of zero or less defaults to
+// one second worth of tokens. The tokens left are kept, up to the new burst, a limiter that had
+// no limit starts with a full burst.
+func (l *RateLimiter) SetRate(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limited := l.rate > 0
+	if limited {
+		l.refill()
+	}
+	l.rate = rate
+	l.burst = float64(burst)
+	if l.burst <= 0 {
+		l.burst = max(rate, 1)
+	}
+	if limited {
+		l.tokens = min(l.tokens, l.burst)
+	} else {
+		l.tokens = l.burst
+	}
+	l.last = time.Now()
+	if l.changed != nil {
+		close(l.changed)
+	}
+	l.changed = make(chan struct{})
+}
+
+func (l *RateLimiter) Rate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// Allow takes a token if one is available.
+func (l *RateLimiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return true
+	}
+	l.refill()
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// WaitN takes n tokens, waiting for them to be refilled when there are not enough. The tokens
+// can go below zero, so n can be larger than the burst. A change of the rate applies to the
+// wait straight away.
+func (l *RateLimiter) WaitN(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return
+	}
+	l.refill()
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return
+	}
+	// The tokens missing are owed once as many were refilled, whatever the rate by then.
+	owed := l.refilled - l.tokens
+	for l.rate > 0 && l.refilled < owed {
+		wait := time.Duration((owed - l.refilled) / l.rate * float64(time.Second))
+		changed := l.changed
+		l.mu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		}
+		l.mu.Lock()
+		l.refill()
+	}
+}
+
+func (l *RateLimiter) refill() {
+	now := time.Now()
+	tokens := min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.refilled += max(tokens-l.tokens, 0)
+	l.tokens = tokens
+	l.last = now
+}
@@ -0,0 +1,78 @@
+package node
+
+import (
+	"io"
+	"sync"
+)
+
+// replies routes the answers to a MessageGetFile sent to the multiplexed peers. They come on
+// streams of their own and in any order, the ID of the request echoed in their fileHeader tells
+// which fetch is waiting for them.
+type replies struct {
+	mu      sync.Mutex
+	next    uint64
+	waiting map[string]map[uint64]chan reply
+}
+
+// reply is the header of an answer and the stream of the file following it.
+type reply struct {
+	hdr  fileHeader
+	body io.ReadCloser
+}
+
+func newReplies() *replies {
+	return &replies{waiting: make(map[string]map[uint64]chan reply)}
+}
+
+// newID returns the ID of a new request.
+func (r *replies) newID() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.next++
+	return r.next
+}
+
+// expect returns the channel the answer of the peer to the request comes on, it is closed when
+// the peer goes away first. forget has to be called once done with it.
+func (r *replies) expect(addr string, id uint64) chan reply {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.waiting[addr] == nil {
+		r.waiting[addr] = make(map[uint64]chan reply)
+	}
+	ch := make(chan reply, 1)
+	r.waiting[addr][id] = ch
+	return ch
+}
+
+func (r *replies) forget(addr string, id uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.waiting[addr], id)
+	if len(r.waiting[addr]) == 0 {
+		delete(r.waiting, addr)
+	}
+}
+
+// deliver hands the answer to the fetch waiting for it, it returns false when nobody does.
+func (r *replies) deliver(addr string, rep reply) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ch, ok := r.waiting[addr][rep.hdr.ID]
+	if !ok {
+		return false
+	}
+	delete(r.waiting[addr], rep.hdr.ID)
+	ch <- rep
+	return true
+}
+
+// drop lets go of the fetches waiting on the peer, it went away.
+func (r *replies) drop(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, ch := range r.waiting[addr] {
+		close(ch)
+	}
+	delete(r.waiting, addr)
+}
@@ -0,0 +1,1775 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ashirwad-maker/quantumsync/crypto"
+	"github.com/ashirwad-maker/quantumsync/metrics"
+	"github.com/ashirwad-maker/quantumsync/p2p"
+	"github.com/ashirwad-maker/quantumsync/store"
+	"github.com/ashirwad-maker/quantumsync/trace"
+)
+
+// FileServerOpts configures a FileServer, the zero values of the tuning options keep their defaults.
+type FileServerOpts struct {
+	EncKey      []byte // EncKey is used to encrypt and decrypt the data in the file.
+	StorageRoot string
+	// ID names the node, its files are kept under <StorageRoot>/<ID>. Empty uses the ID kept in
+	// the storage root, a new one the first time, so a restarted node finds its files again.
+	ID               string
+	PathTansformFunc store.PathTansformFunc
+	Transport        p2p.Transport
+	BootstrapNodes   []string // Bootstrap nodes in context of p2p, are specific nodes that serve as initial contact points
+	// for new nodes joining the network, they are repsonsible for connection of peers in decentralized network.
+
+	// MaxHintBytes and HintTTL bound the hinted handoff queue, which keeps the writes for
+	// peers that could not be reached during Store until they reconnect.
+	MaxHintBytes int64
+	HintTTL      time.Duration
+	// RedialInterval is the time waited between attempts to reconnect to a peer we dialed that went away.
+	RedialInterval time.Duration
+
+	// Versioning keeps every Store of a key as a new version instead of overwriting it,
+	// MaxVersions and MaxVersionAge are the retention policy of the old versions.
+	Versioning    bool
+	MaxVersions   int
+	MaxVersionAge time.Duration
+	// KeepSiblings keeps the versions of a key written concurrently by different nodes instead of
+	// only keeping the last writer, Get reports them so the caller can resolve the conflict.
+	KeepSiblings bool
+
+	// ReadConsistency and WriteConsistency are used by Get and Store, GetWith and StoreWith
+	// take the level per call.
+	ReadConsistency  Consistency
+	WriteConsistency Consistency
+	// AckTimeout is how long Store waits for the acknowledgements of the peers.
+	AckTimeout time.Duration
+	// Codec encodes the messages sent to the peers, it defaults to GobCodec.
+	Codec Codec
+	// Bandwidth throttles the files sent to and received from the peers, SetBandwidthLimits
+	// changes it while running.
+	Bandwidth BandwidthLimits
+	// Workers is the number of messages of the peers handled at the same time, InboxSize the
+	// number of messages a peer can have waiting. The requests coming in past it are answered
+	// with ErrPeerBusy.
+	Workers   int
+	InboxSize int
+	// Logger gets the logs of the server and of its store, every record has the address of the
+	// transport as node. Nil drops them.
+	Logger *slog.Logger
+	// Metrics is the registry the requests, messages and replication traffic of the server, and
+	// the files of its store, are counted in. Nil makes a new one, serving it over HTTP exposes
+	// them to Prometheus.
+	Metrics *metrics.Registry
+	// Tracer starts the spans of the requests, and of the messages of the peers that are part of
+	// them. Nil records nothing.
+	Tracer trace.Tracer
+}
+
+// FileServer stores files on the local disk and replicates them to its peers over the transport.
+type FileServer struct {
+	FileServerOpts
+	peerLock sync.Mutex
+	peers    map[string]p2p.Peer
+	// offline holds the addresses of the peers we dialed that dropped, writes for them are hinted.
+	offline map[string]struct{}
+	// ids are the node IDs the peers said hello with, by address. The writes handed off for a peer
+	// are kept under its ID, the address of an inbound peer changes every time it reconnects.
+	ids map[string]string
+	// streamLock makes sure only one file is being streamed to the peers at a time, otherwise
+	// a Store and a hint replay to the same peer would interleave on the connection. The peers
+	// that agreed on multiplexing get every stream on its own and do not take it, see lockStream.
+	streamLock sync.Mutex
+	store      *store.Store
+	hints      *HintQueue
+	clock      *store.HLC
+	bandwidth  *Bandwidth
+	inbox      *inbox
+	log        *slog.Logger
+	metrics    *serverMetrics
+	// transfers are the files being streamed, errors the last warnings and errors logged.
+	transfers *transfers
+	errors    *recentErrors
+	// flushTraces sends the spans not exported yet on Shutdown, when the server made the exporter.
+	flushTraces func(context.Context) error
+	// replies routes the answers of the multiplexed peers to the fetches waiting for them.
+	replies *replies
+	// acks routes the MessageStoreAck of a version to the Store waiting for it, or to the hint
+	// replay waiting for the one of a peer, see handedOff.
+	ackLock sync.Mutex
+	acks    map[string]chan peerAck
+	quitch  chan struct{}
+
+	// closing is set by Shutdown, inflight are the requests it waits for.
+	closeLock sync.Mutex
+	closing   bool
+	started   bool
+	inflight  sync.WaitGroup
+	loopDone  chan struct{}
+	stopOnce  sync.Once
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// ErrServerClosed is returned by the requests made once the server is shutting down.
+var ErrServerClosed = errors.New("server is shutting down")
+
+// ErrPeerBusy is the error of the requests a peer turned down as it had too many messages to handle.
+var ErrPeerBusy = errors.New("peer is busy")
+
+// NewFileServer returns a FileServer, the OnPeer and OnPeerDisconnect of the transport have to be
+// set to the ones of the server, MakeServer does it for TCP.
+func NewFileServer(opts FileServerOpts) *FileServer {
+	if opts.RedialInterval == 0 {
+		opts.RedialInterval = 2 * time.Second
+	}
+	if opts.AckTimeout == 0 {
+		opts.AckTimeout = 5 * time.Second
+	}
+	if opts.Codec == nil {
+		opts.Codec = GobCodec{}
+	}
+	if opts.Workers == 0 {
+		opts.Workers = 8
+	}
+	if opts.InboxSize == 0 {
+		opts.InboxSize = 32
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	if opts.Metrics == nil {
+		opts.Metrics = metrics.NewRegistry()
+	}
+	if opts.Tracer == nil {
+		opts.Tracer = trace.Nop
+	}
+	// The warnings and errors are kept for Status, whatever the level of the logger.
+	recent := &recentErrors{}
+	logger := slog.New(&errorsHandler{next: opts.Logger.Handler(), recent: recent}).With("node", opts.Transport.Addr())
+	// The store always keeps versions as they carry the metadata needed to resolve conflicting
+	// writes, without versioning only the latest one is retained.
+	if len(opts.ID) == 0 {
+		id, err := loadNodeID(opts.StorageRoot)
+		if err != nil {
+			logger.Warn("could not load the node ID, using a new one", "err", err)
+			id = crypto.GenerateID()
+		}
+		opts.ID = id
+	}
+	storeOpts := store.StoreOpts{
+		Root:             opts.StorageRoot,
+		ID:               opts.ID,
+		PathTansformFunc: opts.PathTansformFunc,
+		Versioning:       true,
+		MaxVersions:      opts.MaxVersions,
+		MaxVersionAge:    opts.MaxVersionAge,
+		KeepSiblings:     opts.KeepSiblings,
+		Logger:           logger,
+		Metrics:          opts.Metrics,
+	}
+	if !opts.Versioning {
+		storeOpts.MaxVersions = 1
+		storeOpts.MaxVersionAge = 0
+	}
+	st := store.NewStore(storeOpts)
+	hintOpts := HintQueueOpts{
+		Root:     filepath.Join(st.Root, defaultHintFolderName),
+		MaxBytes: opts.MaxHintBytes,
+		TTL:      opts.HintTTL,
+	}
+	s := &FileServer{
+		FileServerOpts: opts,
+		store:          st,
+		hints:          NewHintQueue(hintOpts),
+		clock:          store.NewHLC(),
+		bandwidth:      NewBandwidth(opts.Bandwidth),
+		inbox:          newInbox(opts.InboxSize),
+		log:            logger,
+		transfers:      newTransfers(),
+		errors:         recent,
+		replies:        newReplies(),
+		acks:           make(map[string]chan peerAck),
+		quitch:         make(chan struct{}),
+		loopDone:       make(chan struct{}),
+		peers:          make(map[string]p2p.Peer),
+		offline:        make(map[string]struct{}),
+		ids:            make(map[string]string),
+	}
+	s.metrics = newServerMetrics(opts.Metrics, s)
+	return s
+}
+
+type Message struct {
+	Payload any
+	// Trace is the span the message was sent from, the peer handling it continues the trace.
+	Trace trace.SpanContext
+	// stream is the one following the message when it came from a multiplexed peer, it is not
+	// sent.
+	stream io.ReadCloser
+}
+
+type MessageStoreFile struct {
+	Key  string
+	Size int64
+	// Version is the ID the version was created with, so every replica stores it under the same ID.
+	Version string
+	Meta    store.VersionMeta
+	// Repair is set on the writes catching a replica up, they are throttled as TrafficRepair.
+	Repair bool
+}
+
+func (m MessageStoreFile) class() TrafficClass {
+	if m.Repair {
+		return TrafficRepair
+	}
+	return TrafficUser
+}
+
+// MessageStoreAck is sent back by a peer once it has written a file, or failed to.
+type MessageStoreAck struct {
+	Key     string
+	Version string
+	// Bytes and Digest (sha256) are of the data as it was received, before it was written to disk.
+	Bytes  int64
+	Digest string
+	Err    string
+}
+
+type peerAck struct {
+	From string
+	MessageStoreAck
+}
+
+// PeerResult is the outcome of a Store on a single peer.
+type PeerResult struct {
+	Peer string
+	// Bytes and Digest are what the peer reports to have written.
+	Bytes  int64
+	Digest string
+	// Hinted is set when the peer could not be reached and the write was handed off.
+	Hinted bool
+	Err    error
+}
+
+// StoreResult summarizes a Store on the local disk and on every peer.
+type StoreResult struct {
+	Key     string
+	Version string
+	// Size is the number of bytes written to the local disk.
+	Size int64
+	// Acks is the number of replicas that have written the file, the local disk included.
+	Acks  int
+	Peers []PeerResult
+}
+
+// MessageDeleteFile asks the peers to remove every version of the file.
+type MessageDeleteFile struct {
+	Key string
+}
+
+// MessageGoodbye is sent to the peers by a server that is shutting down.
+type MessageGoodbye struct{}
+
+// MessageHello is sent to every peer once connected, ID is the one of the node.
+type MessageHello struct {
+	ID string
+}
+
+type MessageGetFile struct {
+	Key string
+	// Version asks for a specific version of the file, empty asks for the latest.
+	Version string
+	// ID is echoed in the fileHeader of the answer, the multiplexed peers answer in any order.
+	ID uint64
+}
+
+// fileHeader is sent at the start of the stream in reply to MessageGetFile, when the
+// peer does not have the file it is Missing and no data follows. Busy is set instead when the
+// peer had too many messages to handle.
+type fileHeader struct {
+	Size    int64
+	Version string
+	Meta    *store.VersionMeta
+	Missing bool
+	Busy    bool
+	// ID is the one of the MessageGetFile answered.
+	ID uint64
+}
+
+// writeFrame writes v gob encoded and length prefixed, so it can be followed by raw bytes
+// on the same stream. The gob decoder reads ahead and would otherwise eat them.
+func writeFrame(w io.Writer, v any) (int64, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(buf.Len())); err != nil {
+		return 0, err
+	}
+	n, err := w.Write(buf.Bytes())
+	return int64(4 + n), err
+}
+
+func readFrame(r io.Reader, v any) error {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(buf)).Decode(v)
+}
+
+// Object is a version of a file returned by Get.
+type Object struct {
+	io.ReadCloser
+	Version string
+	Size    int64
+	Meta    *store.VersionMeta
+	// Siblings are the versions of the key written concurrently when the server keeps siblings,
+	// the data of the object is the one of the last writer. Storing the key again resolves them.
+	Siblings []store.VersionInfo
+}
+
+// Get returns the latest version of the file, the reader is an *Object.
+func (s *FileServer) Get(key string) (io.Reader, error) {
+	return s.GetVersion(key, "")
+}
+
+// ListVersions returns the versions of the key that are stored on the local disk, oldest first.
+func (s *FileServer) ListVersions(key string) ([]store.VersionInfo, error) {
+	return s.store.ListVersions(key)
+}
+
+// GetVersion returns the given version of the file, an empty version returns the latest one.
+// The reader is an *Object.
+func (s *FileServer) GetVersion(key string, version string) (io.Reader, error) {
+	return s.GetObject(key, version)
+}
+
+// GetObject returns the given version of the file, an empty version returns the latest one.
+func (s *FileServer) GetObject(key string, version string) (*Object, error) {
+	return s.GetWith(key, ReadOpts{Version: version, Consistency: s.ReadConsistency})
+}
+
+// GetWith reads the file from as many replicas as the consistency level asks for and returns
+// the newest version among them. The replicas found with an older version, or without the
+// file, are repaired in the background.
+func (s *FileServer) GetWith(key string, opts ReadOpts) (_ *Object, err error) {
+	defer s.metrics.observe("get", time.Now(), &err)
+	ctx, span := s.startSpan(requestContext(opts.Context), "get", slog.String("key", crypto.HashKey(key)), slog.String("consistency", opts.Consistency.String()))
+	defer endSpan(span, &err)
+	if err := store.ValidateKey(key); err != nil {
+		return nil, err
+	}
+	if len(opts.Version) > 0 {
+		if err := store.ValidateVersionID(opts.Version); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.begin(); err != nil {
+		return nil, err
+	}
+	defer s.inflight.Done()
+
+	if opts.Consistency == ConsistencyOne && s.hasLocal(key, opts.Version) {
+		s.log.Debug("serving file from local disk", "key", crypto.HashKey(key))
+		return s.readObject(key, opts.Version)
+	}
+
+	if err := s.reachable(opts.Consistency, "read"); err != nil {
+		return nil, err
+	}
+	peers, offline := s.peerSnapshot()
+
+	replicas, busy := s.fetchAll(ctx, key, opts.Version, peers)
+	// The peers that answered count towards the consistency level with the local disk, the busy
+	// ones and the ones that failed do not.
+	need := opts.Consistency.required(len(peers) + len(offline) + 1)
+	if answered := len(replicas) + 1; answered < need {
+		return nil, fmt.Errorf("%w: (%s) read needs %d replicas, %d answered and %d were too busy", ErrNotEnoughReplicas, opts.Consistency, need, answered, busy)
+	}
+
+	// Every version received is stored, so without a version asked for the latest one wins.
+	obj, err := s.readObject(key, opts.Version)
+	if err != nil {
+		if busy > 0 {
+			return nil, fmt.Errorf("%w: (%s) not found, %d of the peers were too busy to look", ErrPeerBusy, key, busy)
+		}
+		return nil, err
+	}
+	// The repair is a request of its own, Shutdown waits for it as well.
+	if len(opts.Version) == 0 && s.begin() == nil {
+		go func() {
+			defer s.inflight.Done()
+			s.readRepair(ctx, key, obj.Version, replicas)
+		}()
+	}
+	return obj, nil
+}
+
+// reachable checks that enough replicas are connected for the consistency level, before a read
+// or a write does anything.
+func (s *FileServer) reachable(c Consistency, op string) error {
+	peers, offline := s.peerSnapshot()
+	need := c.required(len(peers) + len(offline) + 1)
+	if need > len(peers)+1 {
+		return fmt.Errorf("%w: (%s) %s needs %d replicas, %d are reachable", ErrNotEnoughReplicas, c, op, need, len(peers)+1)
+	}
+	return nil
+}
+
+// fetchAll asks the peers for the version of the file, every version they send is stored. It
+// returns the version every peer that answered has, empty for the peers that do not have the
+// file, and the number of peers too busy to answer. The busy peers and the ones that could not be
+// asked or failed to answer are left out, there is no telling what they have.
+func (s *FileServer) fetchAll(ctx context.Context, key string, version string, peers map[string]p2p.Peer) (map[string]string, int) {
+	s.log.Debug("fetching file from the peers", "key", crypto.HashKey(key), "peers", len(peers))
+
+	replicas := make(map[string]string, len(peers))
+	if len(peers) == 0 {
+		return replicas, 0
+	}
+	id := s.replies.newID()
+	msg := Message{
+		Payload: MessageGetFile{
+			Key:     crypto.HashKey(key),
+			Version: version,
+			ID:      id,
+		},
+	}
+	_, broadcast := s.startSpan(ctx, "broadcast", slog.Int("peers", len(peers)))
+	msg.Trace = broadcast.SpanContext()
+	b, err := encodeMessage(s.Codec, &msg)
+	asked := make(map[string]p2p.Peer, len(peers))
+	// The answers of the multiplexed peers are routed by the ID, they are expected before asking.
+	answers := make(map[string]chan reply)
+	for addr, peer := range peers {
+		if err != nil {
+			break
+		}
+		if multiplexed(peer) {
+			answers[addr] = s.replies.expect(addr, id)
+			defer s.replies.forget(addr, id)
+		}
+		if err := s.send(peer, b); err != nil {
+			s.log.Warn("could not ask peer for file", "peer", addr, "key", crypto.HashKey(key), "err", err)
+			continue
+		}
+		asked[addr] = peer
+	}
+	endSpan(broadcast, &err)
+
+	// Every peer asked answers on a stream of its own, which has to be read whatever happens to
+	// the others, or the read loop of the peer stays stuck on it.
+	busy := 0
+	for addr, peer := range asked {
+		hdr, err := s.fetchFromPeer(ctx, key, addr, peer, answers[addr])
+		if err != nil {
+			s.log.Warn("could not fetch file from peer", "peer", addr, "key", crypto.HashKey(key), "err", err)
+			continue
+		}
+		switch {
+		case hdr.Busy:
+			busy++
+		case hdr.Missing:
+			replicas[addr] = ""
+		default:
+			replicas[addr] = hdr.Version
+		}
+	}
+	return replicas, busy
+}
+
+// fetchFromPeer reads the answer of the peer to a MessageGetFile, the version it sent is stored.
+// The answer of a multiplexed peer comes on answer, the one of the others is the next stream read
+// off the connection.
+func (s *FileServer) fetchFromPeer(ctx context.Context, key string, addr string, peer p2p.Peer, answer chan reply) (_ fileHeader, err error) {
+	ctx, span := s.startSpan(ctx, "stream copy", slog.String("peer", addr))
+	defer endSpan(span, &err)
+
+	var hdr fileHeader
+	var st io.ReadCloser
+	if answer != nil {
+		select {
+		case rep, ok := <-answer:
+			if !ok {
+				return hdr, net.ErrClosed
+			}
+			hdr, st = rep.hdr, rep.body
+		case <-s.quitch:
+			return hdr, ErrServerClosed
+		}
+	} else {
+		st, err = peer.NextStream()
+		if err != nil {
+			return hdr, err
+		}
+		// First read the file size and version from the peers, then use it in the io.LimitReader
+		if err := readHeader(st, s.Codec, &hdr); err != nil {
+			st.Close()
+			return hdr, err
+		}
+	}
+	defer st.Close()
+	if hdr.Busy {
+		s.log.Warn("peer too busy to serve file", "peer", addr, "key", crypto.HashKey(key))
+		return hdr, nil
+	}
+	if hdr.Missing {
+		return hdr, nil
+	}
+	if hdr.Meta != nil {
+		s.clock.Update(hdr.Meta.Timestamp)
+	}
+
+	start := time.Now()
+	_, decrypt := s.startSpan(ctx, "decrypt", slog.String("version", hdr.Version))
+	tr := s.transfers.start(Transfer{Peer: addr, Key: crypto.HashKey(key), Version: hdr.Version, Direction: "receive", Class: TrafficUser.String(), Size: hdr.Size})
+	defer tr.done()
+	lr := io.LimitReader(tr.reader(s.bandwidth.Reader(st, addr, TrafficUser)), hdr.Size)
+	n, err := s.store.WriteDecryptVersion(s.EncKey, key, hdr.Version, hdr.Meta, lr)
+	decrypt.SetAttributes(slog.Int64("bytes", n))
+	endSpan(decrypt, &err)
+	if err != nil {
+		// Whatever is left of the stream has to be read, otherwise it ends up in the next message.
+		io.Copy(io.Discard, lr)
+		return hdr, err
+	}
+	s.metrics.replicated.With("received", TrafficUser.String()).Add(float64(n))
+	s.log.Info("file received", "peer", addr, "key", crypto.HashKey(key), "version", hdr.Version, "bytes", n, "duration", time.Since(start))
+	return hdr, nil
+}
+
+// readRepair sends the version to the replicas that are behind, it returns the addresses of the
+// ones repaired. It is called in a request, begin has to be called before.
+func (s *FileServer) readRepair(ctx context.Context, key string, version string, replicas map[string]string) []string {
+	var stale []p2p.Peer
+	for addr, v := range replicas {
+		if v >= version {
+			continue
+		}
+		if peer, ok := s.peer(addr); ok {
+			stale = append(stale, peer)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	ctx, span := s.startSpan(ctx, "read repair", slog.String("version", version), slog.Int("peers", len(stale)))
+	defer span.End()
+
+	log := s.log.With("key", crypto.HashKey(key), "version", version)
+	_, _, r, err := s.store.ReadVersion(key, version)
+	if err != nil {
+		log.Warn("read repair failed", "err", err)
+		return nil
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		log.Warn("read repair failed", "err", err)
+		return nil
+	}
+	meta, err := s.store.ReadVersionMeta(key, version)
+	if err != nil || meta == nil {
+		log.Warn("read repair failed, no metadata", "err", err)
+		return nil
+	}
+
+	msg := MessageStoreFile{
+		Key:     crypto.HashKey(key),
+		Size:    int64(len(data)) + 16,
+		Version: version,
+		Meta:    *meta,
+		Repair:  true,
+	}
+
+	var repaired []string
+	for _, peer := range stale {
+		if _, _, err := s.storeOnPeer(ctx, peer, msg, data); err != nil {
+			log.Warn("read repair failed", "peer", peer.RemoteAddr().String(), "err", err)
+			continue
+		}
+		log.Info("replica repaired", "peer", peer.RemoteAddr().String())
+		repaired = append(repaired, peer.RemoteAddr().String())
+	}
+	return repaired
+}
+
+func (s *FileServer) readObject(key string, version string) (*Object, error) {
+	version, size, r, err := s.store.ReadVersion(key, version)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := s.store.ReadVersionMeta(key, version)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	siblings, err := s.store.Siblings(key)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return &Object{
+		ReadCloser: r,
+		Version:    version,
+		Size:       size,
+		Meta:       meta,
+		Siblings:   siblings,
+	}, nil
+}
+
+// newVersionMeta stamps a local write of the key. Its vector clock has seen every version
+// stored so far, which is what resolves the siblings of the key.
+func (s *FileServer) newVersionMeta(key string) (*store.VersionMeta, error) {
+	versions, err := s.store.ListVersions(key)
+	if err != nil {
+		return nil, err
+	}
+	clock := store.VectorClock{}
+	for _, v := range store.SiblingVersions(versions) {
+		if v.Meta != nil {
+			clock = clock.Merge(v.Meta.Clock)
+		}
+	}
+	return &store.VersionMeta{
+		Timestamp: s.clock.Now(),
+		Node:      s.store.ID,
+		Clock:     clock.Increment(s.store.ID),
+	}, nil
+}
+
+func (s *FileServer) hasLocal(key string, version string) bool {
+	if len(version) == 0 {
+		return s.store.Has(key)
+	}
+	return s.store.HasVersion(key, version)
+}
+
+// broadcasting this to all the peers
+func (s *FileServer) stream(msg *Message) error {
+	buf := new(bytes.Buffer)
+	for _, peer := range s.peers {
+		if err := s.Codec.Encode(buf, msg); err != nil {
+			return err
+		}
+		// con.Write() take slice of bytes in input
+		peer.Send(buf.Bytes())
+	}
+	return nil
+}
+
+func (s *FileServer) broadcast(msg *Message) error {
+	b, err := encodeMessage(s.Codec, msg)
+	if err != nil {
+		return err
+	}
+
+	for _, peer := range s.peerList() {
+		if err := s.send(peer, b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// send writes an already encoded message to a single peer.
+func (s *FileServer) send(peer p2p.Peer, msg []byte) error {
+	defer s.lockStream(peer)()
+	w, err := peer.OpenStream()
+	if err != nil {
+		return err
+	}
+	if err := writeMessage(w, msg); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// lockStream takes streamLock for a peer that did not agree on multiplexing, the function
+// returned lets go of it.
+func (s *FileServer) lockStream(peer p2p.Peer) func() {
+	if multiplexed(peer) {
+		return func() {}
+	}
+	s.streamLock.Lock()
+	return s.streamLock.Unlock
+}
+
+// multiplexed reports whether the messages of the peer, with the streams following them, go on
+// streams of their own, so they do not wait for one another.
+func multiplexed(peer p2p.Peer) bool {
+	return peer.Protocol().Features.Has(p2p.FeatureMultiplexing)
+}
+
+func writeMessage(w io.Writer, msg []byte) error {
+	if _, err := w.Write([]byte{p2p.IncomingMessage}); err != nil {
+		return err
+	}
+	time.Sleep(5 * time.Millisecond)
+	_, err := w.Write(msg)
+	return err
+}
+
+// sendFile announces the file with msg and then streams it to the peer, copyFn writes
+// the actual bytes of the stream, throttled as the traffic class.
+func (s *FileServer) sendFile(ctx context.Context, peer p2p.Peer, msg *Message, class TrafficClass, copyFn func(w io.Writer) (int64, error)) (_ int64, err error) {
+	_, span := s.startSpan(ctx, "stream copy", slog.String("peer", peer.RemoteAddr().String()), slog.String("class", class.String()))
+	defer endSpan(span, &err)
+	msg.Trace = span.SpanContext()
+
+	b, err := encodeMessage(s.Codec, msg)
+	if err != nil {
+		return 0, err
+	}
+	defer s.lockStream(peer)()
+	w, err := peer.OpenStream()
+	if err != nil {
+		return 0, err
+	}
+	defer w.Close()
+	if err := writeMessage(w, b); err != nil {
+		return 0, err
+	}
+
+	// Here waiting is necessary as it will send the messages at the same instant, that can cause problem.
+	time.Sleep(time.Millisecond * 5)
+
+	if _, err := w.Write([]byte{p2p.IncomingStream}); err != nil {
+		return 0, err
+	}
+	info := Transfer{Peer: peer.RemoteAddr().String(), Direction: "send", Class: class.String()}
+	if file, ok := msg.Payload.(MessageStoreFile); ok {
+		info.Key, info.Version, info.Size = file.Key, file.Version, file.Size
+	}
+	tr := s.transfers.start(info)
+	defer tr.done()
+	n, err := copyFn(tr.writer(s.bandwidth.Writer(w, peer.RemoteAddr().String(), class)))
+	s.metrics.replicated.With("sent", class.String()).Add(float64(n))
+	span.SetAttributes(slog.Int64("bytes", n))
+	if err != nil {
+		return n, err
+	}
+	return n, w.Close()
+}
+
+// Store writes the file to the local disk and to every known peer.
+func (s *FileServer) Store(key string, r io.Reader) (*StoreResult, error) {
+	return s.StoreWith(key, r, WriteOpts{Consistency: s.WriteConsistency})
+}
+
+// StoreWith stores the file and waits for the acknowledgements of the peers it was sent to.
+// It fails when less replicas than the consistency level asks for have written the file, the
+// local disk included, the result tells what happened on every peer either way. When not enough
+// peers are connected to ever get there it fails straight away, without writing anything.
+func (s *FileServer) StoreWith(key string, r io.Reader, opts WriteOpts) (_ *StoreResult, err error) {
+	defer s.metrics.observe("store", time.Now(), &err)
+	ctx, span := s.startSpan(requestContext(opts.Context), "store", slog.String("key", crypto.HashKey(key)), slog.String("consistency", opts.Consistency.String()))
+	defer endSpan(span, &err)
+	if err := s.begin(); err != nil {
+		return nil, err
+	}
+	defer s.inflight.Done()
+
+	// A write that can not get the acks it needs is turned down before anything is written, as
+	// the reads are.
+	if err := s.reachable(opts.Consistency, "write"); err != nil {
+		return nil, err
+	}
+
+	// 1. Store this file to disk.
+	// 2. broadcast this file to all know peers in the network.
+
+	fileBuffer := new(bytes.Buffer)
+
+	// io.TeeReader is used where a copy of io.Reader is required. If not used, then after writing the data to the disk,
+	// the io.Reader will be at the EOF and no more data can be read and passed to Payload.data, therefore a copy of io.Reader is required.
+	tee := io.TeeReader(r, fileBuffer)
+	// a copy is being made in buf.
+
+	meta, err := s.newVersionMeta(key)
+	if err != nil {
+		return nil, err
+	}
+	version := store.FormatVersionID(meta.Timestamp, meta.Node)
+	span.SetAttributes(slog.String("version", version))
+	_, write := s.startSpan(ctx, "disk write")
+	size, err := s.store.WriteVersion(key, version, meta, tee)
+	write.SetAttributes(slog.Int64("bytes", size))
+	endSpan(write, &err)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := MessageStoreFile{
+		Key:     crypto.HashKey(key),
+		Size:    size + 16,
+		Version: version,
+		Meta:    *meta,
+	}
+	result := &StoreResult{
+		Key:     key,
+		Version: version,
+		Size:    size,
+		Acks:    1,
+	}
+
+	// Every peer gets its own reader over the buffered file, as each copyEncrypt consumes it.
+	data := fileBuffer.Bytes()
+	peers, offline := s.peerSnapshot()
+
+	acks := s.expectAcks(version, len(peers))
+	defer s.forgetAcks(version)
+
+	// The broadcast lasts until the acks are in, the spans of the peers writing the file are
+	// children of the stream copy to them.
+	bctx, broadcast := s.startSpan(ctx, "broadcast", slog.Int("peers", len(peers)), slog.Int("offline", len(offline)))
+
+	// The digest of what was sent to every peer, to check against the one in its ack.
+	sent := make(map[string]string, len(peers))
+	for addr, peer := range peers {
+		_, digest, err := s.storeOnPeer(bctx, peer, msg, data)
+		if err != nil {
+			s.log.Warn("could not send file, handing it off", "peer", addr, "key", msg.Key, "version", version, "err", err)
+			result.Peers = append(result.Peers, PeerResult{Peer: addr, Hinted: s.addHint(addr, msg, data), Err: err})
+			continue
+		}
+		sent[addr] = digest
+	}
+
+	// The peers that are currently unreachable get the write once they reconnect.
+	for _, addr := range offline {
+		result.Peers = append(result.Peers, PeerResult{Peer: addr, Hinted: s.addHint(addr, msg, data), Err: errPeerOffline})
+	}
+
+	s.collectAcks(result, acks, sent)
+	broadcast.SetAttributes(slog.Int("acks", result.Acks))
+	broadcast.End()
+
+	need := opts.Consistency.required(len(peers) + len(offline) + 1)
+	if result.Acks < need {
+		return result, fmt.Errorf("%w: (%s) write of (%s) got %d of %d acks", ErrNotEnoughReplicas, opts.Consistency, version, result.Acks, need)
+	}
+	return result, nil
+}
+
+var (
+	errPeerOffline = errors.New("peer is offline")
+	errAckTimeout  = errors.New("timed out waiting for ack")
+)
+
+// storeOnPeer announces the file with msg and streams the data encrypted to the peer, it returns
+// the sha256 digest of the bytes sent.
+func (s *FileServer) storeOnPeer(ctx context.Context, peer p2p.Peer, msg MessageStoreFile, data []byte) (int64, string, error) {
+	hash := sha256.New()
+	n, err := s.sendFile(ctx, peer, &Message{Payload: msg}, msg.class(), func(w io.Writer) (int64, error) {
+		n, err := crypto.CopyEncrypt(s.EncKey, bytes.NewReader(data), io.MultiWriter(w, hash))
+		return int64(n), err
+	})
+	return n, hex.EncodeToString(hash.Sum(nil)), err
+}
+
+// expectAcks returns the channel the acks routed by key come on, the version of a Store.
+func (s *FileServer) expectAcks(key string, peers int) chan peerAck {
+	ch := make(chan peerAck, peers)
+	s.ackLock.Lock()
+	s.acks[key] = ch
+	s.ackLock.Unlock()
+	return ch
+}
+
+func (s *FileServer) forgetAcks(key string) {
+	s.ackLock.Lock()
+	delete(s.acks, key)
+	s.ackLock.Unlock()
+}
+
+// collectAcks waits for the ack of every peer the file was sent to, at most AckTimeout, and
+// adds their results.
+func (s *FileServer) collectAcks(result *StoreResult, acks chan peerAck, sent map[string]string) {
+	pending := make(map[string]string, len(sent))
+	for addr, digest := range sent {
+		pending[addr] = digest
+	}
+
+	timeout := time.After(s.AckTimeout)
+	for len(pending) > 0 {
+		select {
+		case ack := <-acks:
+			digest, ok := pending[ack.From]
+			if !ok {
+				continue
+			}
+			delete(pending, ack.From)
+
+			res := PeerResult{Peer: ack.From, Bytes: ack.Bytes, Digest: ack.Digest}
+			switch {
+			case ack.Err == ErrPeerBusy.Error():
+				res.Err = ErrPeerBusy
+			case len(ack.Err) > 0:
+				res.Err = errors.New(ack.Err)
+			case ack.Digest != digest:
+				res.Err = fmt.Errorf("digest mismatch, sent %s peer has %s", digest, ack.Digest)
+			default:
+				result.Acks++
+			}
+			result.Peers = append(result.Peers, res)
+			s.log.Debug("ack received", "peer", ack.From, "key", crypto.HashKey(result.Key), "version", result.Version, "bytes", ack.Bytes, "err", res.Err)
+		case <-timeout:
+			for addr := range pending {
+				result.Peers = append(result.Peers, PeerResult{Peer: addr, Err: errAckTimeout})
+			}
+			return
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// addHint hands the write off for the peer, it reports whether it was.
+func (s *FileServer) addHint(addr string, msg MessageStoreFile, data []byte) bool {
+	keys := s.hintKeys(addr)
+	if len(keys) == 0 {
+		s.log.Warn("dropping write for inbound peer, it did not say hello", "peer", addr, "key", msg.Key, "version", msg.Version)
+		return false
+	}
+	buf := new(bytes.Buffer)
+	if _, err := crypto.CopyEncrypt(s.EncKey, bytes.NewReader(data), buf); err != nil {
+		s.log.Error("could not encrypt hint", "peer", addr, "key", msg.Key, "err", err)
+		return false
+	}
+	if err := s.hints.Add(keys[0], msg, buf); err != nil {
+		s.log.Warn("dropping write for offline peer", "peer", addr, "key", msg.Key, "version", msg.Version, "err", err)
+		return false
+	}
+	return true
+}
+
+// hintKeys returns what the writes handed off for the peer are kept under, its ID once it said
+// hello and the address we dial it at. An inbound peer that did not say hello has none, its
+// address does not outlive the connection.
+func (s *FileServer) hintKeys(addr string) []string {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	var keys []string
+	if id, ok := s.ids[addr]; ok {
+		keys = append(keys, id)
+	}
+	_, offline := s.offline[addr]
+	if peer, ok := s.peers[addr]; offline || ok && peer.Outbound() {
+		keys = append(keys, addr)
+	}
+	return keys
+}
+
+// replayHints streams the writes the peer missed while it was unreachable, the ones kept under
+// key. A hint is only dropped once the peer acked it.
+func (s *FileServer) replayHints(peer p2p.Peer, key string) {
+	if s.begin() != nil {
+		return
+	}
+	defer s.inflight.Done()
+
+	addr := peer.RemoteAddr().String()
+	ctx, span := s.startSpan(context.Background(), "hint replay", slog.String("peer", addr))
+	defer span.End()
+	err := s.hints.Replay(key, func(h *Hint, r io.Reader) error {
+		repair := h.Msg
+		repair.Repair = true
+		msg := Message{Payload: repair}
+
+		// A Store of the same version might still be waiting for the acks of the other peers.
+		acks := s.expectAcks(handedOff(addr, h.Msg.Version), 1)
+		defer s.forgetAcks(handedOff(addr, h.Msg.Version))
+
+		hash := sha256.New()
+		n, err := s.sendFile(ctx, peer, &msg, TrafficRepair, func(w io.Writer) (int64, error) {
+			return io.Copy(io.MultiWriter(w, hash), r)
+		})
+		if err != nil {
+			return err
+		}
+		select {
+		case ack := <-acks:
+			if len(ack.Err) > 0 {
+				return errors.New(ack.Err)
+			}
+			if digest := hex.EncodeToString(hash.Sum(nil)); ack.Digest != digest {
+				return fmt.Errorf("digest mismatch, sent %s peer has %s", digest, ack.Digest)
+			}
+		case <-time.After(s.AckTimeout):
+			return errAckTimeout
+		case <-s.quitch:
+			return ErrServerClosed
+		}
+		s.log.Info("hint handed off", "peer", addr, "key", h.Msg.Key, "version", h.Msg.Version, "bytes", n)
+		return nil
+	})
+	if err != nil {
+		span.SetError(err)
+		s.log.Warn("hint replay stopped", "peer", addr, "err", err)
+	}
+}
+
+// handedOff is the key the ack of a hint replayed to the peer is routed by.
+func handedOff(addr string, version string) string {
+	return addr + " " + version
+}
+
+func (s *FileServer) peerList() []p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func (s *FileServer) peerSnapshot() (map[string]p2p.Peer, []string) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peers := make(map[string]p2p.Peer, len(s.peers))
+	for addr, peer := range s.peers {
+		peers[addr] = peer
+	}
+	offline := make([]string, 0, len(s.offline))
+	for addr := range s.offline {
+		offline = append(offline, addr)
+	}
+	return peers, offline
+}
+
+// Delete removes the file from the local disk and asks every connected peer to do the same.
+func (s *FileServer) Delete(key string) (err error) {
+	defer s.metrics.observe("delete", time.Now(), &err)
+	ctx, span := s.startSpan(context.Background(), "delete", slog.String("key", crypto.HashKey(key)))
+	defer endSpan(span, &err)
+	if err := s.begin(); err != nil {
+		return err
+	}
+	defer s.inflight.Done()
+
+	if err := s.store.Delete(key); err != nil {
+		return err
+	}
+	_, broadcast := s.startSpan(ctx, "broadcast")
+	defer broadcast.End()
+	msg := Message{
+		Payload: MessageDeleteFile{
+			Key: crypto.HashKey(key),
+		},
+		Trace: broadcast.SpanContext(),
+	}
+	return s.broadcast(&msg)
+}
+
+// PeerInfo describes a peer of the server.
+type PeerInfo struct {
+	Addr string `json:"addr"`
+	// Outbound is set for the peers we dialed.
+	Outbound bool `json:"outbound"`
+	// Connected is false for the peers we dialed that went away and are being redialed.
+	Connected bool `json:"connected"`
+	// RTT is the round trip time measured by the heartbeats, zero until the first one.
+	RTT Duration `json:"rtt,omitempty"`
+	// ConnectedAt, BytesSent and BytesReceived are of the current connection.
+	ConnectedAt   time.Time `json:"connected_at,omitempty"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+	// Inbox is the number of messages of the peer waiting for a worker, Hints the number of
+	// writes handed off for it.
+	Inbox int `json:"inbox"`
+	Hints int `json:"hints"`
+}
+
+// BandwidthLimits returns the limits the replication traffic is throttled to.
+func (s *FileServer) BandwidthLimits() BandwidthLimits {
+	return s.bandwidth.Limits()
+}
+
+// SetBandwidthLimits changes the limits of the replication traffic, the files being sent and
+// received are throttled to them straight away.
+func (s *FileServer) SetBandwidthLimits(limits BandwidthLimits) {
+	s.bandwidth.SetLimits(limits)
+}
+
+// Peers returns the connected peers followed by the ones that are offline.
+func (s *FileServer) Peers() []PeerInfo {
+	peers, offline := s.peerSnapshot()
+	infos := make([]PeerInfo, 0, len(peers)+len(offline))
+	for addr, peer := range peers {
+		stats := peer.Stats()
+		infos = append(infos, PeerInfo{
+			Addr:          addr,
+			Outbound:      peer.Outbound(),
+			Connected:     true,
+			RTT:           Duration(peer.RTT()),
+			ConnectedAt:   stats.ConnectedAt,
+			BytesSent:     stats.BytesSent,
+			BytesReceived: stats.BytesReceived,
+			Inbox:         s.inbox.waiting(addr),
+			Hints:         s.pendingHints(addr),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Addr < infos[j].Addr })
+	sort.Strings(offline)
+	for _, addr := range offline {
+		infos = append(infos, PeerInfo{Addr: addr, Outbound: true, Hints: s.pendingHints(addr)})
+	}
+	return infos
+}
+
+// pendingHints returns the number of writes handed off for the peer, zero when they cannot be listed.
+func (s *FileServer) pendingHints(addr string) int {
+	var n int
+	for _, key := range s.hintKeys(addr) {
+		hints, err := s.hints.Pending(key)
+		if err != nil {
+			s.log.Debug("could not list the hints", "peer", addr, "err", err)
+		}
+		n += len(hints)
+	}
+	return n
+}
+
+// Stop stops the server right away, Shutdown lets the requests in flight finish first.
+func (s *FileServer) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.quitch)
+	})
+}
+
+// Shutdown stops the server gracefully. New requests and new peers are refused straight away,
+// the requests in flight are given until the context is done to finish, then the peers are told
+// goodbye, their connections are closed and the store is flushed. When the context is done first
+// the connections are closed anyway and its error is returned.
+func (s *FileServer) Shutdown(ctx context.Context) error {
+	s.closeLock.Lock()
+	if s.closing {
+		s.closeLock.Unlock()
+		return ErrServerClosed
+	}
+	s.closing = true
+	started := s.started
+	s.closeLock.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+		s.sayGoodbye()
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// The loop finishes the message it is handling before it returns, a peer streaming a file
+	// to us is not cut short.
+	s.Stop()
+	if started {
+		select {
+		case <-s.loopDone:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	for _, peer := range s.peerList() {
+		peer.Close()
+	}
+	if e := s.closeTransport(); e != nil && err == nil {
+		err = e
+	}
+	if e := s.store.Flush(); e != nil && err == nil {
+		err = e
+	}
+	if s.flushTraces != nil {
+		if e := s.flushTraces(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// begin registers a request Shutdown has to wait for, it fails once the server is shutting down.
+func (s *FileServer) begin() error {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+	if s.closing {
+		return ErrServerClosed
+	}
+	s.inflight.Add(1)
+	return nil
+}
+
+func (s *FileServer) isClosing() bool {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+	return s.closing
+}
+
+// sayHello tells the peer our ID, it replays the writes handed off for us under it.
+func (s *FileServer) sayHello(peer p2p.Peer) {
+	b, err := encodeMessage(s.Codec, &Message{Payload: MessageHello{ID: s.store.ID}})
+	if err != nil {
+		s.log.Error("could not encode hello", "err", err)
+		return
+	}
+	if err := s.send(peer, b); err != nil {
+		s.log.Warn("could not say hello", "peer", peer.RemoteAddr().String(), "err", err)
+	}
+}
+
+// sayGoodbye tells the peers we are leaving, so they close the connection on their side.
+func (s *FileServer) sayGoodbye() {
+	msg := Message{Payload: MessageGoodbye{}}
+	if err := s.broadcast(&msg); err != nil {
+		s.log.Warn("could not say goodbye", "err", err)
+	}
+}
+
+func (s *FileServer) closeTransport() error {
+	s.closeOnce.Do(func() {
+		s.closeErr = s.Transport.Close()
+	})
+	return s.closeErr
+}
+
+func (s *FileServer) OnPeer(p p2p.Peer) error {
+	if s.isClosing() {
+		return ErrServerClosed
+	}
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	addr := p.RemoteAddr().String()
+	s.peers[addr] = p
+	delete(s.offline, addr)
+	s.log.Info("peer connected", "peer", addr, "outbound", p.Outbound(), "protocol", p.Protocol().Version, "features", p.Protocol().Features.String())
+
+	go s.sayHello(p)
+	// The writes handed off before the peer said hello are kept under the address we dial it at.
+	if p.Outbound() {
+		go s.replayHints(p, addr)
+	}
+
+	return nil
+}
+
+// OnPeerDisconnect forgets about the peer. Peers we dialed are redialed in the background and
+// are hinted until then. The address of an inbound peer changes when it reconnects, the writes
+// that could not be sent to it are hinted under the ID it said hello with.
+func (s *FileServer) OnPeerDisconnect(p p2p.Peer) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	addr := p.RemoteAddr().String()
+	delete(s.peers, addr)
+	s.bandwidth.forget(addr)
+	s.inbox.forget(addr)
+	s.replies.drop(addr)
+	s.log.Info("peer disconnected", "peer", addr)
+
+	if p.Outbound() {
+		s.offline[addr] = struct{}{}
+		go s.redial(addr)
+	} else {
+		delete(s.ids, addr)
+	}
+}
+
+func (s *FileServer) redial(addr string) {
+	for {
+		select {
+		case <-s.quitch:
+			return
+		case <-time.After(s.RedialInterval):
+		}
+
+		s.peerLock.Lock()
+		_, ok := s.offline[addr]
+		s.peerLock.Unlock()
+		if !ok || s.isClosing() {
+			return
+		}
+		if err := s.Transport.Dial(addr); err == nil {
+			return
+		}
+	}
+}
+
+// SetBootstrapNodes replaces the bootstrap nodes and dials the ones that were not in the list
+// before. Peers that are no longer in the list stay connected.
+func (s *FileServer) SetBootstrapNodes(nodes []string) {
+	s.peerLock.Lock()
+	known := make(map[string]bool, len(s.BootstrapNodes))
+	for _, addr := range s.BootstrapNodes {
+		known[addr] = true
+	}
+	s.BootstrapNodes = nodes
+	s.peerLock.Unlock()
+
+	var added []string
+	for _, addr := range nodes {
+		if !known[addr] {
+			added = append(added, addr)
+		}
+	}
+	s.dialNodes(added)
+}
+
+func (s *FileServer) bootstrapNetwork() error {
+	s.peerLock.Lock()
+	nodes := s.BootstrapNodes
+	s.peerLock.Unlock()
+
+	s.dialNodes(nodes)
+	return nil
+}
+
+func (s *FileServer) dialNodes(nodes []string) {
+	for _, addr := range nodes {
+		if len(addr) == 0 {
+			continue
+		}
+		go func(addr string) {
+			s.log.Debug("dialing peer", "peer", addr)
+			if err := s.Transport.Dial(addr); err != nil {
+				s.log.Warn("could not dial peer", "peer", addr, "err", err)
+			}
+		}(addr)
+	}
+}
+
+// loop hands the messages of the peers to the workers, it never waits for them so a slow
+// message does not hold up the reads from the other peers. The workers finish the messages they
+// are handling before it returns, a peer streaming a file to us is not cut short.
+func (s *FileServer) loop() {
+	var workers sync.WaitGroup
+	for i := 0; i < s.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.work()
+		}()
+	}
+	defer func() {
+		s.log.Info("server stopping")
+		s.inbox.close()
+		workers.Wait()
+		close(s.loopDone)
+	}()
+	for {
+		select {
+		case rpc := <-s.Transport.Consume():
+			// A stream on its own is the answer of a multiplexed peer to a MessageGetFile.
+			if rpc.Stream && rpc.Body != nil {
+				go s.handleReply(rpc.From, rpc.Body)
+				continue
+			}
+
+			var msg Message
+			if err := s.Codec.Decode(bytes.NewReader(rpc.Payload), &msg); err != nil {
+				s.log.Warn("could not decode message", "peer", rpc.From, "err", err)
+				if rpc.Body != nil {
+					rpc.Body.Close()
+				}
+				continue
+			}
+			msg.stream = rpc.Body
+			s.dispatch(rpc.From, &msg)
+
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// handleReply reads the header of an answer to a MessageGetFile and hands it to the fetch waiting
+// for it.
+func (s *FileServer) handleReply(from string, body io.ReadCloser) {
+	var hdr fileHeader
+	if err := readHeader(body, s.Codec, &hdr); err != nil {
+		s.log.Warn("could not read answer", "peer", from, "err", err)
+		body.Close()
+		return
+	}
+	if !s.replies.deliver(from, reply{hdr: hdr, body: body}) {
+		s.log.Debug("answer nobody waits for", "peer", from, "id", hdr.ID)
+		body.Close()
+	}
+}
+
+// closeStream closes the stream that came along with the message, once it was handled.
+func closeStream(msg *Message) {
+	if msg.stream != nil {
+		msg.stream.Close()
+	}
+}
+
+// nextStream returns the stream following a message, the one that came along with it from a
+// multiplexed peer or the next one read off the connection.
+func nextStream(peer p2p.Peer, stream io.ReadCloser) (io.ReadCloser, error) {
+	if stream != nil {
+		return stream, nil
+	}
+	return peer.NextStream()
+}
+
+func (s *FileServer) work() {
+	for {
+		from, msg, ok := s.inbox.next()
+		if !ok {
+			return
+		}
+		start := time.Now()
+		typ := messageType(msg)
+		s.metrics.messages.With(typ).Inc()
+		ctx, span := s.startSpan(trace.ContextWithRemote(context.Background(), msg.Trace), "handle "+typ, slog.String("peer", from))
+		err := s.handleMessage(ctx, from, msg)
+		closeStream(msg)
+		endSpan(span, &err)
+		if err != nil {
+			s.metrics.messageErrors.With(typ).Inc()
+			s.log.Warn("message failed", "peer", from, "type", typ, "err", err)
+		}
+		s.log.Debug("message handled", "peer", from, "type", typ, "duration", time.Since(start))
+		s.inbox.done(from)
+	}
+}
+
+// dispatch queues the message for the workers. The acks, hellos and goodbyes are handled straight
+// away, they take no time and the Store waiting for an ack should not wait behind the requests.
+func (s *FileServer) dispatch(from string, msg *Message) {
+	switch v := msg.Payload.(type) {
+	case MessageStoreAck:
+		closeStream(msg)
+		s.handleMessageStoreAck(from, v)
+		return
+	case MessageGoodbye:
+		closeStream(msg)
+		s.handleMessageGoodbye(from)
+		return
+	case MessageHello:
+		closeStream(msg)
+		s.handleMessageHello(from, v)
+		return
+	}
+	if !s.inbox.push(from, msg) {
+		s.replyBusy(from, msg)
+	}
+}
+
+// replyBusy turns down a message of a peer that has too many waiting, the messages nobody waits
+// an answer for are dropped. The answer is sent in the background, as the peer might be busy
+// streaming to us.
+func (s *FileServer) replyBusy(from string, msg *Message) {
+	s.metrics.busy.With(messageType(msg)).Inc()
+	s.log.Warn("too many messages waiting, replying busy", "peer", from, "type", messageType(msg))
+	peer, ok := s.peer(from)
+	if !ok {
+		closeStream(msg)
+		return
+	}
+	switch v := msg.Payload.(type) {
+	case MessageStoreFile:
+		go func() {
+			// The stream has to be read all the same, otherwise it ends up in the next message.
+			if st, err := nextStream(peer, msg.stream); err == nil {
+				io.CopyN(io.Discard, st, v.Size)
+				st.Close()
+			}
+			s.sendAck(peer, MessageStoreAck{Key: v.Key, Version: v.Version, Err: ErrPeerBusy.Error()})
+		}()
+	case MessageGetFile:
+		closeStream(msg)
+		go func() {
+			w, err := peer.OpenStream()
+			if err != nil {
+				return
+			}
+			defer w.Close()
+			w.Write([]byte{p2p.IncomingStream})
+			writeHeader(w, s.Codec, fileHeader{Version: v.Version, Busy: true, ID: v.ID})
+		}()
+	default:
+		closeStream(msg)
+	}
+}
+
+func (s *FileServer) handleMessage(ctx context.Context, from string, msg *Message) error {
+	switch v := msg.Payload.(type) {
+	case MessageStoreFile:
+		return s.handleMessageStoreFile(ctx, from, v, msg.stream)
+	case MessageGetFile:
+		return s.handleMessageGetFile(ctx, from, v)
+	case MessageStoreAck:
+		return s.handleMessageStoreAck(from, v)
+	case MessageDeleteFile:
+		return s.handleMessageDeleteFile(from, v)
+	case MessageGoodbye:
+		return s.handleMessageGoodbye(from)
+	case MessageHello:
+		return s.handleMessageHello(from, v)
+	}
+	return nil
+}
+
+// handleMessageHello remembers the ID of the peer and replays the writes handed off for it.
+func (s *FileServer) handleMessageHello(from string, msg MessageHello) error {
+	if len(msg.ID) == 0 {
+		return nil
+	}
+	s.peerLock.Lock()
+	peer, ok := s.peers[from]
+	if ok {
+		s.ids[from] = msg.ID
+	}
+	s.peerLock.Unlock()
+	if !ok {
+		return nil
+	}
+	s.log.Debug("peer said hello", "peer", from, "id", msg.ID)
+	go s.replayHints(peer, msg.ID)
+	return nil
+}
+
+// handleMessageGoodbye closes the connection of a peer that is shutting down. A peer we dialed is
+// redialed and hinted as for any other disconnect, it is likely to come back.
+func (s *FileServer) handleMessageGoodbye(from string) error {
+	s.log.Info("peer shutting down", "peer", from)
+	peer, ok := s.peer(from)
+	if !ok {
+		return nil
+	}
+	return peer.Close()
+}
+
+func (s *FileServer) handleMessageDeleteFile(from string, msg MessageDeleteFile) error {
+	// The key is the hash of the one deleted, anything leading out of the store is turned down.
+	if err := store.ValidateKey(msg.Key); err != nil {
+		return err
+	}
+	s.log.Info("deleting file", "peer", from, "key", msg.Key)
+	return s.store.Delete(msg.Key)
+}
+
+func (s *FileServer) peer(addr string) (p2p.Peer, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	peer, ok := s.peers[addr]
+	return peer, ok
+}
+
+func (s *FileServer) handleMessageGetFile(ctx context.Context, from string, msg MessageGetFile) (err error) {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s does not exist in peer map", from)
+	}
+
+	w, err := peer.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	// The peer waits for an answer from everyone it asked, so tell it when we do not have the file.
+	if !s.hasLocal(msg.Key, msg.Version) {
+		w.Write([]byte{p2p.IncomingStream})
+		if _, err := writeHeader(w, s.Codec, fileHeader{Version: msg.Version, Missing: true, ID: msg.ID}); err != nil {
+			return err
+		}
+		return fmt.Errorf("[%s] need to serve the file (%s) but it does not exist on the disk", s.Transport.Addr(), msg.Key)
+	}
+
+	version, fileSize, r, err := s.store.ReadVersion(msg.Key, msg.Version)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	meta, err := s.store.ReadVersionMeta(msg.Key, version)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	_, span := s.startSpan(ctx, "stream copy", slog.String("version", version))
+	defer endSpan(span, &err)
+	w.Write([]byte{p2p.IncomingStream})
+	if _, err := writeHeader(w, s.Codec, fileHeader{Size: fileSize, Version: version, Meta: meta, ID: msg.ID}); err != nil {
+		return err
+	}
+	tr := s.transfers.start(Transfer{Peer: from, Key: msg.Key, Version: version, Direction: "send", Class: TrafficUser.String(), Size: fileSize})
+	defer tr.done()
+	n, err := io.Copy(tr.writer(s.bandwidth.Writer(w, from, TrafficUser)), r)
+	s.metrics.replicated.With("sent", TrafficUser.String()).Add(float64(n))
+	span.SetAttributes(slog.Int64("bytes", n))
+	if err != nil {
+		return err
+	}
+	s.log.Info("file served", "peer", from, "key", msg.Key, "version", version, "bytes", n, "duration", time.Since(start))
+
+	return nil
+}
+
+func (s *FileServer) handleMessageStoreAck(from string, msg MessageStoreAck) error {
+	s.ackLock.Lock()
+	ch, ok := s.acks[handedOff(from, msg.Version)]
+	if !ok {
+		ch, ok = s.acks[msg.Version]
+	}
+	s.ackLock.Unlock()
+	if !ok {
+		// Nobody is waiting for it any more, like for a Store that timed out.
+		return nil
+	}
+	select {
+	case ch <- peerAck{From: from, MessageStoreAck: msg}:
+	default:
+	}
+	return nil
+}
+
+// handleMessageStoreFile writes the file streamed after the message, stream is the one that came
+// along with it from a multiplexed peer.
+func (s *FileServer) handleMessageStoreFile(ctx context.Context, from string, msg MessageStoreFile, stream io.ReadCloser) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) could not be found", from)
+	}
+
+	s.clock.Update(msg.Meta.Timestamp)
+	s.detectConflict(msg)
+
+	st, err := nextStream(peer, stream)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	// Here after the broadcasting the message is read, and stored in the file.
+	// The io.Limiter is used with the stream of the peer asking it to read msg.size bytes.
+	start := time.Now()
+	hash := sha256.New()
+	tr := s.transfers.start(Transfer{Peer: from, Key: msg.Key, Version: msg.Version, Direction: "receive", Class: msg.class().String(), Size: msg.Size})
+	defer tr.done()
+	lr := io.LimitReader(tr.reader(s.bandwidth.Reader(st, from, msg.class())), msg.Size)
+	_, write := s.startSpan(ctx, "disk write", slog.String("version", msg.Version), slog.Bool("repair", msg.Repair))
+	n, err := s.store.WriteVersion(msg.Key, msg.Version, &msg.Meta, io.TeeReader(lr, hash))
+	write.SetAttributes(slog.Int64("bytes", n))
+	endSpan(write, &err)
+	s.metrics.replicated.With("received", msg.class().String()).Add(float64(n))
+
+	ack := MessageStoreAck{
+		Key:     msg.Key,
+		Version: msg.Version,
+		Bytes:   n,
+		Digest:  hex.EncodeToString(hash.Sum(nil)),
+	}
+	if err != nil {
+		ack.Err = err.Error()
+		// Whatever is left of the stream has to be read, otherwise it ends up in the next message.
+		io.Copy(io.Discard, lr)
+	} else {
+		s.log.Info("file stored", "peer", from, "key", msg.Key, "version", msg.Version, "bytes", n, "repair", msg.Repair, "duration", time.Since(start))
+	}
+
+	st.Close()
+
+	// The ack is sent in the background, as the peer might be busy streaming to us and can only
+	// read it once our loop moves on.
+	go s.sendAck(peer, ack)
+	return err
+}
+
+func (s *FileServer) sendAck(peer p2p.Peer, ack MessageStoreAck) {
+	b, err := encodeMessage(s.Codec, &Message{Payload: ack})
+	if err != nil {
+		s.log.Error("could not encode ack", "err", err)
+		return
+	}
+
+	if err := s.send(peer, b); err != nil {
+		s.log.Warn("could not send ack", "peer", peer.RemoteAddr().String(), "key", ack.Key, "version", ack.Version, "err", err)
+	}
+}
+
+// detectConflict logs when an incoming write was made without knowing of the latest version
+// stored locally. The version IDs make the last writer win on every replica, unless siblings are kept.
+func (s *FileServer) detectConflict(msg MessageStoreFile) {
+	latest, err := s.store.LatestVersion(msg.Key)
+	if err != nil || latest.Meta == nil {
+		return
+	}
+	if latest.Meta.Clock.Compare(msg.Meta.Clock) != store.Concurrent {
+		return
+	}
+	winner := latest.ID
+	if msg.Version > winner {
+		winner = msg.Version
+	}
+	if s.KeepSiblings {
+		s.log.Info("concurrent writes, keeping siblings", "key", msg.Key, "version", latest.ID, "sibling", msg.Version)
+		return
+	}
+	s.log.Info("concurrent writes, last writer wins", "key", msg.Key, "version", winner)
+}
+
+func (s *FileServer) Start() error {
+
+	s.closeLock.Lock()
+	if s.closing {
+		s.closeLock.Unlock()
+		return ErrServerClosed
+	}
+	s.started = true
+	s.closeLock.Unlock()
+
+	if err := s.Transport.ListenAndAccept(); err != nil {
+		close(s.loopDone)
+		return err
+	}
+	s.bootstrapNetwork()
+
+	s.loop()
+	return s.closeTransport()
+}
+
+func init() {
+	gob.Register(MessageStoreFile{})
+	gob.Register(MessageGetFile{})
+	gob.Register(MessageStoreAck{})
+	gob.Register(MessageDeleteFile{})
+	gob.Register(MessageGoodbye{})
+	gob.Register(MessageHello{})
+	gob.Register(fileHeader{})
+}
@@ -0,0 +1,329 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ashirwad-maker/quantumsync/crypto"
+	"github.com/ashirwad-maker/quantumsync/p2p"
+	"github.com/ashirwad-maker/quantumsync/store"
+)
+
+func newTestServer(t *testing.T) *FileServer {
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		HandshakeFunc: p2p.NOPhandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	s := NewFileServer(FileServerOpts{
+		EncKey:           crypto.NewEncryptionKey(),
+		StorageRoot:      t.TempDir(),
+		PathTansformFunc: store.CASPathTransformFunc,
+		Transport:        tr,
+	})
+	tr.OnPeer = s.OnPeer
+	tr.OnPeerDisconnect = s.OnPeerDisconnect
+	return s
+}
+
+func TestFileServerShutdown(t *testing.T) {
+	s := newTestServer(t)
+	errch := make(chan error, 1)
+	go func() {
+		errch <- s.Start()
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := s.Store("picture", bytes.NewReader([]byte("some jpeg bytes"))); err != nil {
+		t.Fatal(err)
+	}
+	// A write cut short by a crash.
+	abandoned := filepath.Join(s.store.Root, ".abandoned.tmp")
+	if err := os.WriteFile(abandoned, []byte("half of it"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errch:
+		if err != nil {
+			t.Fatalf("Start: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Start did not return after Shutdown")
+	}
+
+	if _, err := os.Stat(abandoned); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want the temporary file removed, have %v", err)
+	}
+	if _, err := s.Store("picture", bytes.NewReader([]byte("more bytes"))); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("want %s have %v", ErrServerClosed, err)
+	}
+	if _, err := s.Get("picture"); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("want %s have %v", ErrServerClosed, err)
+	}
+}
+
+func TestFileServerShutdownWaits(t *testing.T) {
+	s := newTestServer(t)
+
+	// A request in flight holds the shutdown until it is done or the context expires.
+	if err := s.begin(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want %s have %v", context.DeadlineExceeded, err)
+	}
+	s.inflight.Done()
+}
+
+func newMemServer(t *testing.T, network *p2p.MemNetwork, addr string, nodes ...string) *FileServer {
+	return newMemServerWith(t, network, FileServerOpts{}, addr, nodes...)
+}
+
+// newMemServerWith is newMemServer with the options not set by it given.
+func newMemServerWith(t *testing.T, network *p2p.MemNetwork, opts FileServerOpts, addr string, nodes ...string) *FileServer {
+	tr := p2p.NewMemTransport(network, p2p.TCPTransportOpts{
+		ListenAddr:    addr,
+		HandshakeFunc: Handshake(opts.Codec),
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	return startServer(t, tr.TCPTransport, opts, nodes...)
+}
+
+// newQUICServer returns a node listening for QUIC on a free port of localhost, its peers over
+// QUIC agree on multiplexing.
+func newQUICServer(t *testing.T, opts FileServerOpts, nodes ...string) *FileServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	tr := p2p.NewQUICTransport(p2p.QUICTransportOpts{TCPTransportOpts: p2p.TCPTransportOpts{
+		ListenAddr:    addr,
+		HandshakeFunc: Handshake(opts.Codec),
+		Decoder:       p2p.DefaultDecoder{},
+	}})
+	return startServer(t, tr.TCPTransport, opts, nodes...)
+}
+
+// startServer starts a node on the transport with the options not set by it given.
+func startServer(t *testing.T, tr *p2p.TCPTransport, opts FileServerOpts, nodes ...string) *FileServer {
+	opts.EncKey = crypto.NewEncryptionKey()
+	opts.StorageRoot = t.TempDir()
+	opts.PathTansformFunc = store.CASPathTransformFunc
+	opts.Transport = tr
+	opts.BootstrapNodes = nodes
+	opts.AckTimeout = 200 * time.Millisecond
+	s := NewFileServer(opts)
+	tr.OnPeer = s.OnPeer
+	tr.OnPeerDisconnect = s.OnPeerDisconnect
+
+	go s.Start()
+	t.Cleanup(s.Stop)
+	return s
+}
+
+func TestFileServerMemNetwork(t *testing.T) {
+	network := p2p.NewMemNetwork()
+	s1 := newMemServer(t, network, ":3000")
+	time.Sleep(10 * time.Millisecond)
+	s2 := newMemServer(t, network, ":4000", ":3000")
+	time.Sleep(50 * time.Millisecond)
+
+	result, err := s2.StoreWith("picture", bytes.NewReader([]byte("some jpeg bytes")), WriteOpts{Consistency: ConsistencyAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Acks != 2 {
+		t.Errorf("want 2 acks have %d", result.Acks)
+	}
+	if !s1.store.Has(crypto.HashKey("picture")) {
+		t.Error("want the file replicated to the peer")
+	}
+
+	// The writes to a peer on the other side of a partition are never acknowledged.
+	network.Partition(":3000", ":4000")
+	_, err = s2.StoreWith("other picture", bytes.NewReader([]byte("more jpeg bytes")), WriteOpts{Consistency: ConsistencyAll})
+	if !errors.Is(err, ErrNotEnoughReplicas) {
+		t.Errorf("want %s have %v", ErrNotEnoughReplicas, err)
+	}
+}
+
+func TestFileServerStoreResult(t *testing.T) {
+	network := p2p.NewMemNetwork()
+	newMemServer(t, network, ":3000")
+	newMemServer(t, network, ":5000")
+	time.Sleep(10 * time.Millisecond)
+	s2 := newMemServer(t, network, ":4000", ":3000", ":5000")
+	time.Sleep(50 * time.Millisecond)
+
+	result, err := s2.StoreWith("picture", bytes.NewReader([]byte("some jpeg bytes")), WriteOpts{Consistency: ConsistencyAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Key != "picture" || result.Size != 15 || result.Acks != 3 || len(result.Peers) != 2 {
+		t.Fatalf("want the write acked by the 3 replicas have %+v", result)
+	}
+	// The peers report the bytes of the encrypted stream and its digest, checked against the one sent.
+	peers := make(map[string]PeerResult)
+	for _, p := range result.Peers {
+		peers[p.Peer] = p
+	}
+	for _, addr := range []string{":3000", ":5000"} {
+		p, ok := peers[addr]
+		if !ok || p.Err != nil || p.Hinted || p.Bytes != 15+16 || len(p.Digest) != 64 {
+			t.Errorf("want the ack of %s have %+v", addr, p)
+		}
+	}
+
+	// A peer that takes the file but never answers times out, the others still ack.
+	network.Partition(":4000", ":5000")
+	start := time.Now()
+	result, err = s2.StoreWith("other picture", bytes.NewReader([]byte("more jpeg bytes")), WriteOpts{Consistency: ConsistencyQuorum})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < s2.AckTimeout {
+		t.Error("want the store to wait for the ack until the timeout")
+	}
+	peers = make(map[string]PeerResult)
+	for _, p := range result.Peers {
+		peers[p.Peer] = p
+	}
+	if result.Acks != 2 || peers[":3000"].Err != nil || !errors.Is(peers[":5000"].Err, errAckTimeout) {
+		t.Errorf("want the ack of :3000 and a timeout from :5000 have %+v", result)
+	}
+}
+
+func TestCollectAcks(t *testing.T) {
+	s := newTestServer(t)
+	s.AckTimeout = 50 * time.Millisecond
+	sent := map[string]string{
+		":3000": "aaaa",
+		":4000": "bbbb",
+		":5000": "cccc",
+		":6000": "dddd",
+		":7000": "eeee",
+	}
+	acks := make(chan peerAck, 10)
+	acks <- peerAck{From: ":3000", MessageStoreAck: MessageStoreAck{Bytes: 31, Digest: "aaaa"}}
+	acks <- peerAck{From: ":4000", MessageStoreAck: MessageStoreAck{Bytes: 31, Digest: "ffff"}}
+	acks <- peerAck{From: ":5000", MessageStoreAck: MessageStoreAck{Err: "disk full"}}
+	acks <- peerAck{From: ":6000", MessageStoreAck: MessageStoreAck{Err: ErrPeerBusy.Error()}}
+	// An ack from a peer the file was not sent to is ignored.
+	acks <- peerAck{From: ":8000", MessageStoreAck: MessageStoreAck{Digest: "aaaa"}}
+
+	result := &StoreResult{Key: "picture", Acks: 1}
+	s.collectAcks(result, acks, sent)
+
+	if result.Acks != 2 {
+		t.Errorf("want the local write and :3000 acked have %d", result.Acks)
+	}
+	peers := make(map[string]PeerResult)
+	for _, p := range result.Peers {
+		peers[p.Peer] = p
+	}
+	if len(peers) != len(sent) {
+		t.Fatalf("want a result for every peer sent to have %+v", result.Peers)
+	}
+	if p := peers[":3000"]; p.Err != nil || p.Bytes != 31 || p.Digest != "aaaa" {
+		t.Errorf("want :3000 acked have %+v", p)
+	}
+	if p := peers[":4000"]; p.Err == nil || !strings.Contains(p.Err.Error(), "digest mismatch") || p.Digest != "ffff" {
+		t.Errorf("want a digest mismatch from :4000 have %+v", p)
+	}
+	if p := peers[":5000"]; p.Err == nil || p.Err.Error() != "disk full" {
+		t.Errorf("want the error of :5000 have %+v", p)
+	}
+	if p := peers[":6000"]; !errors.Is(p.Err, ErrPeerBusy) {
+		t.Errorf("want :6000 busy have %+v", p)
+	}
+	if p := peers[":7000"]; !errors.Is(p.Err, errAckTimeout) {
+		t.Errorf("want :7000 timed out have %+v", p)
+	}
+}
+
+func TestFileServerDeleteTraversal(t *testing.T) {
+	s := newTestServer(t)
+	s.store.PathTansformFunc = store.DefaultPathTransformFunc
+	if _, err := s.store.Write("picture", bytes.NewReader([]byte("some jpeg bytes"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the CAS transform "../x" is laid out under "..", which is the whole root.
+	for _, key := range []string{"../x", "../" + s.store.ID, "/tmp", `..\x`} {
+		if err := s.handleMessageDeleteFile(":3000", MessageDeleteFile{Key: key}); !errors.Is(err, store.ErrInvalidKey) {
+			t.Errorf("want %s deleting (%s) for a peer have %v", store.ErrInvalidKey, key, err)
+		}
+		if err := s.Delete(key); !errors.Is(err, store.ErrInvalidKey) {
+			t.Errorf("want %s deleting (%s) have %v", store.ErrInvalidKey, key, err)
+		}
+	}
+	if !s.store.Has("picture") {
+		t.Error("want the files of the store left alone")
+	}
+}
+
+func TestFileServerMultiplexing(t *testing.T) {
+	// s1 streams at 16KB a second, a second worth of bytes goes at once.
+	s1 := newQUICServer(t, FileServerOpts{Bandwidth: BandwidthLimits{User: Rates{Upload: 16 * 1024}}})
+	time.Sleep(10 * time.Millisecond)
+	s2 := newQUICServer(t, FileServerOpts{}, s1.Transport.Addr())
+	deadline := time.Now().Add(2 * time.Second)
+	for (len(s1.peerList()) == 0 || len(s2.peerList()) == 0) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	peers := s1.peerList()
+	if len(peers) != 1 || !multiplexed(peers[0]) {
+		t.Fatalf("want a multiplexed peer have %d peers", len(peers))
+	}
+	if _, err := s1.StoreWith("small", strings.NewReader("some jpeg bytes"), WriteOpts{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := make(chan error, 1)
+	go func() {
+		_, err := s1.StoreWith("big", bytes.NewReader(bytes.Repeat([]byte("a"), 40*1024)), WriteOpts{Consistency: ConsistencyAll})
+		stored <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// The file being streamed to s2 for another second holds up neither the request of s1 nor
+	// the answer of s2.
+	start := time.Now()
+	obj, err := s1.GetWith("small", ReadOpts{Consistency: ConsistencyAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj.Close()
+	if took := time.Since(start); took > 500*time.Millisecond {
+		t.Errorf("want the read done while the file is streamed, it took %s", took)
+	}
+
+	select {
+	case err := <-stored:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the store never finished")
+	}
+	if !s2.store.Has(crypto.HashKey("big")) {
+		t.Error("want the file on s2")
+	}
+}
@@ -0,0 +1,29 @@
+package node
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/ashirwad-maker/quantumsync/trace"
+)
+
+// startSpan starts a span of the server, it has the address of the transport as node like the logs.
+func (s *FileServer) startSpan(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, trace.Span) {
+	return s.Tracer.Start(ctx, name, append(attrs, slog.String("node", s.Transport.Addr()))...)
+}
+
+// endSpan ends the span, failed when *err is set. It is meant to be deferred with the named error
+// of the function.
+func endSpan(span trace.Span, err *error) {
+	span.SetError(*err)
+	span.End()
+}
+
+// requestContext returns the context given in the options of a request, the background one when
+// there is none.
+func requestContext(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
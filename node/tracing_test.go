@@ -0,0 +1,89 @@
+package node
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ashirwad-maker/quantumsync/p2p"
+	"github.com/ashirwad-maker/quantumsync/trace"
+)
+
+// waitSpan waits for a span of that name to be recorded on the node.
+func waitSpan(t *testing.T, rec *trace.Recorder, name string, node string) trace.SpanData {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		for _, span := range rec.Named(name) {
+			if span.Attr("node").String() == node {
+				return span
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("no %s span recorded on %s", name, node)
+	return trace.SpanData{}
+}
+
+func TestFileServerTracing(t *testing.T) {
+	network := p2p.NewMemNetwork()
+	rec := trace.NewRecorder()
+	tracer := trace.NewTracer(trace.TracerOpts{Exporter: rec})
+	newMemServerWith(t, network, FileServerOpts{Tracer: tracer}, ":3000")
+	time.Sleep(10 * time.Millisecond)
+	s2 := newMemServerWith(t, network, FileServerOpts{Tracer: tracer}, ":4000", ":3000")
+	time.Sleep(50 * time.Millisecond)
+
+	// The trace of the caller, as the gateway gets it from a traceparent header.
+	client := trace.SpanContext{TraceID: trace.TraceID{7}, SpanID: trace.SpanID{7}, Sampled: true}
+	ctx := trace.ContextWithRemote(context.Background(), client)
+	if _, err := s2.StoreWith("picture", strings.NewReader("some jpeg bytes"), WriteOpts{Consistency: ConsistencyAll, Context: ctx}); err != nil {
+		t.Fatal(err)
+	}
+
+	store := waitSpan(t, rec, "store", ":4000")
+	if store.SpanContext.TraceID != client.TraceID || store.Parent != (trace.Parent{SpanID: client.SpanID, Remote: true}) {
+		t.Errorf("want the store to continue the trace of the caller, have %+v", store)
+	}
+	write := waitSpan(t, rec, "disk write", ":4000")
+	broadcast := waitSpan(t, rec, "broadcast", ":4000")
+	stream := waitSpan(t, rec, "stream copy", ":4000")
+	if write.Parent.SpanID != store.SpanContext.SpanID || broadcast.Parent.SpanID != store.SpanContext.SpanID {
+		t.Error("want the disk write and the broadcast children of the store")
+	}
+	if stream.Parent.SpanID != broadcast.SpanContext.SpanID || stream.Attr("peer").String() != ":3000" {
+		t.Errorf("want the stream copy to the peer a child of the broadcast, have %+v", stream)
+	}
+	if broadcast.Attr("acks").Int64() != 2 {
+		t.Errorf("want 2 acks on the broadcast have %v", broadcast.Attr("acks"))
+	}
+
+	// The peer continues the trace from the span the file was sent from.
+	handle := waitSpan(t, rec, "handle StoreFile", ":3000")
+	if handle.SpanContext.TraceID != client.TraceID || handle.Parent != (trace.Parent{SpanID: stream.SpanContext.SpanID, Remote: true}) {
+		t.Errorf("want the handling on the peer a remote child of the stream copy, have %+v", handle)
+	}
+	if peerWrite := waitSpan(t, rec, "disk write", ":3000"); peerWrite.Parent.SpanID != handle.SpanContext.SpanID {
+		t.Error("want the disk write on the peer a child of the handling")
+	}
+
+	// A read from the peers decrypts the file they stream back.
+	rec.Reset()
+	obj, err := s2.GetWith("picture", ReadOpts{Consistency: ConsistencyAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, obj)
+	obj.Close()
+	get := waitSpan(t, rec, "get", ":4000")
+	decrypt := waitSpan(t, rec, "decrypt", ":4000")
+	if decrypt.SpanContext.TraceID != get.SpanContext.TraceID || decrypt.Attr("bytes").Int64() == 0 {
+		t.Errorf("want the decrypt of the file received in the trace of the get, have %+v", decrypt)
+	}
+	serve := waitSpan(t, rec, "handle GetFile", ":3000")
+	if serve.SpanContext.TraceID != get.SpanContext.TraceID || !serve.Parent.Remote {
+		t.Errorf("want the peer serving the file in the trace of the get, have %+v", serve)
+	}
+}
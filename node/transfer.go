@@ -0,0 +1,100 @@
+package node
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Transfer is a file being streamed to or from a peer, as listed by Status.
+type Transfer struct {
+	ID   uint64 `json:"id"`
+	Peer string `json:"peer"`
+	// Key is the hash of the key, as the peers know it.
+	Key     string `json:"key"`
+	Version string `json:"version,omitempty"`
+	// Direction is "send" or "receive", Class the traffic class it is throttled as.
+	Direction string `json:"direction"`
+	Class     string `json:"class"`
+	// Size is the number of bytes of the stream, Bytes the number moved so far.
+	Size    int64     `json:"size"`
+	Bytes   int64     `json:"bytes"`
+	Started time.Time `json:"started"`
+}
+
+// transfers are the streams in progress, the bytes of each are counted as they go through.
+type transfers struct {
+	mu     sync.Mutex
+	next   uint64
+	active map[uint64]*transfer
+}
+
+type transfer struct {
+	Transfer
+	list  *transfers
+	bytes atomic.Int64
+}
+
+func newTransfers() *transfers {
+	return &transfers{active: make(map[uint64]*transfer)}
+}
+
+// start lists the transfer until done is called.
+func (t *transfers) start(info Transfer) *transfer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.next++
+	info.ID = t.next
+	info.Started = time.Now()
+	tr := &transfer{Transfer: info, list: t}
+	t.active[tr.ID] = tr
+	return tr
+}
+
+// list returns the transfers in progress, oldest first.
+func (t *transfers) list() []Transfer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]Transfer, 0, len(t.active))
+	for _, tr := range t.active {
+		info := tr.Transfer
+		info.Bytes = tr.bytes.Load()
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (tr *transfer) done() {
+	tr.list.mu.Lock()
+	defer tr.list.mu.Unlock()
+	delete(tr.list.active, tr.ID)
+}
+
+func (tr *transfer) Write(b []byte) (int, error) {
+	tr.bytes.Add(int64(len(b)))
+	return len(b), nil
+}
+
+// reader counts the bytes read from r as the progress of the transfer.
+func (tr *transfer) reader(r io.Reader) io.Reader {
+	return io.TeeReader(r, tr)
+}
+
+// writer counts the bytes written to w as the progress of the transfer.
+func (tr *transfer) writer(w io.Writer) io.Writer {
+	return &countingWriter{w: w, tr: tr}
+}
+
+type countingWriter struct {
+	w  io.Writer
+	tr *transfer
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.tr.bytes.Add(int64(n))
+	return n, err
+}
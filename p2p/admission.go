@@ -0,0 +1,122 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+)
+
+var (
+	// ErrConnLimit is returned when a connection would go over the limits of the transport.
+	ErrConnLimit = errors.New("connection limit reached")
+	// ErrNotAllowed is returned for a connection from an address the transport does not accept.
+	ErrNotAllowed = errors.New("address not allowed")
+	// ErrRejected is returned when the peer turned our connection down.
+	ErrRejected = errors.New("connection rejected")
+)
+
+// connInfo is what the limits of the transport count a connection against.
+type connInfo struct {
+	outbound bool
+	ip       netip.Addr
+}
+
+// remoteIP is the IP address the connection comes from, it is not valid on the networks without
+// one, which are left out of the per-IP limit and the allow and deny lists.
+func remoteIP(conn net.Conn) netip.Addr {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ip.Unmap()
+}
+
+// ParsePrefixes parses the CIDRs of an allow or deny list, a bare IP address is a prefix of itself.
+func ParsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			ip, ipErr := netip.ParseAddr(cidr)
+			if ipErr != nil {
+				return nil, fmt.Errorf("invalid CIDR (%s)", cidr)
+			}
+			prefix = netip.PrefixFrom(ip, ip.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func containsIP(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// admit checks the connection against the limits of the transport, it is called with t.mu held.
+func (t *TCPTransport) admit(info connInfo) error {
+	if info.outbound {
+		if t.MaxOutbound > 0 && t.outbound >= t.MaxOutbound {
+			return fmt.Errorf("%w: %d outbound peers", ErrConnLimit, t.outbound)
+		}
+		return nil
+	}
+	if info.ip.IsValid() {
+		if containsIP(t.Deny, info.ip) || (len(t.Allow) > 0 && !containsIP(t.Allow, info.ip)) {
+			return fmt.Errorf("%w (%s)", ErrNotAllowed, info.ip)
+		}
+		if t.MaxConnsPerIP > 0 && t.perIP[info.ip] >= t.MaxConnsPerIP {
+			return fmt.Errorf("%w: %d connections from (%s)", ErrConnLimit, t.perIP[info.ip], info.ip)
+		}
+	}
+	if t.MaxInbound > 0 && t.inbound >= t.MaxInbound {
+		return fmt.Errorf("%w: %d inbound peers", ErrConnLimit, t.inbound)
+	}
+	return nil
+}
+
+// writeReject tells the peer why its connection is being closed, it does not wait long for a
+// peer that does not read.
+func writeReject(conn net.Conn, reason error) {
+	msg := []byte(reason.Error())
+	if len(msg) > 1024 {
+		msg = msg[:1024]
+	}
+	frame := []byte{IncomingReject}
+	frame = binary.LittleEndian.AppendUint16(frame, uint16(len(msg)))
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write(append(frame, msg...)); err != nil {
+		return
+	}
+	// Closing with what the peer sent unread, like its hello, resets a TCP connection and the
+	// frame can be lost, so it is read until the peer closes, for a little while.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	io.Copy(io.Discard, conn)
+}
+
+// readReject reads the reason of a reject frame, its first byte already read.
+func readReject(r io.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	reason := make([]byte, size)
+	_, err := io.ReadFull(r, reason)
+	return reason, err
+}
+
+func rejectedError(conn net.Conn, reason []byte) error {
+	return fmt.Errorf("%w by (%s): %s", ErrRejected, conn.RemoteAddr(), reason)
+}
@@ -0,0 +1,220 @@
+package p2p
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// dialAndHandshake dials the transport over TCP and runs the version handshake, it returns the
+// error of the handshake.
+func dialAndHandshake(t *testing.T, addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	handshake := VersionHandshake(VersionHandshakeOpts{MinVersion: 1, MaxVersion: 1, Timeout: time.Second})
+	return handshake(NewTCPPeer(conn, true))
+}
+
+func newAdmissionTransport(t *testing.T, opts TCPTransportOpts) (*TCPTransport, chan Peer) {
+	peers := make(chan Peer, 10)
+	opts.ListenAddr = "127.0.0.1:0"
+	opts.HandshakeFunc = VersionHandshake(VersionHandshakeOpts{MinVersion: 1, MaxVersion: 1})
+	opts.Decoder = DefaultDecoder{}
+	opts.OnPeer = func(p Peer) error {
+		peers <- p
+		return nil
+	}
+	tr := NewTCPTransport(opts)
+	assert.Nil(t, tr.ListenAndAccept())
+	t.Cleanup(func() { tr.Close() })
+	return tr, peers
+}
+
+func listenAddr(tr *TCPTransport) string {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.listener.Addr().String()
+}
+
+func TestAdmissionPerIP(t *testing.T) {
+	tr, peers := newAdmissionTransport(t, TCPTransportOpts{MaxInbound: 2, MaxConnsPerIP: 1})
+	addr := listenAddr(tr)
+
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	assert.Nil(t, VersionHandshake(VersionHandshakeOpts{MinVersion: 1, MaxVersion: 1})(NewTCPPeer(conn, true)))
+	<-peers
+
+	// A second connection from the same address is turned down with the reason.
+	err = dialAndHandshake(t, addr)
+	assert.True(t, errors.Is(err, ErrRejected), err)
+	assert.Contains(t, err.Error(), "connection limit reached: 1 connections from (127.0.0.1)")
+
+	// Once the first one is gone there is room again.
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+		return tr.inbound == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Nil(t, dialAndHandshake(t, addr))
+}
+
+func TestAdmissionInbound(t *testing.T) {
+	tr, peers := newAdmissionTransport(t, TCPTransportOpts{MaxInbound: 1})
+	addr := listenAddr(tr)
+
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	assert.Nil(t, VersionHandshake(VersionHandshakeOpts{MinVersion: 1, MaxVersion: 1})(NewTCPPeer(conn, true)))
+	<-peers
+
+	err = dialAndHandshake(t, addr)
+	assert.True(t, errors.Is(err, ErrRejected), err)
+	assert.Contains(t, err.Error(), "1 inbound peers")
+
+	// A peer without the handshake gets the reject frame as its first message.
+	conn, err = net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	var rpc RPC
+	assert.Nil(t, DefaultDecoder{}.Decode(conn, &rpc))
+	assert.Equal(t, byte(IncomingReject), rpc.Control)
+	assert.Contains(t, string(rpc.Payload), "1 inbound peers")
+}
+
+func TestAdmissionAllowDeny(t *testing.T) {
+	deny, err := ParsePrefixes([]string{"127.0.0.1"})
+	assert.Nil(t, err)
+	tr, _ := newAdmissionTransport(t, TCPTransportOpts{Deny: deny})
+	err = dialAndHandshake(t, listenAddr(tr))
+	assert.True(t, errors.Is(err, ErrRejected), err)
+	assert.Contains(t, err.Error(), "address not allowed (127.0.0.1)")
+
+	allow, err := ParsePrefixes([]string{"10.0.0.0/8", "::1/128"})
+	assert.Nil(t, err)
+	tr, _ = newAdmissionTransport(t, TCPTransportOpts{Allow: allow})
+	err = dialAndHandshake(t, listenAddr(tr))
+	assert.True(t, errors.Is(err, ErrRejected), err)
+
+	allow = append(allow, netip.MustParsePrefix("127.0.0.0/8"))
+	tr, _ = newAdmissionTransport(t, TCPTransportOpts{Allow: allow})
+	assert.Nil(t, dialAndHandshake(t, listenAddr(tr)))
+
+	_, err = ParsePrefixes([]string{"10.0.0.0/33"})
+	assert.NotNil(t, err)
+}
+
+func TestAdmissionOutbound(t *testing.T) {
+	network := NewMemNetwork()
+	opts := TCPTransportOpts{
+		ListenAddr:    ":3000",
+		HandshakeFunc: NOPhandshakeFunc,
+		Decoder:       DefaultDecoder{},
+	}
+	a := NewMemTransport(network, opts)
+	assert.Nil(t, a.ListenAndAccept())
+	defer a.Close()
+	opts.ListenAddr = ":3001"
+	c := NewMemTransport(network, opts)
+	assert.Nil(t, c.ListenAndAccept())
+	defer c.Close()
+
+	opts.ListenAddr = ":4000"
+	opts.MaxOutbound = 1
+	peers := make(chan Peer, 1)
+	opts.OnPeer = func(p Peer) error {
+		peers <- p
+		return nil
+	}
+	b := NewMemTransport(network, opts)
+	assert.Nil(t, b.ListenAndAccept())
+	defer b.Close()
+
+	assert.Nil(t, b.Dial(":3000"))
+	<-peers
+	assert.True(t, errors.Is(b.Dial(":3001"), ErrConnLimit))
+}
+
+func TestAdmissionOutboundConcurrent(t *testing.T) {
+	tr, _ := newAdmissionTransport(t, TCPTransportOpts{})
+	addr := listenAddr(tr)
+
+	// The first dial is held up until the second one is done.
+	release := make(chan struct{})
+	fail := true
+	b := NewTCPTransport(TCPTransportOpts{
+		HandshakeFunc: NOPhandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		MaxOutbound:   1,
+		Dial: func(addr string) (net.Conn, error) {
+			<-release
+			if fail {
+				return nil, errors.New("connection refused")
+			}
+			return net.Dial("tcp", addr)
+		},
+	})
+	defer b.Close()
+
+	dialed := make(chan error, 1)
+	go func() { dialed <- b.Dial(addr) }()
+	time.Sleep(20 * time.Millisecond)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+	assert.True(t, errors.Is(b.Dial(addr), ErrConnLimit))
+
+	// A failed dial gives its slot back.
+	assert.NotNil(t, <-dialed)
+	fail = false
+	assert.Nil(t, b.Dial(addr))
+}
+
+// failingListener fails every Accept until it is closed.
+type failingListener struct {
+	net.Listener
+	accepts chan struct{}
+	closech chan struct{}
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	select {
+	case l.accepts <- struct{}{}:
+	default:
+	}
+	select {
+	case <-l.closech:
+		return nil, net.ErrClosed
+	default:
+	}
+	return nil, errors.New("too many open files")
+}
+
+func (l *failingListener) Close() error {
+	close(l.closech)
+	return nil
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	l := &failingListener{accepts: make(chan struct{}, 100), closech: make(chan struct{})}
+	tr := NewTCPTransport(TCPTransportOpts{
+		ListenAddr: "failing",
+		Listen: func(string) (net.Listener, error) {
+			return l, nil
+		},
+	})
+	assert.Nil(t, tr.ListenAndAccept())
+	time.Sleep(200 * time.Millisecond)
+	tr.Close()
+	// 5, 10, 20, 40, 80ms and so on, rather than thousands of tries.
+	assert.Less(t, len(l.accepts), 10)
+}
@@ -35,7 +35,21 @@ func (dec DefaultDecoder) Decode(r io.Reader, rpc *RPC) error {
 		return nil
 	}
 
-	buf := make([]byte, 2048)
+	if peekBuf[0] == IncomingPing || peekBuf[0] == IncomingPong {
+		rpc.Control = peekBuf[0]
+		rpc.Payload = make([]byte, 8)
+		_, err := io.ReadFull(r, rpc.Payload)
+		return err
+	}
+
+	if peekBuf[0] == IncomingReject {
+		rpc.Control = IncomingReject
+		var err error
+		rpc.Payload, err = readReject(r)
+		return err
+	}
+
+	buf := make([]byte, MaxMessageSize)
 	n, err := r.Read(buf) // blocking call mmove forward after reading from io reader.
 	if err != nil {
 		return err
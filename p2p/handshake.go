@@ -1,7 +1,166 @@
 package p2p
 
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
 // Hanshake func is responsible for accepting the users ...?
 
 type HandshakeFunc func(Peer) error
 
 func NOPhandshakeFunc(Peer) error { return nil }
+
+// Features are the optional parts of the protocol a node supports.
+type Features uint32
+
+const (
+	FeatureCompression Features = 1 << iota
+	FeatureAEAD
+	FeatureChunking
+	FeatureMultiplexing
+	FeatureBinaryCodec
+	FeatureHeartbeat
+)
+
+var featureNames = []string{"compression", "aead", "chunking", "multiplexing", "binary-codec", "heartbeat"}
+
+// Has reports whether all the features of g are in f.
+func (f Features) Has(g Features) bool {
+	return f&g == g
+}
+
+func (f Features) String() string {
+	var names []string
+	for i, name := range featureNames {
+		if f&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if rest := f &^ (1<<len(featureNames) - 1); rest != 0 {
+		names = append(names, fmt.Sprintf("0x%x", uint32(rest)))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// Protocol is what the two ends of a connection agreed on in the handshake, it is the zero value
+// when no version was negotiated.
+type Protocol struct {
+	Version uint16
+	// Features are the ones supported by both ends.
+	Features Features
+}
+
+// ErrIncompatible is returned by the version handshake when the peer can not be talked to.
+var ErrIncompatible = errors.New("incompatible protocol")
+
+// VersionHandshakeOpts are the versions and features a node speaks.
+type VersionHandshakeOpts struct {
+	MinVersion uint16
+	MaxVersion uint16
+	Features   Features
+	// Required are the features the peer has to support, they are also supported by us.
+	Required Features
+	// Timeout bounds the exchange, it defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+// handshakeMagic starts the hello, the peers without a handshake take it for a broken message.
+var handshakeMagic = [4]byte{'Q', 'S', 'H', 'S'}
+
+// hello is sent by both ends as soon as they are connected, they then pick the same protocol
+// from the two hellos, so no further round trip is needed.
+type hello struct {
+	Magic      [4]byte
+	MinVersion uint16
+	MaxVersion uint16
+	Features   Features
+	Required   Features
+}
+
+// VersionHandshake returns a HandshakeFunc agreeing with the peer on the highest version both
+// speak and the features both support. The connection is dropped with ErrIncompatible when there
+// is no such version or one end lacks a feature the other requires.
+func VersionHandshake(opts VersionHandshakeOpts) HandshakeFunc {
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	opts.Features |= opts.Required
+	local := hello{
+		Magic:      handshakeMagic,
+		MinVersion: opts.MinVersion,
+		MaxVersion: opts.MaxVersion,
+		Features:   opts.Features,
+		Required:   opts.Required,
+	}
+	return func(peer Peer) error {
+		peer.SetDeadline(time.Now().Add(opts.Timeout))
+		defer peer.SetDeadline(time.Time{})
+
+		// Multiplexing is only offered over the connections that can do it.
+		local := local
+		if !canMultiplex(peer) {
+			local.Features &^= FeatureMultiplexing
+		}
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.LittleEndian, local)
+		if _, err := peer.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		// The peer might have turned the connection down instead.
+		var remote hello
+		first := make([]byte, 1)
+		_, err := io.ReadFull(peer, first)
+		if err == nil && first[0] == IncomingReject {
+			reason, err := readReject(peer)
+			if err != nil {
+				return err
+			}
+			return rejectedError(peer, reason)
+		}
+		if err == nil {
+			err = binary.Read(io.MultiReader(bytes.NewReader(first), peer), binary.LittleEndian, &remote)
+		}
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return fmt.Errorf("%w: no handshake from (%s), it might run a version without one: %s", ErrIncompatible, peer.RemoteAddr(), err)
+			}
+			return err
+		}
+		proto, err := negotiate(local, remote)
+		if err != nil {
+			return fmt.Errorf("handshake with (%s): %w", peer.RemoteAddr(), err)
+		}
+		if p, ok := peer.(interface{ setProtocol(Protocol) }); ok {
+			p.setProtocol(proto)
+		}
+		return nil
+	}
+}
+
+func negotiate(local, remote hello) (Protocol, error) {
+	if remote.Magic != handshakeMagic {
+		return Protocol{}, fmt.Errorf("%w: the peer did not start with a handshake", ErrIncompatible)
+	}
+	version := min(local.MaxVersion, remote.MaxVersion)
+	if version < max(local.MinVersion, remote.MinVersion) || version == 0 {
+		return Protocol{}, fmt.Errorf("%w: we speak versions %d to %d, the peer %d to %d",
+			ErrIncompatible, local.MinVersion, local.MaxVersion, remote.MinVersion, remote.MaxVersion)
+	}
+	if missing := local.Required &^ remote.Features; missing != 0 {
+		return Protocol{}, fmt.Errorf("%w: the peer does not support %s", ErrIncompatible, missing)
+	}
+	if missing := remote.Required &^ local.Features; missing != 0 {
+		return Protocol{}, fmt.Errorf("%w: the peer requires %s", ErrIncompatible, missing)
+	}
+	return Protocol{Version: version, Features: local.Features & remote.Features}, nil
+}
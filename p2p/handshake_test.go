@@ -0,0 +1,98 @@
+package p2p
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// handshakePair runs the handshakes of both ends of a connection and returns the two peers.
+func handshakePair(t *testing.T, a, b HandshakeFunc) (*TCPPeer, *TCPPeer, error, error) {
+	dialer, accepted := memConnPair(t, NewMemNetwork())
+	t.Cleanup(func() {
+		dialer.Close()
+		accepted.Close()
+	})
+	pa, pb := NewTCPPeer(dialer, true), NewTCPPeer(accepted, false)
+	errch := make(chan error, 1)
+	go func() {
+		errch <- b(pb)
+	}()
+	errA := a(pa)
+	return pa, pb, errA, <-errch
+}
+
+func TestVersionHandshake(t *testing.T) {
+	v1 := VersionHandshake(VersionHandshakeOpts{MinVersion: 1, MaxVersion: 1})
+	v12 := VersionHandshake(VersionHandshakeOpts{MinVersion: 1, MaxVersion: 2, Features: FeatureCompression | FeatureChunking})
+	v23 := VersionHandshake(VersionHandshakeOpts{MinVersion: 2, MaxVersion: 3, Features: FeatureCompression})
+
+	// The highest version both speak, with the features both support.
+	pa, pb, errA, errB := handshakePair(t, v12, v23)
+	assert.Nil(t, errA)
+	assert.Nil(t, errB)
+	assert.Equal(t, Protocol{Version: 2, Features: FeatureCompression}, pa.Protocol())
+	assert.Equal(t, pa.Protocol(), pb.Protocol())
+
+	// Both ends drop the connection when there is none.
+	_, _, errA, errB = handshakePair(t, v1, v23)
+	assert.True(t, errors.Is(errA, ErrIncompatible))
+	assert.True(t, errors.Is(errB, ErrIncompatible))
+	assert.Contains(t, errA.Error(), "we speak versions 1 to 1, the peer 2 to 3")
+}
+
+func TestVersionHandshakeRequired(t *testing.T) {
+	plain := VersionHandshake(VersionHandshakeOpts{MinVersion: 1, MaxVersion: 1})
+	aead := VersionHandshake(VersionHandshakeOpts{MinVersion: 1, MaxVersion: 1, Required: FeatureAEAD})
+
+	_, _, errA, errB := handshakePair(t, plain, aead)
+	assert.True(t, errors.Is(errA, ErrIncompatible))
+	assert.Contains(t, errA.Error(), "the peer requires aead")
+	assert.Contains(t, errB.Error(), "the peer does not support aead")
+
+	pa, _, errA, errB := handshakePair(t, aead, aead)
+	assert.Nil(t, errA)
+	assert.Nil(t, errB)
+	assert.True(t, pa.Protocol().Features.Has(FeatureAEAD))
+}
+
+func TestVersionHandshakeOldPeer(t *testing.T) {
+	v1 := VersionHandshake(VersionHandshakeOpts{MinVersion: 1, MaxVersion: 1, Timeout: 50 * time.Millisecond})
+
+	// A node without the handshake never answers.
+	start := time.Now()
+	_, _, errA, errB := handshakePair(t, v1, NOPhandshakeFunc)
+	assert.Nil(t, errB)
+	assert.True(t, errors.Is(errA, ErrIncompatible))
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestVersionHandshakeMultiplexing(t *testing.T) {
+	mux := VersionHandshake(VersionHandshakeOpts{MinVersion: 1, MaxVersion: 1, Features: FeatureMultiplexing | FeatureHeartbeat})
+
+	// A connection that can not multiplex does not offer it.
+	pa, pb, errA, errB := handshakePair(t, mux, mux)
+	assert.Nil(t, errA)
+	assert.Nil(t, errB)
+	assert.Equal(t, FeatureHeartbeat, pa.Protocol().Features)
+	assert.Equal(t, pa.Protocol(), pb.Protocol())
+
+	dialer, accepted := quicConnPair(t)
+	pa, pb = NewTCPPeer(dialer, true), NewTCPPeer(accepted, false)
+	errch := make(chan error, 1)
+	go func() {
+		errch <- mux(pb)
+	}()
+	assert.Nil(t, mux(pa))
+	assert.Nil(t, <-errch)
+	assert.Equal(t, FeatureMultiplexing|FeatureHeartbeat, pa.Protocol().Features)
+	assert.Equal(t, pa.Protocol(), pb.Protocol())
+}
+
+func TestFeaturesString(t *testing.T) {
+	assert.Equal(t, "none", Features(0).String())
+	assert.Equal(t, "compression,multiplexing", (FeatureCompression | FeatureMultiplexing).String())
+	assert.Equal(t, "aead,0x100", (FeatureAEAD | 1<<8).String())
+}
@@ -0,0 +1,391 @@
+package p2p
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// MemTransport is a TCPTransport running over a MemNetwork instead of real sockets, the
+// transports of a test share a network and dial each other by their ListenAddr.
+type MemTransport struct {
+	*TCPTransport
+}
+
+// NewMemTransport returns a transport on the network, the Listen and Dial of the options are
+// replaced by the ones of the network.
+func NewMemTransport(network *MemNetwork, opts TCPTransportOpts) *MemTransport {
+	opts.Listen = network.Listen
+	opts.Dial = func(addr string) (net.Conn, error) {
+		return network.Dial(opts.ListenAddr, addr)
+	}
+	return &MemTransport{TCPTransport: NewTCPTransport(opts)}
+}
+
+// MemNetwork is an in-process network, the addresses are plain names registered by Listen.
+// Unlike net.Pipe the connections are buffered like a TCP socket, so a write never waits for
+// the other end to read, and a read returns the data of at most one write.
+//
+// Latency, lost writes and partitions can be injected, the writes lost are picked by a random
+// source seeded with 1 so a test sees the same losses on every run.
+type MemNetwork struct {
+	mu         sync.Mutex
+	listeners  map[string]*memListener
+	latency    time.Duration
+	dropRate   float64
+	rand       *rand.Rand
+	partitions map[[2]string]struct{}
+	conns      int
+}
+
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{
+		listeners:  make(map[string]*memListener),
+		rand:       rand.New(rand.NewSource(1)),
+		partitions: make(map[[2]string]struct{}),
+	}
+}
+
+// SetLatency delays the delivery of every write, and every dial, by d.
+func (n *MemNetwork) SetLatency(d time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.latency = d
+}
+
+// SetDropRate makes the given fraction of the writes vanish, the writer is not told.
+func (n *MemNetwork) SetDropRate(rate float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.dropRate = rate
+}
+
+// Seed reseeds the random source picking the writes lost.
+func (n *MemNetwork) Seed(seed int64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.rand = rand.New(rand.NewSource(seed))
+}
+
+// Partition cuts a from b, dialing fails and the writes on the connections between them are
+// lost in both directions until Heal is called.
+func (n *MemNetwork) Partition(a, b string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.partitions[partitionKey(a, b)] = struct{}{}
+}
+
+func (n *MemNetwork) Heal(a, b string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.partitions, partitionKey(a, b))
+}
+
+// HealAll removes every partition.
+func (n *MemNetwork) HealAll() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.partitions = make(map[[2]string]struct{})
+}
+
+func partitionKey(a, b string) [2]string {
+	if b < a {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+func (n *MemNetwork) partitioned(a, b string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, ok := n.partitions[partitionKey(a, b)]
+	return ok
+}
+
+// lost reports whether a write from a to b does not make it, and if it does when it arrives.
+func (n *MemNetwork) lost(a, b string) (bool, time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.partitions[partitionKey(a, b)]; ok {
+		return true, time.Time{}
+	}
+	if n.dropRate > 0 && n.rand.Float64() < n.dropRate {
+		return true, time.Time{}
+	}
+	return false, time.Now().Add(n.latency)
+}
+
+// Listen registers the address on the network.
+func (n *MemNetwork) Listen(addr string) (net.Listener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.listeners[addr]; ok {
+		return nil, fmt.Errorf("mem listen %s: address already in use", addr)
+	}
+	l := &memListener{
+		network: n,
+		addr:    memAddr(addr),
+		conns:   make(chan net.Conn),
+		closech: make(chan struct{}),
+	}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+// Dial connects from, the address of the dialer, to addr. The dialer end of the connection
+// gets an address of its own, as a TCP connection gets an ephemeral port.
+func (n *MemNetwork) Dial(from string, addr string) (net.Conn, error) {
+	n.mu.Lock()
+	l, ok := n.listeners[addr]
+	latency := n.latency
+	n.conns++
+	local := memAddr(fmt.Sprintf("%s#%d", from, n.conns))
+	n.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("mem dial %s: connection refused", addr)
+	}
+	if n.partitioned(from, addr) {
+		return nil, fmt.Errorf("mem dial %s: network is unreachable", addr)
+	}
+	time.Sleep(latency)
+
+	toListener, toDialer := newMemPipe(), newMemPipe()
+	dialerConn := &memConn{
+		network:    n,
+		local:      local,
+		remote:     memAddr(addr),
+		localNode:  from,
+		remoteNode: addr,
+		r:          toDialer,
+		w:          toListener,
+	}
+	listenerConn := &memConn{
+		network:    n,
+		local:      memAddr(addr),
+		remote:     local,
+		localNode:  addr,
+		remoteNode: from,
+		r:          toListener,
+		w:          toDialer,
+	}
+
+	select {
+	case l.conns <- listenerConn:
+		return dialerConn, nil
+	case <-l.closech:
+		return nil, fmt.Errorf("mem dial %s: connection refused", addr)
+	}
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+type memListener struct {
+	network   *MemNetwork
+	addr      memAddr
+	conns     chan net.Conn
+	closech   chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closech:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closech)
+		l.network.mu.Lock()
+		delete(l.network.listeners, string(l.addr))
+		l.network.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+// memConn is one end of a connection, it reads from r and writes to w, the pipes are swapped
+// on the other end.
+type memConn struct {
+	network    *MemNetwork
+	local      memAddr
+	remote     memAddr
+	localNode  string
+	remoteNode string
+	r          *memPipe
+	w          *memPipe
+	closeOnce  sync.Once
+}
+
+func (c *memConn) Read(b []byte) (int, error) {
+	return c.r.read(b)
+}
+
+func (c *memConn) Write(b []byte) (int, error) {
+	lost, at := c.network.lost(c.localNode, c.remoteNode)
+	if lost {
+		return len(b), c.w.writable()
+	}
+	if err := c.w.push(append([]byte(nil), b...), at); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *memConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.r.closeRead()
+		c.w.closeWrite()
+	})
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.r.setDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline does nothing, the writes never block.
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// memPipe carries the data of one direction of a connection, every write is kept as a chunk
+// that becomes readable once its delivery time is reached.
+type memPipe struct {
+	// readMu makes concurrent reads take turns like they do on a socket, the read loop of the
+	// transport and the consumer of a stream both read from the connection.
+	readMu     sync.Mutex
+	mu         sync.Mutex
+	cond       *sync.Cond
+	chunks     []memChunk
+	last       time.Time
+	deadline   time.Time
+	readClosed bool
+	// writeClosed makes the reads return io.EOF once the chunks left are read.
+	writeClosed bool
+}
+
+type memChunk struct {
+	data []byte
+	at   time.Time
+}
+
+func newMemPipe() *memPipe {
+	p := &memPipe{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *memPipe) writable() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.writeClosed || p.readClosed {
+		return io.ErrClosedPipe
+	}
+	return nil
+}
+
+func (p *memPipe) push(data []byte, at time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.writeClosed || p.readClosed {
+		return io.ErrClosedPipe
+	}
+	// A write never overtakes the previous one, even when the latency went down in between.
+	if at.Before(p.last) {
+		at = p.last
+	}
+	p.last = at
+	p.chunks = append(p.chunks, memChunk{data: data, at: at})
+	p.cond.Broadcast()
+	return nil
+}
+
+func (p *memPipe) read(b []byte) (int, error) {
+	p.readMu.Lock()
+	defer p.readMu.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		if p.readClosed {
+			return 0, net.ErrClosed
+		}
+		if !p.deadline.IsZero() && !time.Now().Before(p.deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		if len(p.chunks) > 0 {
+			chunk := &p.chunks[0]
+			if wait := time.Until(chunk.at); wait > 0 {
+				p.wakeAfter(wait)
+				p.cond.Wait()
+				continue
+			}
+			n := copy(b, chunk.data)
+			chunk.data = chunk.data[n:]
+			if len(chunk.data) == 0 {
+				p.chunks = p.chunks[1:]
+			}
+			return n, nil
+		}
+		if p.writeClosed {
+			return 0, io.EOF
+		}
+		p.cond.Wait()
+	}
+}
+
+// wakeAfter wakes the readers up after d, for the chunks in flight and the deadlines.
+func (p *memPipe) wakeAfter(d time.Duration) {
+	time.AfterFunc(d, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.cond.Broadcast()
+	})
+}
+
+func (p *memPipe) setDeadline(t time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deadline = t
+	if wait := time.Until(t); !t.IsZero() && wait > 0 {
+		p.wakeAfter(wait)
+	}
+	p.cond.Broadcast()
+}
+
+func (p *memPipe) closeRead() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readClosed = true
+	p.chunks = nil
+	p.cond.Broadcast()
+}
+
+func (p *memPipe) closeWrite() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.writeClosed = true
+	p.cond.Broadcast()
+}
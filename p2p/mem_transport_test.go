@@ -0,0 +1,145 @@
+package p2p
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memConnPair returns both ends of a connection from :4000 to :3000.
+func memConnPair(t *testing.T, network *MemNetwork) (net.Conn, net.Conn) {
+	l, err := network.Listen(":3000")
+	assert.Nil(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		assert.Nil(t, err)
+		accepted <- conn
+	}()
+	dialer, err := network.Dial(":4000", ":3000")
+	assert.Nil(t, err)
+	return dialer, <-accepted
+}
+
+func TestMemTransport(t *testing.T) {
+	network := NewMemNetwork()
+	opts := TCPTransportOpts{
+		ListenAddr:    ":3000",
+		HandshakeFunc: NOPhandshakeFunc,
+		Decoder:       DefaultDecoder{},
+	}
+	peers := make(chan Peer, 1)
+	a := NewMemTransport(network, opts)
+	opts.ListenAddr = ":4000"
+	opts.OnPeer = func(p Peer) error {
+		peers <- p
+		return nil
+	}
+	b := NewMemTransport(network, opts)
+	assert.Nil(t, a.ListenAndAccept())
+	defer a.Close()
+	assert.Nil(t, b.ListenAndAccept())
+	defer b.Close()
+
+	assert.Nil(t, b.Dial(":3000"))
+	peer := <-peers
+	assert.True(t, peer.Outbound())
+	assert.Equal(t, ":3000", peer.RemoteAddr().String())
+
+	assert.Nil(t, peer.Send([]byte{IncomingMessage}))
+	assert.Nil(t, peer.Send([]byte("hello")))
+	select {
+	case rpc := <-a.Consume():
+		assert.Equal(t, "hello", string(rpc.Payload))
+		assert.Equal(t, ":4000#1", rpc.From)
+	case <-time.After(time.Second):
+		t.Fatal("the message never arrived")
+	}
+
+	_, err := network.Dial(":4000", ":5000")
+	assert.NotNil(t, err)
+	_, err = network.Listen(":3000")
+	assert.NotNil(t, err)
+}
+
+func TestMemConn(t *testing.T) {
+	dialer, accepted := memConnPair(t, NewMemNetwork())
+
+	// Every read returns the data of a single write, the writes do not wait for the reads.
+	dialer.Write([]byte("first"))
+	dialer.Write([]byte("second"))
+	buf := make([]byte, 64)
+	n, err := accepted.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "first", string(buf[:n]))
+	n, err = accepted.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "second", string(buf[:n]))
+
+	accepted.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = accepted.Read(buf)
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	accepted.SetReadDeadline(time.Time{})
+
+	dialer.Write([]byte("last"))
+	dialer.Close()
+	n, err = accepted.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "last", string(buf[:n]))
+	_, err = accepted.Read(buf)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestMemNetworkLatency(t *testing.T) {
+	network := NewMemNetwork()
+	dialer, accepted := memConnPair(t, network)
+	network.SetLatency(50 * time.Millisecond)
+
+	start := time.Now()
+	dialer.Write([]byte("slow"))
+	buf := make([]byte, 64)
+	_, err := accepted.Read(buf)
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestMemNetworkDrop(t *testing.T) {
+	network := NewMemNetwork()
+	dialer, accepted := memConnPair(t, network)
+	network.SetDropRate(0.5)
+
+	for i := 0; i < 100; i++ {
+		_, err := dialer.Write([]byte{byte(i)})
+		assert.Nil(t, err)
+	}
+	dialer.Close()
+	received, err := io.ReadAll(accepted)
+	assert.Nil(t, err)
+	assert.Greater(t, len(received), 20)
+	assert.Less(t, len(received), 80)
+}
+
+func TestMemNetworkPartition(t *testing.T) {
+	network := NewMemNetwork()
+	dialer, accepted := memConnPair(t, network)
+
+	network.Partition(":3000", ":4000")
+	_, err := network.Dial(":4000", ":3000")
+	assert.NotNil(t, err)
+	_, err = dialer.Write([]byte("lost"))
+	assert.Nil(t, err)
+
+	network.Heal(":4000", ":3000")
+	dialer.Write([]byte("delivered"))
+	buf := make([]byte, 64)
+	n, err := accepted.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "delivered", string(buf[:n]))
+}
@@ -1,10 +1,23 @@
 package p2p
 
+import "io"
+
 const (
 	IncomingMessage = 0x1
 	IncomingStream  = 0x2
+	// IncomingPing and IncomingPong are the heartbeats, followed by the 8 bytes of the time the
+	// ping was sent, which the pong echoes.
+	IncomingPing = 0x3
+	IncomingPong = 0x4
+	// IncomingReject is sent before closing a connection that was not admitted, followed by the
+	// length of the reason as a little endian uint16 and the reason.
+	IncomingReject = 0x5
 )
 
+// MaxMessageSize is the most DefaultDecoder reads of an IncomingMessage, which it reads at once.
+// A longer message would be cut short, the node encoding it turns it down instead.
+const MaxMessageSize = 2048
+
 // RPC (Remote Procedure Call) represents any abriitary data that is being sent
 // over the each transport between two nodes in the network.
 // RPC in context of p2p(peer to peer) can invoke procedures or functions on remote
@@ -13,4 +26,11 @@ type RPC struct {
 	Payload []byte
 	From    string
 	Stream  bool
+	// Control is IncomingPing or IncomingPong for a heartbeat, the transport answers it, or
+	// IncomingReject with the reason as the payload.
+	Control byte
+	// Body is set for the peers that agreed on FeatureMultiplexing, where every message comes on
+	// a stream of its own. It reads the stream following the message, io.EOF when there is none,
+	// or the stream itself when Stream is set. It has to be closed once done with.
+	Body io.ReadCloser
 }
@@ -0,0 +1,52 @@
+package p2p
+
+import (
+	"io"
+
+	"github.com/ashirwad-maker/quantumsync/metrics"
+)
+
+// transportMetrics are the metrics of a transport, shared by its peers.
+type transportMetrics struct {
+	connections      *metrics.GaugeVec
+	connectionsTotal *metrics.CounterVec
+	rejected         *metrics.Counter
+	handshakeErrors  *metrics.Counter
+	bytesReceived    *metrics.Counter
+	bytesSent        *metrics.Counter
+	messages         *metrics.Counter
+	rtt              *metrics.Histogram
+}
+
+func newTransportMetrics(r *metrics.Registry) *transportMetrics {
+	return &transportMetrics{
+		connections:      r.GaugeVec("qs_transport_connections", "Connections open, by direction.", "direction"),
+		connectionsTotal: r.CounterVec("qs_transport_connections_total", "Connections opened, by direction.", "direction"),
+		rejected:         r.Counter("qs_transport_rejected_connections_total", "Inbound connections turned away by the limits or the allow and deny lists."),
+		handshakeErrors:  r.Counter("qs_transport_handshake_errors_total", "Connections dropped by a failed handshake."),
+		bytesReceived:    r.Counter("qs_transport_received_bytes_total", "Bytes read from the peers."),
+		bytesSent:        r.Counter("qs_transport_sent_bytes_total", "Bytes written to the peers."),
+		messages:         r.Counter("qs_transport_messages_total", "Messages received from the peers."),
+		rtt:              r.Histogram("qs_transport_rtt_seconds", "Round trip times measured by the heartbeats.", nil),
+	}
+}
+
+func direction(outbound bool) string {
+	if outbound {
+		return "outbound"
+	}
+	return "inbound"
+}
+
+// countedStream counts the bytes written on a stream of a multiplexed connection, they do not
+// go through the Write of the peer.
+type countedStream struct {
+	io.WriteCloser
+	peer *TCPPeer
+}
+
+func (s *countedStream) Write(b []byte) (int, error) {
+	n, err := s.WriteCloser.Write(b)
+	s.peer.countSent(n)
+	return n, err
+}
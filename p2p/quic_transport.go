@@ -0,0 +1,505 @@
+package p2p
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicProto is the ALPN protocol of the nodes, a QUIC handshake needs one.
+const quicProto = "quantumsync"
+
+// QUICTransportOpts configures a QUICTransport, the addresses are host:port on UDP.
+type QUICTransportOpts struct {
+	TCPTransportOpts
+	// TLSConfig secures the connections, QUIC is always encrypted. When nil the listener uses a
+	// certificate made up on start and the dialer does not verify it, the traffic is encrypted but
+	// the nodes are not authenticated, as over TCP.
+	TLSConfig *tls.Config
+}
+
+// QUICTransport is a TCPTransport over QUIC. Every message, along with the stream following it,
+// is sent on a QUIC stream of its own, so concurrent writes to a peer never interleave and a
+// stream lost on the way does not hold up the packets of the others. When both ends agreed on
+// FeatureMultiplexing every QUIC stream is read on its own, so a file being streamed does not hold
+// up the messages sent after it. Otherwise they are read in the order they were opened.
+type QUICTransport struct {
+	*TCPTransport
+}
+
+// NewQUICTransport returns a transport over QUIC, the Listen and Dial of the options are replaced.
+func NewQUICTransport(opts QUICTransportOpts) *QUICTransport {
+	tcpOpts := opts.TCPTransportOpts
+	tcpOpts.Listen = func(addr string) (net.Listener, error) {
+		return ListenQUIC(addr, opts.TLSConfig)
+	}
+	tcpOpts.Dial = func(addr string) (net.Conn, error) {
+		return DialQUIC(addr, opts.TLSConfig)
+	}
+	return &QUICTransport{TCPTransport: NewTCPTransport(tcpOpts)}
+}
+
+var quicConfig = &quic.Config{
+	// An idle connection would be closed after 30 seconds otherwise.
+	KeepAlivePeriod:       10 * time.Second,
+	MaxIncomingUniStreams: 1000,
+}
+
+// ListenQUIC listens for QUIC connections on the UDP address, a nil config uses a certificate
+// made up for the process.
+func ListenQUIC(addr string, tlsConf *tls.Config) (net.Listener, error) {
+	if tlsConf == nil {
+		cert, err := selfSignedCert()
+		if err != nil {
+			return nil, err
+		}
+		tlsConf = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	tr := &quic.Transport{Conn: udpConn}
+	ln, err := tr.Listen(withProto(tlsConf), quicConfig)
+	if err != nil {
+		tr.Close()
+		udpConn.Close()
+		return nil, err
+	}
+	return &quicListener{ln: ln, tr: tr, udpConn: udpConn}, nil
+}
+
+// DialQUIC connects to the QUIC listener at addr, a nil config does not verify its certificate.
+func DialQUIC(addr string, tlsConf *tls.Config) (net.Conn, error) {
+	if tlsConf == nil {
+		tlsConf = &tls.Config{InsecureSkipVerify: true}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, withProto(tlsConf), quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	return newQUICConn(conn), nil
+}
+
+func withProto(tlsConf *tls.Config) *tls.Config {
+	if len(tlsConf.NextProtos) > 0 {
+		return tlsConf
+	}
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = []string{quicProto}
+	return tlsConf
+}
+
+var (
+	certOnce sync.Once
+	cert     tls.Certificate
+	certErr  error
+)
+
+// selfSignedCert returns the certificate of the process, made up the first time.
+func selfSignedCert() (tls.Certificate, error) {
+	certOnce.Do(func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			certErr = err
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		if err != nil {
+			certErr = err
+			return
+		}
+		cert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	})
+	return cert, certErr
+}
+
+// quicListener owns the UDP socket of the connections it accepts, it is closed once the listener
+// and all of them are. Closing the socket first would cut them off without telling the peers.
+type quicListener struct {
+	ln      *quic.Listener
+	tr      *quic.Transport
+	udpConn net.PacketConn
+
+	mu     sync.Mutex
+	conns  int
+	closed bool
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	conn, err := l.ln.Accept(context.Background())
+	if errors.Is(err, quic.ErrServerClosed) {
+		return nil, net.ErrClosed
+	}
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	l.conns++
+	l.mu.Unlock()
+	c := newQUICConn(conn)
+	c.onClose = func() { l.release(1) }
+	return c, nil
+}
+
+func (l *quicListener) Close() error {
+	err := l.ln.Close()
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+	l.release(0)
+	return err
+}
+
+// release forgets about n connections that closed, the socket is closed with the last one.
+func (l *quicListener) release(n int) {
+	l.mu.Lock()
+	l.conns -= n
+	done := l.closed && l.conns == 0
+	l.mu.Unlock()
+	if done {
+		l.tr.Close()
+		l.udpConn.Close()
+	}
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// The first byte of every stream tells what it is for.
+const (
+	quicStreamData  = 0x0
+	quicStreamClose = 0x1
+)
+
+// quicLinger is how long Close waits for the peer to read what was sent before closing the
+// connection, closing a QUIC connection drops the streams that are still on their way.
+const quicLinger = time.Second
+
+// quicConn is a QUIC connection used as a byte stream: the reads go through the streams the peer
+// opened one after the other, every write goes on a new stream. OpenStream gives a stream for
+// several writes that have to stay together.
+//
+// Close sends a close stream after the others and waits for the peer to close the connection once
+// it has read up to it, as the data still buffered on a TCP socket is delivered after a close.
+type quicConn struct {
+	conn quic.Connection
+
+	readMu sync.Mutex
+
+	// mu guards the deadlines and the stream being read, so a deadline set while a read waits
+	// applies to it.
+	mu            sync.Mutex
+	current       quic.ReceiveStream
+	kindRead      bool
+	peerClosed    bool
+	acceptCancel  context.CancelFunc
+	readDeadline  time.Time
+	writeDeadline time.Time
+	closeOnce     sync.Once
+	closeErr      error
+	// onClose is called once the connection is closed.
+	onClose func()
+}
+
+func newQUICConn(conn quic.Connection) *quicConn {
+	return &quicConn{conn: conn}
+}
+
+func (c *quicConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for {
+		c.mu.Lock()
+		st, kindRead, peerClosed := c.current, c.kindRead, c.peerClosed
+		c.mu.Unlock()
+		if peerClosed {
+			return 0, io.EOF
+		}
+		if st == nil {
+			var err error
+			if st, err = c.acceptStream(); err != nil {
+				return 0, err
+			}
+		}
+		if !kindRead {
+			kind := make([]byte, 1)
+			if _, err := io.ReadFull(st, kind); err != nil {
+				return 0, quicError(err)
+			}
+			c.mu.Lock()
+			c.kindRead = true
+			c.mu.Unlock()
+			if kind[0] == quicStreamClose {
+				// Everything the peer sent has been read, it waits for us to close.
+				c.mu.Lock()
+				c.peerClosed = true
+				c.mu.Unlock()
+				c.conn.CloseWithError(0, "")
+				return 0, io.EOF
+			}
+		}
+
+		n, err := st.Read(b)
+		if err == io.EOF {
+			// On to the next stream, the caller sees one stream of bytes.
+			c.mu.Lock()
+			c.current = nil
+			c.kindRead = false
+			c.mu.Unlock()
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, quicError(err)
+	}
+}
+
+// acceptStream waits for the next stream of the peer until the read deadline, and makes it the
+// one being read.
+func (c *quicConn) acceptStream() (quic.ReceiveStream, error) {
+	for {
+		c.mu.Lock()
+		deadline := c.readDeadline
+		ctx, cancel := context.WithCancel(context.Background())
+		if !deadline.IsZero() {
+			ctx, cancel = context.WithDeadline(context.Background(), deadline)
+		}
+		c.acceptCancel = cancel
+		c.mu.Unlock()
+
+		st, err := c.conn.AcceptUniStream(ctx)
+		cancel()
+
+		c.mu.Lock()
+		c.acceptCancel = nil
+		if err == nil {
+			st.SetReadDeadline(c.readDeadline)
+			c.current = st
+			c.kindRead = false
+		}
+		c.mu.Unlock()
+		// The deadline moved while waiting, wait again with the new one.
+		if errors.Is(err, context.Canceled) && c.conn.Context().Err() == nil {
+			continue
+		}
+		return st, quicError(err)
+	}
+}
+
+// AcceptStream waits for the next stream of the peer, for a multiplexed connection that reads
+// every stream on its own instead of one after the other. The first byte of the stream is left to
+// the caller, it returns io.EOF once the peer is closing. It can not be mixed with Read, only the
+// rest of the stream a Read was in the middle of is skipped.
+func (c *quicConn) AcceptStream() (io.ReadCloser, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	c.mu.Lock()
+	current, peerClosed := c.current, c.peerClosed
+	c.current = nil
+	c.mu.Unlock()
+	if peerClosed {
+		return nil, io.EOF
+	}
+	if current != nil {
+		current.CancelRead(0)
+	}
+
+	st, err := c.acceptStream()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.current = nil
+	c.mu.Unlock()
+	// The read deadline of the connection is the one of waiting for the stream.
+	st.SetReadDeadline(time.Time{})
+	kind := make([]byte, 1)
+	if _, err := io.ReadFull(st, kind); err != nil {
+		st.CancelRead(0)
+		return nil, quicError(err)
+	}
+	if kind[0] == quicStreamClose {
+		c.mu.Lock()
+		c.peerClosed = true
+		c.mu.Unlock()
+		c.conn.CloseWithError(0, "")
+		return nil, io.EOF
+	}
+	return &quicReceiveStream{ReceiveStream: st}, nil
+}
+
+// quicReceiveStream is a stream accepted by AcceptStream, closing it before the end tells the peer
+// the rest is not read.
+type quicReceiveStream struct {
+	quic.ReceiveStream
+}
+
+// Read keeps the io.EOF coming with the last bytes for the next read, as a socket does.
+func (s *quicReceiveStream) Read(b []byte) (int, error) {
+	n, err := s.ReceiveStream.Read(b)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, quicError(err)
+}
+
+func (s *quicReceiveStream) Close() error {
+	s.CancelRead(0)
+	return nil
+}
+
+// quicError maps the errors of QUIC to the ones of a socket, a connection closed by the peer ends
+// the reads with io.EOF.
+func quicError(err error) error {
+	var appErr *quic.ApplicationError
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.DeadlineExceeded):
+		return os.ErrDeadlineExceeded
+	case errors.As(err, &appErr) && appErr.ErrorCode == 0:
+		if appErr.Remote {
+			return io.EOF
+		}
+		return net.ErrClosed
+	}
+	return err
+}
+
+// OpenStream returns a new stream to the peer, closing it tells the peer it is complete.
+func (c *quicConn) OpenStream() (io.WriteCloser, error) {
+	ctx := context.Background()
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	return c.openStream(ctx, deadline, quicStreamData)
+}
+
+func (c *quicConn) openStream(ctx context.Context, deadline time.Time, kind byte) (*quicStream, error) {
+	st, err := c.conn.OpenUniStreamSync(ctx)
+	if err != nil {
+		return nil, quicError(err)
+	}
+	st.SetWriteDeadline(deadline)
+	if _, err := st.Write([]byte{kind}); err != nil {
+		st.CancelWrite(0)
+		return nil, quicError(err)
+	}
+	return &quicStream{SendStream: st}, nil
+}
+
+func (c *quicConn) Write(b []byte) (int, error) {
+	w, err := c.OpenStream()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, w.Close()
+}
+
+func (c *quicConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.linger()
+		c.closeErr = c.conn.CloseWithError(0, "")
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return c.closeErr
+}
+
+// linger tells the peer we are closing and waits for it to have read everything.
+func (c *quicConn) linger() {
+	c.mu.Lock()
+	peerClosed := c.peerClosed
+	c.mu.Unlock()
+	if peerClosed || c.conn.Context().Err() != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), quicLinger)
+	defer cancel()
+	st, err := c.openStream(ctx, time.Now().Add(quicLinger), quicStreamClose)
+	if err != nil {
+		return
+	}
+	st.Close()
+	select {
+	case <-c.conn.Context().Done():
+	case <-ctx.Done():
+	}
+}
+
+func (c *quicConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *quicConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+func (c *quicConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline applies to waiting for the next stream as well as to reading it.
+func (c *quicConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	if c.current != nil {
+		c.current.SetReadDeadline(t)
+	}
+	if c.acceptCancel != nil {
+		c.acceptCancel()
+	}
+	return nil
+}
+
+// SetWriteDeadline applies to the streams opened after it.
+func (c *quicConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+type quicStream struct {
+	quic.SendStream
+}
+
+func (s *quicStream) Write(b []byte) (int, error) {
+	n, err := s.SendStream.Write(b)
+	return n, quicError(err)
+}
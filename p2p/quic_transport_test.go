@@ -0,0 +1,189 @@
+package p2p
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func freeUDPAddr(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func TestQUICTransport(t *testing.T) {
+	opts := QUICTransportOpts{
+		TCPTransportOpts: TCPTransportOpts{
+			ListenAddr:    freeUDPAddr(t),
+			HandshakeFunc: NOPhandshakeFunc,
+			Decoder:       DefaultDecoder{},
+		},
+	}
+	a := NewQUICTransport(opts)
+	assert.Nil(t, a.ListenAndAccept())
+	defer a.Close()
+
+	peers := make(chan Peer, 1)
+	opts.ListenAddr = freeUDPAddr(t)
+	opts.OnPeer = func(p Peer) error {
+		peers <- p
+		return nil
+	}
+	b := NewQUICTransport(opts)
+	defer b.Close()
+	assert.Nil(t, b.Dial(a.Addr()))
+	peer := <-peers
+	assert.True(t, peer.Outbound())
+	assert.Equal(t, a.Addr(), peer.RemoteAddr().String())
+
+	assert.Nil(t, peer.Send([]byte{IncomingMessage}))
+	assert.Nil(t, peer.Send([]byte("hello")))
+	assertMessage(t, a, "hello")
+}
+
+func TestQUICTransportMultiplexing(t *testing.T) {
+	opts := QUICTransportOpts{
+		TCPTransportOpts: TCPTransportOpts{
+			ListenAddr:    freeUDPAddr(t),
+			HandshakeFunc: VersionHandshake(VersionHandshakeOpts{MinVersion: 1, MaxVersion: 1, Features: FeatureMultiplexing}),
+			Decoder:       DefaultDecoder{},
+		},
+	}
+	a := NewQUICTransport(opts)
+	assert.Nil(t, a.ListenAndAccept())
+	defer a.Close()
+
+	peers := make(chan Peer, 1)
+	opts.ListenAddr = freeUDPAddr(t)
+	opts.OnPeer = func(p Peer) error {
+		peers <- p
+		return nil
+	}
+	b := NewQUICTransport(opts)
+	defer b.Close()
+	assert.Nil(t, b.Dial(a.Addr()))
+	peer := <-peers
+	assert.True(t, peer.Protocol().Features.Has(FeatureMultiplexing))
+
+	// A message with a stream that is still being written.
+	w, err := peer.OpenStream()
+	assert.Nil(t, err)
+	w.Write([]byte{IncomingMessage})
+	w.Write([]byte("store"))
+	time.Sleep(5 * time.Millisecond)
+	w.Write([]byte{IncomingStream})
+	w.Write([]byte("first half,"))
+	first := assertMessage(t, a, "store")
+	assert.NotNil(t, first.Body)
+
+	// The messages sent after it are not held up by it.
+	assert.Nil(t, peer.Send([]byte("\x01delete")))
+	assertMessage(t, a, "delete")
+
+	w.Write([]byte("second half"))
+	w.Close()
+	body, err := io.ReadAll(first.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "first half,second half", string(body))
+	first.Body.Close()
+
+	// A stream on its own comes with nothing before it.
+	w, err = peer.OpenStream()
+	assert.Nil(t, err)
+	w.Write([]byte{IncomingStream})
+	w.Write([]byte("answer"))
+	w.Close()
+	select {
+	case rpc := <-a.Consume():
+		assert.True(t, rpc.Stream)
+		body, err := io.ReadAll(rpc.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, "answer", string(body))
+		rpc.Body.Close()
+	case <-time.After(time.Second):
+		t.Fatal("the stream never arrived")
+	}
+}
+
+func quicConnPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := ListenQUIC(freeUDPAddr(t), nil)
+	assert.Nil(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		assert.Nil(t, err)
+		accepted <- conn
+	}()
+	dialer, err := DialQUIC(l.Addr().String(), nil)
+	assert.Nil(t, err)
+	t.Cleanup(func() { dialer.Close() })
+	return dialer, <-accepted
+}
+
+func TestQUICConnStreams(t *testing.T) {
+	dialer, accepted := quicConnPair(t)
+	opener := dialer.(interface {
+		OpenStream() (io.WriteCloser, error)
+	})
+
+	// The writes of concurrent streams do not interleave, each one is read as a whole.
+	var wg sync.WaitGroup
+	for _, c := range []string{"a", "b", "c"} {
+		w, err := opener.OpenStream()
+		assert.Nil(t, err)
+		wg.Add(1)
+		go func(w io.WriteCloser, c string) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				w.Write([]byte(strings.Repeat(c, 100)))
+				time.Sleep(time.Millisecond)
+			}
+			w.Close()
+		}(w, c)
+	}
+	received := make(chan []byte)
+	go func() {
+		b, err := io.ReadAll(accepted)
+		assert.Nil(t, err)
+		received <- b
+	}()
+	wg.Wait()
+	// Closing waits for the peer to read what is on its way.
+	dialer.Close()
+	assert.Equal(t, strings.Repeat("a", 1000)+strings.Repeat("b", 1000)+strings.Repeat("c", 1000), string(<-received))
+}
+
+func TestQUICConnDeadline(t *testing.T) {
+	_, accepted := quicConnPair(t)
+
+	accepted.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := accepted.Read(make([]byte, 8))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+
+	// A deadline set while a read waits applies to it.
+	errch := make(chan error, 1)
+	accepted.SetReadDeadline(time.Time{})
+	go func() {
+		_, err := accepted.Read(make([]byte, 8))
+		errch <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	accepted.SetReadDeadline(time.Now())
+	select {
+	case err := <-errch:
+		assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	case <-time.After(time.Second):
+		t.Fatal("the read did not see the new deadline")
+	}
+}
@@ -1,11 +1,19 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
+	"net/netip"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ashirwad-maker/quantumsync/metrics"
 )
 
 // TCPPeer represents the remote node over a estabilished connection.
@@ -19,24 +27,257 @@ type TCPPeer struct {
 	outbound bool
 
 	// We are reading from the conn in the handleConn function and we are also reading it in the
-	// loop function from the peer, which are basically the same connection, so to avoid race conditions we are using a waitgroup.
-	wg *sync.WaitGroup
+	// loop function from the peer, which are basically the same connection, so the read loop waits
+	// on streamDone until the consumer of a stream is done with it. It holds one token, a stream
+	// closed before the read loop gets to it, or closed twice over a garbled connection, does not
+	// block or panic.
+	streamDone chan struct{}
+	// streamStart is signalled by the read loop when it gets to a stream, NextStream waits for it
+	// so the consumer only reads the connection once the read loop is done with it. It is nil for
+	// a peer made outside of a transport, nothing else reads its connection. loopDone is closed
+	// when the read loop returns.
+	streamStart chan struct{}
+	loopDone    chan struct{}
+
+	// protocol is set by the handshake before the read loop starts.
+	protocol Protocol
+
+	// The timeouts of the reads and writes, set by the transport before the read loop starts. The
+	// read loop sets idle while it waits for the next frame, that read gets idleTimeout instead.
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+	idle         atomic.Bool
+	// writeMu is held by an open stream, so the heartbeats never land in the middle of one.
+	writeMu sync.Mutex
+	rtt     atomic.Int64
+	// metrics are those of the transport, nil for a peer made outside of one.
+	metrics *transportMetrics
+	// The bytes read from and written to the peer, with the handshake and the heartbeats.
+	connectedAt   time.Time
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
 	return &TCPPeer{
-		Conn:     conn,
-		outbound: outbound,
-		wg:       &sync.WaitGroup{},
+		Conn:        conn,
+		outbound:    outbound,
+		streamDone:  make(chan struct{}, 1),
+		connectedAt: time.Now(),
+	}
+}
+
+// Outbound reports whether the connection was dialed by us (true) or accepted
+// from the listener (false).
+func (peer *TCPPeer) Outbound() bool {
+	return peer.outbound
+}
+
+// Protocol reports the version and features agreed on in the handshake.
+func (peer *TCPPeer) Protocol() Protocol {
+	return peer.protocol
+}
+
+func (peer *TCPPeer) setProtocol(p Protocol) {
+	peer.protocol = p
+}
+
+// RTT implements the Peer interface.
+func (peer *TCPPeer) RTT() time.Duration {
+	return time.Duration(peer.rtt.Load())
+}
+
+// Stats implements the Peer interface.
+func (peer *TCPPeer) Stats() PeerStats {
+	return PeerStats{
+		ConnectedAt:   peer.connectedAt,
+		BytesSent:     peer.bytesSent.Load(),
+		BytesReceived: peer.bytesReceived.Load(),
+	}
+}
+
+func (peer *TCPPeer) countReceived(n int) {
+	peer.bytesReceived.Add(int64(n))
+	if peer.metrics != nil {
+		peer.metrics.bytesReceived.Add(float64(n))
+	}
+}
+
+func (peer *TCPPeer) countSent(n int) {
+	peer.bytesSent.Add(int64(n))
+	if peer.metrics != nil {
+		peer.metrics.bytesSent.Add(float64(n))
 	}
 }
 
+// Read reads from the connection within the read timeout. A read that times out leaves the
+// connection in the middle of a frame, it is closed and the read loop waiting on a stream let go.
+func (peer *TCPPeer) Read(b []byte) (int, error) {
+	timeout := peer.readTimeout
+	if peer.idle.Swap(false) {
+		timeout = peer.idleTimeout
+	}
+	if timeout > 0 {
+		peer.Conn.SetReadDeadline(time.Now().Add(timeout))
+	} else if peer.readTimeout > 0 || peer.idleTimeout > 0 {
+		peer.Conn.SetReadDeadline(time.Time{})
+	}
+	n, err := peer.Conn.Read(b)
+	peer.countReceived(n)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		peer.Conn.Close()
+		peer.CloseStream()
+		return n, fmt.Errorf("nothing heard from (%s) in %s: %w", peer.RemoteAddr(), timeout, err)
+	}
+	return n, err
+}
+
+// Write writes to the connection within the write timeout.
+func (peer *TCPPeer) Write(b []byte) (int, error) {
+	if peer.writeTimeout > 0 {
+		peer.Conn.SetWriteDeadline(time.Now().Add(peer.writeTimeout))
+	}
+	n, err := peer.Conn.Write(b)
+	peer.countSent(n)
+	return n, err
+}
+
 func (peer *TCPPeer) CloseStream() {
-	peer.wg.Done()
+	select {
+	case peer.streamDone <- struct{}{}:
+	default:
+	}
+}
+
+// NextStream implements the Peer interface, it waits for the read loop to get to the next stream.
+func (peer *TCPPeer) NextStream() (io.ReadCloser, error) {
+	if peer.streamStart == nil {
+		return &streamReader{peer: peer}, nil
+	}
+	select {
+	case <-peer.streamStart:
+		return &streamReader{peer: peer}, nil
+	case <-peer.loopDone:
+		return nil, net.ErrClosed
+	}
+}
+
+// streamReader reads a stream off the connection, closing it hands the connection back to the
+// read loop.
+type streamReader struct {
+	peer      *TCPPeer
+	closeOnce sync.Once
+}
+
+func (r *streamReader) Read(b []byte) (int, error) {
+	return r.peer.Read(b)
+}
+
+func (r *streamReader) Close() error {
+	r.closeOnce.Do(r.peer.CloseStream)
+	return nil
+}
+
+// muxConn is a connection carrying every message, with the stream following it, on a stream of
+// its own. FeatureMultiplexing is only offered over one.
+type muxConn interface {
+	OpenStream() (io.WriteCloser, error)
+	AcceptStream() (io.ReadCloser, error)
+}
+
+func canMultiplex(peer Peer) bool {
+	p, ok := peer.(*TCPPeer)
+	if !ok {
+		return false
+	}
+	_, ok = p.Conn.(muxConn)
+	return ok
+}
+
+// muxStream reads a stream of a multiplexed peer within the read timeout.
+type muxStream struct {
+	io.ReadCloser
+	peer *TCPPeer
+}
+
+func (s *muxStream) Read(b []byte) (int, error) {
+	if d, ok := s.ReadCloser.(interface{ SetReadDeadline(time.Time) error }); ok && s.peer.readTimeout > 0 {
+		d.SetReadDeadline(time.Now().Add(s.peer.readTimeout))
+	}
+	n, err := s.ReadCloser.Read(b)
+	s.peer.countReceived(n)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, fmt.Errorf("nothing heard from (%s) on a stream in %s: %w", s.peer.RemoteAddr(), s.peer.readTimeout, err)
+	}
+	return n, err
+}
+
+// streamBody is the Body of an RPC, the stream following a message starts with IncomingStream.
+type streamBody struct {
+	*muxStream
+	started bool
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	if !b.started {
+		b.started = true
+		kind := make([]byte, 1)
+		if _, err := io.ReadFull(b.muxStream, kind); err != nil {
+			return 0, err
+		}
+		if kind[0] != IncomingStream {
+			return 0, fmt.Errorf("unexpected frame (0x%x) after the message of (%s)", kind[0], b.peer.RemoteAddr())
+		}
+	}
+	return b.muxStream.Read(p)
+}
+
+// OpenStream implements the Peer interface, on a plain connection the stream is the connection
+// itself, which is kept to the stream until it is closed.
+func (peer *TCPPeer) OpenStream() (io.WriteCloser, error) {
+	if m, ok := peer.Conn.(interface {
+		OpenStream() (io.WriteCloser, error)
+	}); ok {
+		w, err := m.OpenStream()
+		if err != nil {
+			return nil, err
+		}
+		return &countedStream{WriteCloser: w, peer: peer}, nil
+	}
+	peer.writeMu.Lock()
+	return &peerStream{peer: peer}, nil
+}
+
+type peerStream struct {
+	peer      *TCPPeer
+	closeOnce sync.Once
+}
+
+func (s *peerStream) Write(b []byte) (int, error) {
+	return s.peer.Write(b)
+}
+
+func (s *peerStream) Close() error {
+	s.closeOnce.Do(s.peer.writeMu.Unlock)
+	return nil
 }
 
 func (peer *TCPPeer) Send(b []byte) error {
-	_, err := peer.Conn.Write(b)
+	peer.writeMu.Lock()
+	defer peer.writeMu.Unlock()
+	_, err := peer.Write(b)
+	return err
+}
+
+// sendControl sends a heartbeat frame unless a stream is being written, the peer is then busy
+// reading it anyway.
+func (peer *TCPPeer) sendControl(kind byte, payload []byte) error {
+	if !peer.writeMu.TryLock() {
+		return nil
+	}
+	defer peer.writeMu.Unlock()
+	_, err := peer.Write(append([]byte{kind}, payload...))
 	return err
 }
 
@@ -50,18 +291,88 @@ type TCPTransportOpts struct {
 	HandshakeFunc HandshakeFunc
 	Decoder       Decoder
 	OnPeer        func(Peer) error
+	// OnPeerDisconnect is called once the read loop of a peer that was accepted by
+	// OnPeer ends, so the server can forget about it.
+	OnPeerDisconnect func(Peer)
+	// Listen and Dial open the listener and the outbound connections, they default to TCP.
+	// MemTransport sets them to run over a MemNetwork, tests can wrap them to inject faults.
+	Listen func(addr string) (net.Listener, error)
+	Dial   func(addr string) (net.Conn, error)
+
+	// HeartbeatInterval is how often the peers that agreed on FeatureHeartbeat in the handshake
+	// are pinged, zero disables the heartbeats. Such a peer is dropped when nothing was heard from
+	// it for IdleTimeout, three heartbeats by default, as when its host lost power.
+	HeartbeatInterval time.Duration
+	IdleTimeout       time.Duration
+	// ReadTimeout and WriteTimeout bound every read and write on the connections once the
+	// handshake is done, zero means no limit.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// MaxInbound and MaxOutbound limit the number of peers accepted and dialed, MaxConnsPerIP
+	// the peers accepted from a single IP address. Zero means no limit.
+	MaxInbound    int
+	MaxOutbound   int
+	MaxConnsPerIP int
+	// Allow and Deny filter the peers accepted by their IP address. Deny wins, and an empty Allow
+	// lets every address not denied in.
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+
+	// Logger gets the logs of the transport, every record has the listen address as node. Nil
+	// drops them.
+	Logger *slog.Logger
+	// Metrics is the registry the connections, bytes and round trip times are counted in, nil
+	// counts them in one of the transport's own.
+	Metrics *metrics.Registry
 }
 
 type TCPTransport struct {
 	TCPTransportOpts // Using strcture embedding.
 	rpcch            chan RPC
 	listener         net.Listener
+	log              *slog.Logger
+	metrics          *transportMetrics
+
+	// conns are the open connections, Close closes them along with the listener. They are
+	// counted by direction and IP address for the limits.
+	mu        sync.Mutex
+	conns     map[net.Conn]connInfo
+	inbound   int
+	outbound  int
+	perIP     map[netip.Addr]int
+	closech   chan struct{}
+	closeOnce sync.Once
 }
 
 func NewTCPTransport(opts TCPTransportOpts) *TCPTransport {
+	if opts.Listen == nil {
+		opts.Listen = func(addr string) (net.Listener, error) {
+			return net.Listen("tcp", addr)
+		}
+	}
+	if opts.Dial == nil {
+		opts.Dial = func(addr string) (net.Conn, error) {
+			return net.Dial("tcp", addr)
+		}
+	}
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = 3 * opts.HeartbeatInterval
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	if opts.Metrics == nil {
+		opts.Metrics = metrics.NewRegistry()
+	}
 	return &TCPTransport{
 		TCPTransportOpts: opts,
 		rpcch:            make(chan RPC),
+		log:              opts.Logger.With("node", opts.ListenAddr),
+		metrics:          newTransportMetrics(opts.Metrics),
+		conns:            make(map[net.Conn]connInfo),
+		perIP:            make(map[netip.Addr]int),
+		closech:          make(chan struct{}),
 	}
 }
 
@@ -75,73 +386,220 @@ func (t *TCPTransport) Consume() <-chan RPC {
 	return t.rpcch
 }
 
-// Close implements the Transport Interface
+// Close implements the Transport Interface, it stops accepting connections and closes the
+// open ones, which ends their read loops.
 func (t *TCPTransport) Close() error {
-	return t.listener.Close()
+	var err error
+	t.closeOnce.Do(func() {
+		t.mu.Lock()
+		close(t.closech)
+		listener := t.listener
+		conns := make([]net.Conn, 0, len(t.conns))
+		for conn := range t.conns {
+			conns = append(conns, conn)
+		}
+		t.mu.Unlock()
+
+		if listener != nil {
+			err = listener.Close()
+		}
+		// Closing a connection can take a while on the transports that wait for the peer to read
+		// what was sent, they are closed together.
+		var wg sync.WaitGroup
+		for _, conn := range conns {
+			wg.Add(1)
+			go func(conn net.Conn) {
+				defer wg.Done()
+				conn.Close()
+			}(conn)
+		}
+		wg.Wait()
+	})
+	return err
 }
 
 // Dial implements the Transport Interface
 func (t *TCPTransport) Dial(addr string) error {
-	conn, err := net.Dial("tcp", addr)
+	// The outbound slot is taken before dialing, so the dials going on together can not all make
+	// it past MaxOutbound. track counts the connection in it.
+	t.mu.Lock()
+	err := t.admit(connInfo{outbound: true})
+	if err == nil {
+		t.outbound++
+	}
+	t.mu.Unlock()
 	if err != nil {
 		return err
 	}
+	conn, err := t.TCPTransportOpts.Dial(addr)
+	if err != nil {
+		t.mu.Lock()
+		t.outbound--
+		t.mu.Unlock()
+		return err
+	}
 	go t.handleConn(conn, true)
 	return nil
 }
 
+// track adds the connection to the open ones, it fails once the transport is closed or when
+// the connection is not admitted. An outbound connection was admitted by Dial, which took its slot.
+func (t *TCPTransport) track(conn net.Conn, outbound bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-t.closech:
+		if outbound {
+			t.outbound--
+		}
+		return net.ErrClosed
+	default:
+	}
+	info := connInfo{outbound: outbound}
+	if !outbound {
+		info.ip = remoteIP(conn)
+		if err := t.admit(info); err != nil {
+			return err
+		}
+		t.inbound++
+	}
+	t.conns[conn] = info
+	t.metrics.connections.With(direction(outbound)).Inc()
+	t.metrics.connectionsTotal.With(direction(outbound)).Inc()
+	if info.ip.IsValid() {
+		t.perIP[info.ip]++
+	}
+	return nil
+}
+
+func (t *TCPTransport) untrack(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info, ok := t.conns[conn]
+	if !ok {
+		return
+	}
+	delete(t.conns, conn)
+	if info.outbound {
+		t.outbound--
+	} else {
+		t.inbound--
+	}
+	t.metrics.connections.With(direction(info.outbound)).Dec()
+	if info.ip.IsValid() {
+		if t.perIP[info.ip]--; t.perIP[info.ip] == 0 {
+			delete(t.perIP, info.ip)
+		}
+	}
+}
+
 // ListenAndAccept implements the Transport Interface
 func (t *TCPTransport) ListenAndAccept() error {
-	var err error
-	t.listener, err = net.Listen("tcp", t.ListenAddr)
+	listener, err := t.TCPTransportOpts.Listen(t.ListenAddr)
 	if err != nil {
 		return err
 	}
+	t.mu.Lock()
+	select {
+	case <-t.closech:
+		t.mu.Unlock()
+		listener.Close()
+		return net.ErrClosed
+	default:
+	}
+	t.listener = listener
+	t.mu.Unlock()
 
-	go t.startAcceptLoop()
-	log.Printf("TCP transport listening on port : %s\n", t.ListenAddr)
+	go t.startAcceptLoop(listener)
+	t.log.Info("transport listening")
 	return nil
 
 }
 
-func (t *TCPTransport) startAcceptLoop() {
+func (t *TCPTransport) startAcceptLoop(listener net.Listener) {
+	// A failing Accept, as when the process runs out of file descriptors, is retried with a
+	// growing delay rather than spinning.
+	var delay time.Duration
 	for {
-		conn, err := t.listener.Accept() // blocking call, till the time a connection does not come
+		conn, err := listener.Accept() // blocking call, till the time a connection does not come
 		if errors.Is(err, net.ErrClosed) {
 			return
 		}
 
 		if err != nil {
-			fmt.Printf("TCP accept error %s", err)
+			delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+			t.log.Error("accept failed", "err", err, "retry", delay)
+			select {
+			case <-time.After(delay):
+			case <-t.closech:
+				return
+			}
+			continue
 		}
-		// fmt.Printf("New Incoming Connection: %+v \n", conn)
+		delay = 0
 		go t.handleConn(conn, false)
 	}
 }
 
 func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 	var err error
+	log := t.log.With("peer", conn.RemoteAddr().String())
 	defer func() {
-		fmt.Printf("Dropping Peer connection: %s\n", err)
+		log.Debug("connection closed", "err", err)
 		conn.Close()
 	}()
+	if err = t.track(conn, outbound); err != nil {
+		if !outbound && !errors.Is(err, net.ErrClosed) {
+			log.Warn("connection not admitted", "err", err)
+			t.metrics.rejected.Inc()
+			writeReject(conn, err)
+		}
+		return
+	}
+	defer t.untrack(conn)
 
 	peer := NewTCPPeer(conn, outbound)
+	peer.metrics = t.metrics
+	peer.streamStart = make(chan struct{}, 1)
+	peer.loopDone = make(chan struct{})
+	defer close(peer.loopDone)
 
 	// First the handshake is called, if the handshake is successful then we will
 	// check the t.OnPeer() if that is also fine then we will go in the Read Loop()
 	// If either of them fails we will drop the connection.
 
 	if err = t.HandshakeFunc(peer); err != nil {
-		fmt.Printf("TCP handshake error: %s\n", err)
+		log.Warn("handshake failed", "err", err)
+		t.metrics.handshakeErrors.Inc()
 		return
 	}
 
+	// The timeouts are set before the server gets to use the peer.
+	peer.readTimeout = t.ReadTimeout
+	peer.writeTimeout = t.WriteTimeout
+	heartbeat := t.HeartbeatInterval > 0 && peer.protocol.Features.Has(FeatureHeartbeat)
+	if heartbeat {
+		peer.idleTimeout = t.IdleTimeout
+	}
+
 	if t.OnPeer != nil {
 		if err = t.OnPeer(peer); err != nil {
 			return
 		}
 	}
+	if t.OnPeerDisconnect != nil {
+		defer t.OnPeerDisconnect(peer)
+	}
+	if heartbeat {
+		done := make(chan struct{})
+		defer close(done)
+		go t.heartbeat(peer, done)
+	}
+
+	if mc, ok := conn.(muxConn); ok && peer.protocol.Features.Has(FeatureMultiplexing) {
+		err = t.acceptStreams(peer, mc, log)
+		return
+	}
 
 	// Read Loop
 	for {
@@ -150,24 +608,129 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 		// otherwise if it is a decoder error then it should be keep on going.
 
 		// Note that the message is being decoded in rpc.PayLoad which is a slice of bytes.
-		log.Printf("Start of the Read loop of (%s)\n", t.ListenAddr)
-		err = t.Decoder.Decode(conn, &rpc)
+		peer.idle.Store(true)
+		err = t.Decoder.Decode(peer, &rpc)
 		if err != nil {
-			fmt.Printf("TCP error:  %s\n", err)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				log.Warn("peer timed out", "err", err)
+			}
 			return
 		}
+		if rpc.Control != 0 {
+			if err = t.handleControl(peer, rpc); err != nil {
+				return
+			}
+			continue
+		}
 		rpc.From = conn.RemoteAddr().String() // Storing the address of a endpoint in the network
 		if rpc.Stream {
-			peer.wg.Add(1)
-			log.Printf("Incoming stream from (%s) to (%s), waiting .....\n", rpc.From, t.ListenAddr)
-			peer.wg.Wait()
-			log.Printf("Closing the stream\n")
+			start := time.Now()
+			select {
+			case peer.streamStart <- struct{}{}:
+			default:
+			}
+			select {
+			case <-peer.streamDone:
+			case <-t.closech:
+				err = net.ErrClosed
+				return
+			}
+			log.Debug("stream done", "duration", time.Since(start))
 			continue // Once the streaming is done no need to pass it to the channel.
 		}
 
-		t.rpcch <- rpc
-		log.Printf("End of the Read loop of (%s) \n", t.ListenAddr)
+		log.Debug("message received", "bytes", len(rpc.Payload))
+		t.metrics.messages.Inc()
+		select {
+		case t.rpcch <- rpc:
+		case <-t.closech:
+			err = net.ErrClosed
+			return
+		}
+	}
+
+}
+
+// acceptStreams reads every stream of a multiplexed peer in a goroutine of its own, so a stream
+// being read does not hold up the messages coming after it.
+func (t *TCPTransport) acceptStreams(peer *TCPPeer, conn muxConn, log *slog.Logger) error {
+	for {
+		// A heartbeat comes on a stream of its own, waiting for one is what can be idle.
+		if peer.idleTimeout > 0 {
+			peer.Conn.SetReadDeadline(time.Now().Add(peer.idleTimeout))
+		}
+		st, err := conn.AcceptStream()
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				log.Warn("peer timed out", "err", err)
+			}
+			return err
+		}
+		go t.handleStream(peer, &muxStream{ReadCloser: st, peer: peer}, log)
+	}
+}
+
+// handleStream decodes the frame starting the stream, the rest of it goes along with the RPC.
+func (t *TCPTransport) handleStream(peer *TCPPeer, st *muxStream, log *slog.Logger) {
+	rpc := RPC{}
+	if err := t.Decoder.Decode(st, &rpc); err != nil {
+		log.Debug("could not decode stream", "err", err)
+		st.Close()
+		return
+	}
+	if rpc.Control != 0 {
+		st.Close()
+		if err := t.handleControl(peer, rpc); err != nil {
+			log.Warn("closing connection", "err", err)
+			peer.Conn.Close()
+		}
+		return
+	}
+	rpc.From = peer.RemoteAddr().String()
+	rpc.Body = &streamBody{muxStream: st, started: rpc.Stream}
+	if !rpc.Stream {
+		log.Debug("message received", "bytes", len(rpc.Payload))
+		t.metrics.messages.Inc()
+	}
+	select {
+	case t.rpcch <- rpc:
+	case <-t.closech:
+		st.Close()
+	case <-peer.loopDone:
+		st.Close()
+	}
+}
 
+// heartbeat pings the peer until done is closed, the pongs give its round trip time.
+func (t *TCPTransport) heartbeat(peer *TCPPeer, done <-chan struct{}) {
+	ticker := time.NewTicker(t.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		sent := binary.LittleEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+		if err := peer.sendControl(IncomingPing, sent); err != nil {
+			// The read loop notices the broken connection.
+			return
+		}
 	}
+}
 
+func (t *TCPTransport) handleControl(peer *TCPPeer, rpc RPC) error {
+	switch rpc.Control {
+	case IncomingPing:
+		if err := peer.sendControl(IncomingPong, rpc.Payload); err != nil {
+			t.log.Debug("pong failed", "peer", peer.RemoteAddr().String(), "err", err)
+		}
+	case IncomingPong:
+		sent := time.Unix(0, int64(binary.LittleEndian.Uint64(rpc.Payload)))
+		peer.rtt.Store(int64(time.Since(sent)))
+		t.metrics.rtt.ObserveSince(sent)
+	case IncomingReject:
+		return rejectedError(peer, rpc.Payload)
+	}
+	return nil
 }
@@ -1,20 +1,102 @@
 package p2p
 
 import (
+	"io"
 	"testing"
+	"time"
 
+	"github.com/ashirwad-maker/quantumsync/metrics"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestTCPTransport(t *testing.T) {
 	opts := TCPTransportOpts{
-		ListenAddr:    ":3000",
+		ListenAddr:    "127.0.0.1:0",
 		HandshakeFunc: NOPhandshakeFunc,
 		Decoder:       DefaultDecoder{},
 	}
 	tr := NewTCPTransport(opts)
-	assert.Equal(t, tr.ListenAddr, ":3000")
+	assert.Equal(t, tr.ListenAddr, "127.0.0.1:0")
 
 	//Server
 	assert.Nil(t, tr.ListenAndAccept())
+	assert.Nil(t, tr.Close())
+}
+
+func TestHeartbeat(t *testing.T) {
+	network := NewMemNetwork()
+	opts := TCPTransportOpts{
+		ListenAddr:        ":3000",
+		HandshakeFunc:     VersionHandshake(VersionHandshakeOpts{MinVersion: 1, MaxVersion: 1, Features: FeatureHeartbeat}),
+		Decoder:           DefaultDecoder{},
+		HeartbeatInterval: 20 * time.Millisecond,
+	}
+	a := NewMemTransport(network, opts)
+	peers := make(chan Peer, 1)
+	gone := make(chan Peer, 1)
+	opts.ListenAddr = ":4000"
+	opts.OnPeer = func(p Peer) error {
+		peers <- p
+		return nil
+	}
+	opts.OnPeerDisconnect = func(p Peer) {
+		gone <- p
+	}
+	opts.Metrics = metrics.NewRegistry()
+	b := NewMemTransport(network, opts)
+	assert.Nil(t, a.ListenAndAccept())
+	defer a.Close()
+	assert.Nil(t, b.ListenAndAccept())
+	defer b.Close()
+
+	assert.Nil(t, b.Dial(":3000"))
+	peer := <-peers
+	assert.True(t, peer.Protocol().Features.Has(FeatureHeartbeat))
+	assert.Eventually(t, func() bool { return peer.RTT() > 0 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1.0, b.metrics.connections.With("outbound").Value())
+	assert.NotZero(t, b.metrics.rtt.Count())
+	stats := peer.Stats()
+	assert.False(t, stats.ConnectedAt.IsZero())
+	assert.NotZero(t, stats.BytesSent)
+	assert.NotZero(t, stats.BytesReceived)
+
+	// A quiet peer is kept as long as it answers the heartbeats.
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-gone:
+		t.Fatal("the peer was dropped while answering the heartbeats")
+	default:
+	}
+
+	// Once the heartbeats stop coming through, as when its host lost power, the peer is dropped.
+	network.Partition(":3000", ":4000")
+	select {
+	case p := <-gone:
+		assert.Equal(t, peer, p)
+		assert.Equal(t, 0.0, b.metrics.connections.With("outbound").Value())
+	case <-time.After(time.Second):
+		t.Fatal("the peer was never dropped")
+	}
+}
+
+func TestPeerStreamHoldsHeartbeats(t *testing.T) {
+	dialer, accepted := memConnPair(t, NewMemNetwork())
+	defer dialer.Close()
+	defer accepted.Close()
+	peer := NewTCPPeer(dialer, true)
+
+	w, err := peer.OpenStream()
+	assert.Nil(t, err)
+	_, err = w.Write([]byte{IncomingStream, 'a'})
+	assert.Nil(t, err)
+	// The ping is skipped while the stream is open, and goes through once it is closed.
+	assert.Nil(t, peer.sendControl(IncomingPing, make([]byte, 8)))
+	assert.Nil(t, w.Close())
+	assert.Nil(t, w.Close())
+	assert.Nil(t, peer.sendControl(IncomingPing, make([]byte, 8)))
+
+	buf := make([]byte, 11)
+	_, err = io.ReadFull(accepted, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{IncomingStream, 'a', IncomingPing}, buf[:3])
 }
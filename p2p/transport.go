@@ -1,12 +1,35 @@
 package p2p
 
-import "net"
+import (
+	"io"
+	"net"
+	"time"
+)
 
 // Peer is an interface that represents a remote node
 type Peer interface {
 	net.Conn
 	Send([]byte) error
 	CloseStream()
+	// NextStream waits for the next stream the peer sends and returns its reader, Close hands the
+	// connection back to the read loop and has to be called once the stream is read.
+	NextStream() (io.ReadCloser, error)
+	Outbound() bool
+	// OpenStream returns the writer for a message and the stream following it, Close marks their
+	// end. Transports that multiplex their connection send them on a stream of their own.
+	OpenStream() (io.WriteCloser, error)
+	// Protocol is what was agreed on with the peer in the handshake.
+	Protocol() Protocol
+	// RTT is the round trip time measured by the last heartbeat, zero before the first one.
+	RTT() time.Duration
+	Stats() PeerStats
+}
+
+// PeerStats are the counters of a connection to a peer.
+type PeerStats struct {
+	ConnectedAt   time.Time
+	BytesSent     int64
+	BytesReceived int64
 }
 
 // Transport is anything that handles the communication between nodes in the network.
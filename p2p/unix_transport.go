@@ -0,0 +1,135 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultSocketMode only lets the user running the node connect to its sockets.
+const DefaultSocketMode os.FileMode = 0600
+
+// UnixTransportOpts configures a UnixTransport, the ListenAddr and the addresses dialed are the
+// paths of the sockets.
+type UnixTransportOpts struct {
+	TCPTransportOpts
+	// Mode is the permissions of the socket file, which decide who can connect: 0600 keeps it to
+	// the user running the node, 0660 lets its group in as well, e.g. the app next to it in a pod.
+	// Zero uses DefaultSocketMode.
+	Mode os.FileMode
+}
+
+// UnixTransport is a TCPTransport over unix domain sockets, for nodes on the same host. The
+// framing and the handshake are the ones of TCP.
+type UnixTransport struct {
+	*TCPTransport
+}
+
+// NewUnixTransport returns a transport over unix sockets, the Listen and Dial of the options are
+// replaced.
+func NewUnixTransport(opts UnixTransportOpts) *UnixTransport {
+	mode := opts.Mode
+	if mode == 0 {
+		mode = DefaultSocketMode
+	}
+	tcpOpts := opts.TCPTransportOpts
+	tcpOpts.Listen = func(path string) (net.Listener, error) {
+		l, err := ListenUnix(path, mode)
+		if err != nil {
+			return nil, err
+		}
+		return &unixListener{Listener: l}, nil
+	}
+	tcpOpts.Dial = func(path string) (net.Conn, error) {
+		return net.Dial("unix", path)
+	}
+	return &UnixTransport{TCPTransport: NewTCPTransport(tcpOpts)}
+}
+
+// ListenUnix listens on the unix socket at path and sets its permissions to mode. A socket left
+// behind by a process that crashed is removed first, any other file in the way is an error. The
+// socket file is removed when the listener is closed.
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("listen unix %s: file exists and is not a socket", path)
+		}
+		// Only a socket nobody listens on is stale.
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("listen unix %s: address already in use", path)
+		}
+		os.Remove(path)
+	}
+
+	// The socket is made in a folder only we can enter and moved into place once it has its mode,
+	// nobody gets to connect to it with the permissions the umask gave it.
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".qs")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "s")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &unixSocket{Listener: l, path: path}, nil
+}
+
+// unixSocket is a listener on the socket moved to path, which is removed when it is closed.
+type unixSocket struct {
+	net.Listener
+	path string
+	once sync.Once
+}
+
+func (l *unixSocket) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixSocket) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(func() { os.Remove(l.path) })
+	return err
+}
+
+// unixListener names the connections it accepts. The dialer end of a unix socket has no address,
+// they would all be "@" and the peers are told apart by their address.
+type unixListener struct {
+	net.Listener
+	conns atomic.Int64
+}
+
+func (l *unixListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	remote := &net.UnixAddr{
+		Name: fmt.Sprintf("%s#%d", l.Addr(), l.conns.Add(1)),
+		Net:  "unix",
+	}
+	return &unixConn{Conn: conn, remote: remote}, nil
+}
+
+type unixConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *unixConn) RemoteAddr() net.Addr {
+	return c.remote
+}
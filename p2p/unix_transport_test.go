@@ -0,0 +1,93 @@
+package p2p
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnixTransport(t *testing.T) {
+	dir := t.TempDir()
+	opts := UnixTransportOpts{
+		TCPTransportOpts: TCPTransportOpts{
+			ListenAddr:    filepath.Join(dir, "a.sock"),
+			HandshakeFunc: NOPhandshakeFunc,
+			Decoder:       DefaultDecoder{},
+		},
+	}
+	peers := make(chan Peer, 1)
+	a := NewUnixTransport(opts)
+	opts.ListenAddr = filepath.Join(dir, "b.sock")
+	opts.Mode = 0660
+	opts.OnPeer = func(p Peer) error {
+		peers <- p
+		return nil
+	}
+	b := NewUnixTransport(opts)
+	assert.Nil(t, a.ListenAndAccept())
+	defer a.Close()
+	assert.Nil(t, b.ListenAndAccept())
+
+	fi, err := os.Stat(a.Addr())
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultSocketMode, fi.Mode().Perm())
+	fi, err = os.Stat(b.Addr())
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0660), fi.Mode().Perm())
+
+	assert.Nil(t, b.Dial(a.Addr()))
+	peer := <-peers
+	assert.True(t, peer.Outbound())
+	assert.Nil(t, peer.Send([]byte{IncomingMessage}))
+	assert.Nil(t, peer.Send([]byte("hello")))
+	select {
+	case rpc := <-a.Consume():
+		assert.Equal(t, "hello", string(rpc.Payload))
+		assert.Equal(t, a.Addr()+"#1", rpc.From)
+	case <-time.After(time.Second):
+		t.Fatal("the message never arrived")
+	}
+
+	// The socket goes away with the transport.
+	assert.Nil(t, b.Close())
+	_, err = os.Stat(b.Addr())
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "qs.sock")
+
+	l, err := ListenUnix(path, DefaultSocketMode)
+	assert.Nil(t, err)
+	_, err = ListenUnix(path, DefaultSocketMode)
+	assert.NotNil(t, err, "the socket is in use")
+
+	// The socket has its mode from the start, the folder it was made in is gone.
+	fi, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultSocketMode, fi.Mode().Perm())
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	conn, err := net.Dial("unix", path)
+	assert.Nil(t, err)
+	conn.Close()
+
+	// A socket left behind by a crash is replaced.
+	l.(*unixSocket).Listener.Close()
+	l, err = ListenUnix(path, DefaultSocketMode)
+	assert.Nil(t, err)
+	l.Close()
+
+	regular := filepath.Join(dir, "notes.txt")
+	assert.Nil(t, os.WriteFile(regular, []byte("keep me"), 0644))
+	_, err = ListenUnix(regular, DefaultSocketMode)
+	assert.NotNil(t, err)
+	_, err = os.Stat(regular)
+	assert.Nil(t, err)
+}
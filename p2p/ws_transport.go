@@ -0,0 +1,257 @@
+package p2p
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultWSPath is the path of the HTTP endpoint the nodes upgrade to a WebSocket on.
+const DefaultWSPath = "/qs"
+
+// WSTransportOpts configures a WSTransport. The ListenAddr is the host:port the HTTP server
+// listens on, the addresses dialed are a host:port or a ws:// or wss:// URL.
+type WSTransportOpts struct {
+	TCPTransportOpts
+	// Path is the endpoint upgraded to a WebSocket, DefaultWSPath when empty.
+	Path string
+	// TLSConfig serves and dials wss:// instead of ws://.
+	TLSConfig *tls.Config
+	// Mounted leaves the serving to an HTTP server of the caller, which routes Path to the
+	// transport, the ListenAddr is then only the address the server can be reached on.
+	Mounted bool
+}
+
+// WSTransport is a TCPTransport over WebSockets, for nodes that can only reach each other through
+// HTTP infrastructure. Every write is sent as a binary message, the framing and the handshake on
+// top are the ones of TCP. The dialer goes through the proxy of the environment, $HTTPS_PROXY.
+type WSTransport struct {
+	*TCPTransport
+	opts     WSTransportOpts
+	upgrader websocket.Upgrader
+
+	mu       sync.Mutex
+	listener *wsListener
+	server   *http.Server
+}
+
+// NewWSTransport returns a transport over WebSockets, the Listen and Dial of the options are
+// replaced.
+func NewWSTransport(opts WSTransportOpts) *WSTransport {
+	if len(opts.Path) == 0 {
+		opts.Path = DefaultWSPath
+	}
+	t := &WSTransport{
+		opts: opts,
+		upgrader: websocket.Upgrader{
+			// The nodes are not browsers, a handshake can be added to check who connects.
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+	tcpOpts := opts.TCPTransportOpts
+	tcpOpts.Listen = t.listen
+	tcpOpts.Dial = t.dial
+	t.TCPTransport = NewTCPTransport(tcpOpts)
+	return t
+}
+
+// URL returns the URL the transport is dialed on from addr, a host:port or a URL.
+func (t *WSTransport) URL(addr string) string {
+	if strings.HasPrefix(addr, "ws://") || strings.HasPrefix(addr, "wss://") {
+		return addr
+	}
+	scheme := "ws"
+	if t.opts.TLSConfig != nil {
+		scheme = "wss"
+	}
+	return scheme + "://" + addr + t.opts.Path
+}
+
+func (t *WSTransport) listen(addr string) (net.Listener, error) {
+	l := &wsListener{
+		addr:    wsAddr(t.URL(addr)),
+		conns:   make(chan net.Conn),
+		closech: make(chan struct{}),
+	}
+	t.mu.Lock()
+	t.listener = l
+	t.mu.Unlock()
+	if t.opts.Mounted {
+		return l, nil
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if t.opts.TLSConfig != nil {
+		ln = tls.NewListener(ln, t.opts.TLSConfig)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(t.opts.Path, t)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	l.onClose = func() { server.Close() }
+	go func() {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			t.log.Error("WebSocket server failed", "err", err)
+		}
+	}()
+	return l, nil
+}
+
+// ServeHTTP upgrades the request to a WebSocket and hands the connection to the transport, it is
+// how a Mounted transport is served.
+func (t *WSTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	l := t.listener
+	t.mu.Unlock()
+	if l == nil {
+		http.Error(w, "transport is not listening", http.StatusServiceUnavailable)
+		return
+	}
+
+	ws, err := t.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has answered the request already.
+		return
+	}
+	conn := newWSConn(ws, wsAddr(r.RemoteAddr))
+	select {
+	case l.conns <- conn:
+	case <-l.closech:
+		conn.Close()
+	}
+}
+
+func (t *WSTransport) dial(addr string) (net.Conn, error) {
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:  t.opts.TLSConfig,
+	}
+	ws, resp, err := dialer.Dial(t.URL(addr), nil)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("websocket dial %s: %s: %w", addr, resp.Status, err)
+		}
+		return nil, err
+	}
+	// The peer is known by the address it was dialed on, so it is redialed on it.
+	return newWSConn(ws, wsAddr(addr)), nil
+}
+
+type wsAddr string
+
+func (a wsAddr) Network() string { return "ws" }
+func (a wsAddr) String() string  { return string(a) }
+
+// wsListener hands the connections upgraded by ServeHTTP to the accept loop of the transport.
+type wsListener struct {
+	addr      wsAddr
+	conns     chan net.Conn
+	closech   chan struct{}
+	closeOnce sync.Once
+	onClose   func()
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closech:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *wsListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closech)
+		if l.onClose != nil {
+			l.onClose()
+		}
+	})
+	return nil
+}
+
+func (l *wsListener) Addr() net.Addr {
+	return l.addr
+}
+
+// wsConn is a WebSocket used as a byte stream, every write is a binary message and the reads go
+// through the messages one after the other.
+type wsConn struct {
+	ws     *websocket.Conn
+	remote net.Addr
+	// A WebSocket takes one reader and one writer at a time, the read loop of the transport and
+	// the consumer of a stream both read from the connection.
+	readMu  sync.Mutex
+	reader  io.Reader
+	writeMu sync.Mutex
+}
+
+func newWSConn(ws *websocket.Conn, remote net.Addr) *wsConn {
+	return &wsConn{ws: ws, remote: remote}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for {
+		if c.reader == nil {
+			_, r, err := c.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			c.reader = r
+		}
+		n, err := c.reader.Read(b)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) Close() error {
+	// WriteControl does not wait for a write in progress, so a peer that stopped reading can not
+	// keep the connection open.
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
@@ -0,0 +1,137 @@
+package p2p
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// wsPair connects a dialer to the transport listening on addr and returns the peer of the dialer.
+func wsPair(t *testing.T, listener *WSTransport, dialer *WSTransport, addr string) Peer {
+	peers := make(chan Peer, 1)
+	dialer.OnPeer = func(p Peer) error {
+		peers <- p
+		return nil
+	}
+	assert.Nil(t, dialer.Dial(addr))
+	t.Cleanup(func() { dialer.Close() })
+	select {
+	case peer := <-peers:
+		return peer
+	case <-time.After(time.Second):
+		t.Fatal("the dial did not make a peer")
+		return nil
+	}
+}
+
+func wsOpts(addr string) WSTransportOpts {
+	return WSTransportOpts{
+		TCPTransportOpts: TCPTransportOpts{
+			ListenAddr:    addr,
+			HandshakeFunc: NOPhandshakeFunc,
+			Decoder:       DefaultDecoder{},
+		},
+	}
+}
+
+func assertMessage(t *testing.T, tr Transport, want string) RPC {
+	select {
+	case rpc := <-tr.Consume():
+		assert.Equal(t, want, string(rpc.Payload))
+		return rpc
+	case <-time.After(time.Second):
+		t.Fatal("the message never arrived")
+		return RPC{}
+	}
+}
+
+func TestWSTransport(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	a := NewWSTransport(wsOpts(addr))
+	assert.Nil(t, a.ListenAndAccept())
+	defer a.Close()
+	b := NewWSTransport(wsOpts(""))
+
+	peer := wsPair(t, a, b, addr)
+	assert.True(t, peer.Outbound())
+	assert.Equal(t, addr, peer.RemoteAddr().String())
+
+	assert.Nil(t, peer.Send([]byte{IncomingMessage}))
+	assert.Nil(t, peer.Send([]byte("hello")))
+	assertMessage(t, a, "hello")
+
+	// Other endpoints of the HTTP server are not upgraded.
+	resp, err := http.Get("http://" + addr + "/other")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestWSTransportMounted(t *testing.T) {
+	srv := httptest.NewUnstartedServer(nil)
+	opts := wsOpts(srv.Listener.Addr().String())
+	opts.Mounted = true
+	a := NewWSTransport(opts)
+	srv.Config.Handler = a
+	srv.Start()
+	defer srv.Close()
+
+	streams := make(chan Peer, 1)
+	a.OnPeer = func(p Peer) error {
+		streams <- p
+		return nil
+	}
+	assert.Nil(t, a.ListenAndAccept())
+	defer a.Close()
+	b := NewWSTransport(wsOpts(""))
+	peer := wsPair(t, a, b, "ws"+strings.TrimPrefix(srv.URL, "http")+DefaultWSPath)
+	inbound := <-streams
+
+	// A stream is read off the connection by its consumer, across the messages it was sent in.
+	assert.Nil(t, peer.Send([]byte{IncomingStream}))
+	assert.Nil(t, peer.Send([]byte("some ")))
+	assert.Nil(t, peer.Send([]byte("bytes")))
+	buf := make([]byte, 10)
+	time.Sleep(50 * time.Millisecond)
+	_, err := io.ReadFull(inbound, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "some bytes", string(buf))
+	inbound.CloseStream()
+
+	assert.Nil(t, peer.Send([]byte{IncomingMessage}))
+	assert.Nil(t, peer.Send([]byte("after the stream")))
+	assertMessage(t, a, "after the stream")
+}
+
+func TestWSTransportTLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(nil)
+	opts := wsOpts(srv.Listener.Addr().String())
+	opts.Mounted = true
+	a := NewWSTransport(opts)
+	srv.Config.Handler = a
+	srv.StartTLS()
+	defer srv.Close()
+	assert.Nil(t, a.ListenAndAccept())
+	defer a.Close()
+
+	opts = wsOpts("")
+	opts.TLSConfig = &tls.Config{RootCAs: srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+	b := NewWSTransport(opts)
+	assert.Equal(t, "wss://"+a.Addr()+DefaultWSPath, b.URL(a.Addr()))
+	peer := wsPair(t, a, b, a.Addr())
+
+	assert.Nil(t, peer.Send([]byte{IncomingMessage}))
+	assert.Nil(t, peer.Send([]byte("hello")))
+	assertMessage(t, a, "hello")
+}
@@ -0,0 +1,160 @@
+package store
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Timestamp is a hybrid logical clock (HLC) timestamp, the physical time in nanoseconds
+// plus a logical counter that orders the events happening within the same nanosecond or
+// while the physical clock is behind the one of a peer.
+type Timestamp struct {
+	WallTime int64
+	Logical  uint32
+}
+
+func (t Timestamp) Less(other Timestamp) bool {
+	if t.WallTime != other.WallTime {
+		return t.WallTime < other.WallTime
+	}
+	return t.Logical < other.Logical
+}
+
+// String formats the timestamp as fixed width hex, so comparing two strings gives the
+// same result as comparing the timestamps.
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%016x%08x", t.WallTime, t.Logical)
+}
+
+// HLC hands out timestamps that never go backwards and that are always after every
+// timestamp received from a peer, even when the clocks of the nodes are skewed.
+type HLC struct {
+	mu   sync.Mutex
+	last Timestamp
+	now  func() int64
+}
+
+func NewHLC() *HLC {
+	return &HLC{
+		now: func() int64 { return time.Now().UnixNano() },
+	}
+}
+
+// Now returns the timestamp of a local event, like a write.
+func (c *HLC) Now() Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if pt := c.now(); pt > c.last.WallTime {
+		c.last = Timestamp{WallTime: pt}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// Update merges a timestamp received from a peer into the clock.
+func (c *HLC) Update(remote Timestamp) Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pt := c.now()
+	switch {
+	case pt > c.last.WallTime && pt > remote.WallTime:
+		c.last = Timestamp{WallTime: pt}
+	case remote.WallTime > c.last.WallTime:
+		c.last = Timestamp{WallTime: remote.WallTime, Logical: remote.Logical + 1}
+	case c.last.WallTime > remote.WallTime:
+		c.last.Logical++
+	default:
+		c.last.Logical = max(c.last.Logical, remote.Logical) + 1
+	}
+	return c.last
+}
+
+// Ordering is the result of comparing two vector clocks.
+type Ordering int
+
+const (
+	Equal Ordering = iota
+	Before
+	After
+	Concurrent
+)
+
+// VectorClock counts the writes of a key made by every node, it tells if one write
+// has seen the other (Before/After) or if they were made concurrently without knowing
+// of each other.
+type VectorClock map[string]uint64
+
+// Increment returns a copy of the clock with the counter of the node bumped.
+func (vc VectorClock) Increment(node string) VectorClock {
+	next := vc.Merge(nil)
+	next[node]++
+	return next
+}
+
+// Merge returns a clock which has seen everything both clocks have seen.
+func (vc VectorClock) Merge(other VectorClock) VectorClock {
+	merged := make(VectorClock, len(vc))
+	for node, n := range vc {
+		merged[node] = n
+	}
+	for node, n := range other {
+		if n > merged[node] {
+			merged[node] = n
+		}
+	}
+	return merged
+}
+
+func (vc VectorClock) Compare(other VectorClock) Ordering {
+	var before, after bool
+	for node, n := range vc {
+		if n > other[node] {
+			after = true
+		}
+	}
+	for node, n := range other {
+		if n > vc[node] {
+			before = true
+		}
+	}
+	switch {
+	case before && after:
+		return Concurrent
+	case before:
+		return Before
+	case after:
+		return After
+	}
+	return Equal
+}
+
+// VersionMeta is stored with every version and travels with it over the network, it is
+// what replicas use to agree on the winner of concurrent writes.
+type VersionMeta struct {
+	// Timestamp orders the versions, the latest one wins (last-writer-wins).
+	Timestamp Timestamp
+	// Node is the ID of the node that made the write, it breaks ties between equal timestamps.
+	Node string
+	// Clock tells apart versions that overwrote each other from concurrent ones (siblings).
+	Clock VectorClock
+}
+
+// FormatVersionID builds the version ID of a write, the IDs sort in the same order as the
+// timestamps which is how every replica agrees on which version is the latest. The node ID ends
+// up in the ID as hex, an ID that is not hex already, like "node-a", is hashed first.
+func FormatVersionID(ts Timestamp, node string) string {
+	if len(node) == 0 || !isHex(node) {
+		sum := sha1.Sum([]byte(node))
+		node = hex.EncodeToString(sum[:])
+	}
+	if len(node) > 8 {
+		node = node[:8]
+	}
+	return fmt.Sprintf("%s-%s", ts, node)
+}
@@ -0,0 +1,53 @@
+package store
+
+import "testing"
+
+func TestHLC(t *testing.T) {
+	var wall int64 = 100
+	c := NewHLC()
+	c.now = func() int64 { return wall }
+
+	t1 := c.Now()
+	t2 := c.Now()
+	if !t1.Less(t2) {
+		t.Errorf("expected %s to be before %s", t1, t2)
+	}
+
+	// A peer with a clock running ahead pushes the local clock forward.
+	remote := Timestamp{WallTime: 500, Logical: 3}
+	t3 := c.Update(remote)
+	if !remote.Less(t3) {
+		t.Errorf("expected %s to be after the remote %s", t3, remote)
+	}
+	t4 := c.Now()
+	if !t3.Less(t4) || t4.WallTime != 500 {
+		t.Errorf("expected %s to stay ahead of %s", t4, t3)
+	}
+	if t3.String() >= t4.String() {
+		t.Errorf("expected the string form to sort like the timestamps")
+	}
+
+	wall = 1000
+	if t5 := c.Now(); t5 != (Timestamp{WallTime: 1000}) {
+		t.Errorf("expected the physical time to take over, have %s", t5)
+	}
+}
+
+func TestVectorClockCompare(t *testing.T) {
+	a := VectorClock{}.Increment("a")
+	b := a.Increment("b")
+	c := a.Increment("c")
+
+	if a.Compare(b) != Before || b.Compare(a) != After {
+		t.Error("expected a to be before b")
+	}
+	if b.Compare(c) != Concurrent {
+		t.Error("expected b and c to be concurrent")
+	}
+	if b.Compare(b.Merge(nil)) != Equal {
+		t.Error("expected a copy to be equal")
+	}
+	if m := b.Merge(c); m.Compare(b) != After || m.Compare(c) != After {
+		t.Error("expected the merge to be after both clocks")
+	}
+}
@@ -0,0 +1,402 @@
+// Package store keeps the files of a node on its local disk, every key is laid out by a
+// PathTansformFunc under the root and can keep several versions, see StoreOpts.
+package store
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ashirwad-maker/quantumsync/crypto"
+	"github.com/ashirwad-maker/quantumsync/metrics"
+)
+
+const DefaultFolderName = "quantumsyncnetwork"
+
+// tempSuffix marks the files that are still being written.
+const tempSuffix = ".tmp"
+
+func CASPathTransformFunc(key string) Pathkey {
+	hash := sha1.Sum([]byte(key))
+
+	// sha1.Sum() returns a [20]byte array and to convert it to a
+	// slice => hash[:]
+	hashStr := hex.EncodeToString(hash[:])
+
+	blockSize := 5
+	sliceLength := len(hashStr) / blockSize
+
+	// Converting a key number of folders and finally merging them to create a path .
+	paths := make([]string, sliceLength)
+	for i := 0; i < sliceLength; i++ {
+		from, to := i*blockSize, (i+1)*blockSize
+		paths[i] = hashStr[from:to]
+	}
+
+	return Pathkey{
+		PathName: strings.Join(paths, "/"),
+		Filename: hashStr,
+	}
+}
+
+type PathTansformFunc func(string) Pathkey
+
+type Pathkey struct {
+	PathName string
+	Filename string
+}
+
+// This function is required as os.RemoveAll() removes the folder and all its childern,
+// so this functions gives the folder where the storage starts.
+func (p Pathkey) FirstPathName() string {
+	paths := strings.Split(p.PathName, "/")
+	if len(paths) == 0 {
+		return ""
+	}
+	return paths[0]
+}
+
+func (p Pathkey) FullPath() string {
+	return fmt.Sprintf("%s/%s", p.PathName, p.Filename)
+}
+
+// ErrInvalidKey is returned for a key that would lead out of the folder of the store, one that
+// is absolute or has a ".." in it. The keys come from the peers and the clients, and without
+// the CAS transform they are the paths of the files.
+var ErrInvalidKey = errors.New("invalid key")
+
+// ValidateKey checks that the key stays under the root whatever PathTansformFunc lays it out.
+func ValidateKey(key string) error {
+	if len(key) == 0 || strings.HasPrefix(key, "/") || strings.HasPrefix(key, `\`) || filepath.IsAbs(key) {
+		return fmt.Errorf("%w (%s)", ErrInvalidKey, key)
+	}
+	for _, part := range strings.FieldsFunc(key, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return fmt.Errorf("%w (%s)", ErrInvalidKey, key)
+		}
+	}
+	return nil
+}
+
+// StoreOpts configures a Store, NewStore fills in the defaults of the zero values.
+type StoreOpts struct {
+	// Root is the folder name of the root, contaning all the folders/files of the system.
+	Root string
+	// ID of the owner of the storage, which will be used to store all the files at that location
+	//	so that we can sync all the files if needed.
+	ID               string
+	PathTansformFunc PathTansformFunc
+
+	// Versioning keeps every write of a key as its own version instead of overwriting the file.
+	Versioning bool
+	// MaxVersions and MaxVersionAge are the retention policy of the versions of a key, the
+	// latest version is always kept. Zero means no limit.
+	MaxVersions   int
+	MaxVersionAge time.Duration
+	// KeepSiblings keeps the versions written concurrently out of the retention policy.
+	KeepSiblings bool
+	// Logger gets the logs of the store, nil drops them.
+	Logger *slog.Logger
+	// Metrics is the registry the writes and the disk usage are counted in, nil counts them in
+	// one of the store's own.
+	Metrics *metrics.Registry
+}
+
+var DefaultPathTransformFunc = func(key string) Pathkey {
+	return Pathkey{
+		PathName: key,
+		Filename: key,
+	}
+}
+
+// Store reads and writes the files of a node under StoreOpts.Root.
+type Store struct {
+	StoreOpts
+	metrics storeMetrics
+}
+
+type storeMetrics struct {
+	writes       *metrics.Counter
+	writeErrors  *metrics.Counter
+	bytesWritten *metrics.Counter
+	deletes      *metrics.Counter
+}
+
+// NewStore returns a Store, the root defaults to DefaultFolderName and the ID to a random one.
+func NewStore(opts StoreOpts) *Store {
+	if opts.PathTansformFunc == nil {
+		opts.PathTansformFunc = DefaultPathTransformFunc
+	}
+	if len(opts.Root) == 0 {
+		opts.Root = DefaultFolderName
+	}
+	if len(opts.ID) == 0 {
+		opts.ID = crypto.GenerateID()
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	if opts.Metrics == nil {
+		opts.Metrics = metrics.NewRegistry()
+	}
+	s := &Store{
+		StoreOpts: opts,
+		metrics: storeMetrics{
+			writes:       opts.Metrics.Counter("qs_store_writes_total", "Files written to disk."),
+			writeErrors:  opts.Metrics.Counter("qs_store_write_errors_total", "Files that could not be written to disk."),
+			bytesWritten: opts.Metrics.Counter("qs_store_written_bytes_total", "Bytes of the files written to disk."),
+			deletes:      opts.Metrics.Counter("qs_store_deletes_total", "Keys deleted from disk."),
+		},
+	}
+	// The disk usage is worked out when scraped, it walks the folder of the node.
+	opts.Metrics.GaugeFunc("qs_store_disk_usage_bytes", "Bytes used on disk by the files, their versions and metadata.", func() float64 {
+		n, _ := s.DiskUsage()
+		return float64(n)
+	})
+	return s
+}
+
+// DiskUsage returns the bytes taken by the files of the node, the folder named after its ID. What
+// else is kept under the root, like the hints of the node, is not counted.
+func (s *Store) DiskUsage() (int64, error) {
+	var n int64
+	err := filepath.WalkDir(filepath.Join(s.Root, s.ID), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			n += info.Size()
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (s *Store) Clear() error {
+	return os.RemoveAll(s.Root)
+}
+
+func (s *Store) Delete(key string) error {
+	pathKey, err := s.pathKey(key)
+	if err != nil {
+		return err
+	}
+	firstPathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, s.ID, pathKey.FirstPathName())
+
+	err = os.RemoveAll(firstPathNameWithRoot)
+	s.metrics.deletes.Inc()
+	s.Logger.Debug("file deleted", "path", pathKey.Filename, "err", err)
+	return err
+}
+
+// pathKey lays out the key once it is checked.
+func (s *Store) pathKey(key string) (Pathkey, error) {
+	if err := ValidateKey(key); err != nil {
+		return Pathkey{}, err
+	}
+	return s.PathTansformFunc(key), nil
+}
+
+func (s *Store) Has(key string) bool {
+	pathKey, err := s.pathKey(key)
+	if err != nil {
+		return false
+	}
+	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, s.ID, pathKey.FullPath())
+	_, err = os.Stat(fullPathWithRoot)
+	if !errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	return s.HasVersion(key, "")
+}
+
+// Write stores the data of the key, with versioning enabled every write creates a new version.
+func (s *Store) Write(key string, r io.Reader) (int64, error) {
+	return s.writeStream(key, r)
+}
+
+// openFileForWriting creates the file of the key, or the file of the given version of the key
+// when versioning is enabled. An empty version creates a new one, meta is stored along the version.
+func (s *Store) openFileForWriting(key string, version string, meta *VersionMeta) (*os.File, string, error) {
+	pathKey, err := s.pathKey(key)
+	if err != nil {
+		return nil, "", err
+	}
+	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, s.ID, pathKey.PathName)
+	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, s.ID, pathKey.FullPath())
+	if s.Versioning {
+		if len(version) == 0 {
+			version = NewVersionID(s.ID)
+		}
+		path, err := s.versionPath(key, version)
+		if err != nil {
+			return nil, "", err
+		}
+		pathNameWithRoot, _ = s.versionsPath(key)
+		fullPathWithRoot = path
+	}
+	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
+		return nil, "", err
+	}
+	if s.Versioning {
+		if err := s.writeVersionKey(key); err != nil {
+			return nil, "", err
+		}
+	}
+	if s.Versioning && meta != nil {
+		if err := s.writeVersionMeta(key, version, meta); err != nil {
+			return nil, "", err
+		}
+	}
+	// The data goes to a temporary file that commitFile moves in place once it is complete.
+	f, err := os.Create(tempPath(fullPathWithRoot))
+	if err != nil {
+		return nil, "", err
+	}
+	return f, fullPathWithRoot, err
+}
+
+// tempPath is where a file is written before it is complete, the leading dot keeps it out of the
+// version listings.
+func tempPath(fullPathWithRoot string) string {
+	dir, file := filepath.Split(fullPathWithRoot)
+	return filepath.Join(dir, "."+file+tempSuffix)
+}
+
+// commitFile flushes the file opened by openFileForWriting to disk and moves it in place, a write
+// cut short by an error or a shutdown never leaves a partial file behind.
+func commitFile(f *os.File, fullPathWithRoot string) error {
+	if err := f.Sync(); err != nil {
+		abortFile(f)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), fullPathWithRoot)
+}
+
+func abortFile(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// Flush removes the temporary files of the writes that never completed.
+func (s *Store) Flush() error {
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(d.Name(), tempSuffix) {
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *Store) WriteDecrypt(encKey []byte, key string, r io.Reader) (int64, error) {
+	return s.WriteDecryptVersion(encKey, key, "", nil, r)
+}
+
+// WriteDecryptVersion decrypts r into the given version of the key.
+func (s *Store) WriteDecryptVersion(encKey []byte, key string, version string, meta *VersionMeta, r io.Reader) (int64, error) {
+	f, fullPathWithRoot, err := s.openFileForWriting(key, version, meta)
+	if err != nil {
+		s.metrics.writeErrors.Inc()
+		return 0, err
+	}
+	n, err := crypto.CopyDecrypt(encKey, r, f)
+	if err != nil {
+		abortFile(f)
+		s.metrics.writeErrors.Inc()
+		return 0, err
+	}
+	if err := commitFile(f, fullPathWithRoot); err != nil {
+		s.metrics.writeErrors.Inc()
+		return 0, err
+	}
+	s.metrics.writes.Inc()
+	s.metrics.bytesWritten.Add(float64(n - 16))
+	s.Logger.Debug("file written", "path", fullPathWithRoot, "bytes", n-16)
+	return ((int64)(n)), s.PruneVersions(key)
+}
+
+func (s *Store) writeStream(key string, r io.Reader) (int64, error) {
+	return s.writeVersionStream(key, "", nil, r)
+}
+
+func (s *Store) writeVersionStream(key string, version string, meta *VersionMeta, r io.Reader) (int64, error) {
+
+	f, fullPathWithRoot, err := s.openFileForWriting(key, version, meta)
+	if err != nil {
+		s.metrics.writeErrors.Inc()
+		return 0, err
+	}
+
+	// io.Copy() keeps on copying from the souce till the EOF is not found, leading to a blocking and disallowing streaming.
+	// Therefor a io.LimitReader is passed while calling.
+
+	n, err := io.Copy(f, r)
+	if err != nil {
+		abortFile(f)
+		s.metrics.writeErrors.Inc()
+		return 0, err
+	}
+	if err := commitFile(f, fullPathWithRoot); err != nil {
+		s.metrics.writeErrors.Inc()
+		return 0, err
+	}
+	s.metrics.writes.Inc()
+	s.metrics.bytesWritten.Add(float64(n))
+	s.Logger.Debug("file written", "path", fullPathWithRoot, "bytes", n)
+	return n, s.PruneVersions(key)
+}
+
+func (s *Store) Read(key string) (int64, io.Reader, error) {
+	return s.readStream(key)
+}
+
+func (s *Store) readStream(key string) (int64, io.ReadCloser, error) {
+	pathkey, err := s.pathKey(key)
+	if err != nil {
+		return 0, nil, err
+	}
+	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, s.ID, pathkey.FullPath())
+	if s.HasVersion(key, "") {
+		_, size, r, err := s.ReadVersion(key, "")
+		return size, r, err
+	}
+	return s.readFile(fullPathWithRoot)
+}
+
+func (s *Store) readFile(fullPathWithRoot string) (int64, io.ReadCloser, error) {
+	fi, err := os.Stat(fullPathWithRoot)
+	if err != nil {
+		return 0, nil, err
+	}
+	file, err := os.Open(fullPathWithRoot)
+	if err != nil {
+		return 0, nil, err
+	}
+	return fi.Size(), file, nil
+}
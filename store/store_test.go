@@ -0,0 +1,358 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPathTransformFunc(t *testing.T) {
+	key := "HelloWorld"
+	Pathkey := CASPathTransformFunc(key)
+	expectedPath := "db8ac/1c259/eb89d/4a131/b253b/acfca/5f319/d54f2"
+	expectedOriginalKey := "db8ac1c259eb89d4a131b253bacfca5f319d54f2"
+	if Pathkey.PathName != expectedPath {
+		t.Error(t, "have %s want this %s", expectedPath, Pathkey.PathName)
+	}
+	if Pathkey.Filename != expectedOriginalKey {
+		t.Error(t, "have %s want this %s", expectedOriginalKey, Pathkey.Filename)
+	}
+	fmt.Println(Pathkey)
+}
+
+func TestStoreDeleteKey(t *testing.T) {
+	s := newStore()
+	key := "myspecialpicture"
+	data := []byte("some jpeg bytes")
+	if _, err := s.writeStream(key, bytes.NewReader(data)); err != nil {
+		t.Error(err)
+	}
+	if err := s.Delete(key); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestStore function is responsible for testing the whole store.go functionalities
+// 50 times with different keys.
+func TestStore(t *testing.T) {
+	opts := StoreOpts{
+		PathTansformFunc: CASPathTransformFunc,
+	}
+	s := NewStore(opts)
+
+	defer teardown(t, s)
+	for count := 0; count < 50; count++ {
+
+		key := fmt.Sprintf("myspecialpicture %d", count)
+		data := []byte("some jpeg bytes")
+		if _, err := s.writeStream(key, bytes.NewReader(data)); err != nil {
+			t.Error(err)
+		}
+
+		if ok := s.Has(key); !ok {
+			t.Errorf("expected to have the key %s", key)
+		}
+
+		_, r, err := s.Read(key)
+		if err != nil {
+			t.Error(err)
+		}
+		b, _ := ioutil.ReadAll(r)
+
+		if string(b) != string(data) {
+			t.Errorf("want %s have %s", string(data), string(b))
+		}
+		// fmt.Println(string(b))
+		if err := s.Delete(key); err != nil {
+			t.Error(err)
+		}
+
+		if ok := s.Has(key); ok {
+			t.Errorf("expected to NOT have the key: %s", key)
+		}
+	}
+
+}
+
+func newStore() *Store {
+	opts := StoreOpts{
+		PathTansformFunc: CASPathTransformFunc,
+	}
+	return NewStore(opts)
+
+}
+
+func teardown(t *testing.T, s *Store) {
+	if err := s.Clear(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStoreVersions(t *testing.T) {
+	opts := StoreOpts{
+		Root:             t.TempDir(),
+		PathTansformFunc: CASPathTransformFunc,
+		Versioning:       true,
+		MaxVersions:      3,
+	}
+	s := NewStore(opts)
+	key := "myspecialpicture"
+
+	for count := 0; count < 5; count++ {
+		data := fmt.Sprintf("some jpeg bytes %d", count)
+		if _, err := s.Write(key, bytes.NewReader([]byte(data))); err != nil {
+			t.Error(err)
+		}
+	}
+
+	versions, err := s.ListVersions(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("expected 3 versions to be retained, have %d", len(versions))
+	}
+
+	_, r, err := s.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(r)
+	if string(b) != "some jpeg bytes 4" {
+		t.Errorf("expected to read the latest version, have %s", string(b))
+	}
+
+	id, _, rc, err := s.ReadVersion(key, versions[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	b, _ = ioutil.ReadAll(rc)
+	if id != versions[0].ID || string(b) != "some jpeg bytes 2" {
+		t.Errorf("want (%s) some jpeg bytes 2 have (%s) %s", versions[0].ID, id, string(b))
+	}
+
+	// A replica writes the version under the ID it got over the network.
+	if _, err := s.WriteVersion(key, versions[0].ID, nil, bytes.NewReader([]byte("replica"))); err != nil {
+		t.Error(err)
+	}
+	latest, err := s.LatestVersion(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.ID != versions[2].ID {
+		t.Errorf("an older version must not become the latest, want %s have %s", versions[2].ID, latest.ID)
+	}
+
+	if err := s.Delete(key); err != nil {
+		t.Error(err)
+	}
+	if s.Has(key) {
+		t.Errorf("expected to NOT have the key: %s", key)
+	}
+}
+
+func TestStoreVersionsNodeID(t *testing.T) {
+	for _, id := range []string{"node-a", "NODEA", "f289ef0501eb5c24"} {
+		s := NewStore(StoreOpts{Root: t.TempDir(), ID: id, PathTansformFunc: CASPathTransformFunc, Versioning: true})
+		if _, err := s.Write("myspecialpicture", bytes.NewReader([]byte("some jpeg bytes"))); err != nil {
+			t.Fatalf("%s: %s", id, err)
+		}
+		latest, err := s.LatestVersion("myspecialpicture")
+		if err != nil {
+			t.Fatalf("%s: %s", id, err)
+		}
+		if err := ValidateVersionID(latest.ID); err != nil {
+			t.Errorf("%s: %s", id, err)
+		}
+	}
+
+	// A hex node ID is kept as is, the others are hashed, and the node part stays the same.
+	ts := Timestamp{WallTime: 1}
+	if id := FormatVersionID(ts, "f289ef0501eb5c24"); !strings.HasSuffix(id, "-f289ef05") {
+		t.Errorf("want the hex node ID kept have %s", id)
+	}
+	if FormatVersionID(ts, "node-a") != FormatVersionID(ts, "node-a") || FormatVersionID(ts, "node-a") == FormatVersionID(ts, "node-b") {
+		t.Error("want the node part to follow the node ID")
+	}
+}
+
+func TestStoreSiblings(t *testing.T) {
+	opts := StoreOpts{
+		Root:             t.TempDir(),
+		PathTansformFunc: CASPathTransformFunc,
+		Versioning:       true,
+		MaxVersions:      1,
+		KeepSiblings:     true,
+	}
+	s := NewStore(opts)
+	key := "myspecialpicture"
+	clock := NewHLC()
+
+	write := func(node string, vc VectorClock) string {
+		meta := &VersionMeta{Timestamp: clock.Now(), Node: node, Clock: vc}
+		version := FormatVersionID(meta.Timestamp, node)
+		if _, err := s.WriteVersion(key, version, meta, bytes.NewReader([]byte(node))); err != nil {
+			t.Fatal(err)
+		}
+		return version
+	}
+
+	write("a", VectorClock{"a": 1})
+	write("b", VectorClock{"a": 1, "b": 1})
+	siblings, err := s.Siblings(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(siblings) != 0 {
+		t.Errorf("an overwritten version is not a sibling, have %d siblings", len(siblings))
+	}
+
+	// c did not see the write of b.
+	concurrent := write("c", VectorClock{"a": 1, "c": 1})
+	siblings, err = s.Siblings(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(siblings) != 2 {
+		t.Fatalf("expected 2 siblings to be kept, have %d", len(siblings))
+	}
+	if latest, _ := s.LatestVersion(key); latest.ID != concurrent {
+		t.Errorf("expected the last writer to be the latest version, want %s have %s", concurrent, latest.ID)
+	}
+
+	write("a", VectorClock{"a": 2, "b": 1, "c": 1})
+	versions, err := s.ListVersions(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 {
+		t.Errorf("expected the write that has seen both siblings to resolve them, have %d versions", len(versions))
+	}
+}
+
+func TestStoreVersionTraversal(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secret, []byte("not for the peers"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := NewStore(StoreOpts{
+		Root:             filepath.Join(dir, "root"),
+		PathTansformFunc: CASPathTransformFunc,
+		Versioning:       true,
+	})
+	key := "myspecialpicture"
+	if _, err := s.Write(key, bytes.NewReader([]byte("some jpeg bytes"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Enough "../" to get from the versions of the key to the folder holding the root.
+	versions, _ := s.versionsPath(key)
+	rel, err := filepath.Rel(dir, versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := strings.Repeat("../", len(strings.Split(rel, string(filepath.Separator))))
+
+	for _, version := range []string{up + "secret", up + "escape", "/etc/passwd", `..\..\secret`, "000000000000000000000000-a/b", "v1"} {
+		if _, _, _, err := s.ReadVersion(key, version); !errors.Is(err, ErrInvalidVersion) {
+			t.Errorf("want %v reading (%s) have %v", ErrInvalidVersion, version, err)
+		}
+		if s.HasVersion(key, version) {
+			t.Errorf("want no version (%s)", version)
+		}
+		if _, err := s.ReadVersionMeta(key, version); !errors.Is(err, ErrInvalidVersion) {
+			t.Errorf("want %v reading the metadata of (%s) have %v", ErrInvalidVersion, version, err)
+		}
+		if err := s.DeleteVersion(key, version); !errors.Is(err, ErrInvalidVersion) {
+			t.Errorf("want %v deleting (%s) have %v", ErrInvalidVersion, version, err)
+		}
+		if _, err := s.WriteVersion(key, version, &VersionMeta{}, bytes.NewReader([]byte("evil"))); !errors.Is(err, ErrInvalidVersion) {
+			t.Errorf("want %v writing (%s) have %v", ErrInvalidVersion, version, err)
+		}
+	}
+
+	if b, _ := os.ReadFile(secret); string(b) != "not for the peers" {
+		t.Errorf("the file outside the root was changed: %s", b)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape")); !errors.Is(err, os.ErrNotExist) {
+		t.Error("a file was written outside the root")
+	}
+	if err := ValidateVersionID(FormatVersionID(NewHLC().Now(), s.ID)); err != nil {
+		t.Errorf("want the IDs made by FormatVersionID valid have %v", err)
+	}
+}
+
+func TestStoreKeyTraversal(t *testing.T) {
+	dir := t.TempDir()
+	s := NewStore(StoreOpts{
+		Root:             filepath.Join(dir, "root"),
+		PathTansformFunc: DefaultPathTransformFunc,
+	})
+	if _, err := s.Write("myspecialpicture", bytes.NewReader([]byte("some jpeg bytes"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the CAS transform the key is the path of the file, a ".." would lead out of the root.
+	for _, key := range []string{"..", "../x", "a/../../x", `..\x`, "/etc/passwd", `\x`, ""} {
+		if err := s.Delete(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("want %v deleting (%s) have %v", ErrInvalidKey, key, err)
+		}
+		if _, err := s.Write(key, bytes.NewReader([]byte("evil"))); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("want %v writing (%s) have %v", ErrInvalidKey, key, err)
+		}
+		if _, _, err := s.Read(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("want %v reading (%s) have %v", ErrInvalidKey, key, err)
+		}
+		if _, err := s.ListVersions(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("want %v listing the versions of (%s) have %v", ErrInvalidKey, key, err)
+		}
+		if s.Has(key) {
+			t.Errorf("want no (%s)", key)
+		}
+	}
+	if !s.Has("myspecialpicture") {
+		t.Error("want the files of the store left alone")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "x")); !errors.Is(err, os.ErrNotExist) {
+		t.Error("a file was written outside the root")
+	}
+
+	for _, key := range []string{"pictures/a", "a..b", "..a", "./a"} {
+		if err := ValidateKey(key); err != nil {
+			t.Errorf("want (%s) valid have %v", key, err)
+		}
+	}
+}
+
+func TestStoreDiskUsage(t *testing.T) {
+	root := t.TempDir()
+	s := NewStore(StoreOpts{Root: root, PathTansformFunc: CASPathTransformFunc})
+	if _, err := s.Write("myspecialpicture", bytes.NewReader([]byte("some jpeg bytes"))); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := s.DiskUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage < int64(len("some jpeg bytes")) {
+		t.Errorf("want at least the bytes of the file have %d", usage)
+	}
+
+	// The files kept next to the node folder, like the hints, are not the store's.
+	if err := os.MkdirAll(filepath.Join(root, "hints"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "hints", "hint"), make([]byte, 1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if have, _ := s.DiskUsage(); have != usage {
+		t.Errorf("want %d have %d", usage, have)
+	}
+}
@@ -0,0 +1,343 @@
+package store
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// The versions of a key are kept in a folder next to where the unversioned file would be.
+	versionsSuffix = ".versions"
+	// The metadata of a version is kept next to it in a hidden file.
+	versionMetaSuffix = ".meta"
+	// The key of the versions is kept in a hidden file in the versions folder, as the path
+	// the key is transformed to can not be turned back into the key.
+	versionKeyFile = ".key"
+)
+
+// VersionInfo describes a single stored version of a key.
+type VersionInfo struct {
+	ID      string
+	Size    int64
+	ModTime time.Time
+	// Meta is nil for versions that were written without metadata.
+	Meta *VersionMeta
+}
+
+// The clock used for the versions created directly through the store.
+var defaultClock = NewHLC()
+
+// NewVersionID returns a new version ID for a write made by the node with the given ID.
+func NewVersionID(node string) string {
+	return FormatVersionID(defaultClock.Now(), node)
+}
+
+// ErrInvalidVersion is returned for a version ID FormatVersionID could not have made. The IDs
+// come from the peers and the clients and end up in the paths of the files, so anything else,
+// like an ID with a "/" or "..", is turned down before it gets near the disk.
+var ErrInvalidVersion = errors.New("invalid version")
+
+// ValidateVersionID checks that the version has the shape of the IDs made by FormatVersionID,
+// the hex timestamp followed by up to 8 hex digits of the node ID.
+func ValidateVersionID(version string) error {
+	ts, node, ok := strings.Cut(version, "-")
+	if !ok || len(ts) != 24 || len(node) == 0 || len(node) > 8 || !isHex(ts) || !isHex(node) {
+		return fmt.Errorf("%w (%s)", ErrInvalidVersion, version)
+	}
+	return nil
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Store) versionsPath(key string) (string, error) {
+	pathKey, err := s.pathKey(key)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s/%s%s", s.Root, s.ID, pathKey.FullPath(), versionsSuffix), nil
+}
+
+// versionPath returns the path of the file of the version, once the ID is checked.
+func (s *Store) versionPath(key string, version string) (string, error) {
+	if err := ValidateVersionID(version); err != nil {
+		return "", err
+	}
+	dir, err := s.versionsPath(key)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s", dir, version), nil
+}
+
+func (s *Store) versionMetaPath(key string, version string) (string, error) {
+	if err := ValidateVersionID(version); err != nil {
+		return "", err
+	}
+	dir, err := s.versionsPath(key)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/.%s%s", dir, version, versionMetaSuffix), nil
+}
+
+// WriteVersion writes r as the given version of the key and applies the retention policy.
+// Replicas use it to store a version under the ID it was created with on the original node,
+// an empty version creates a new one. meta can be nil.
+func (s *Store) WriteVersion(key string, version string, meta *VersionMeta, r io.Reader) (int64, error) {
+	return s.writeVersionStream(key, version, meta, r)
+}
+
+func (s *Store) writeVersionMeta(key string, version string, meta *VersionMeta) error {
+	path, err := s.versionMetaPath(key, version)
+	if err != nil {
+		return err
+	}
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(meta); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// ReadVersionMeta returns the metadata stored with the version, nil if there is none.
+func (s *Store) ReadVersionMeta(key string, version string) (*VersionMeta, error) {
+	path, err := s.versionMetaPath(key, version)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta := new(VersionMeta)
+	return meta, gob.NewDecoder(bytes.NewReader(b)).Decode(meta)
+}
+
+// HasVersion reports if the version of the key exists, an empty version asks for any version.
+func (s *Store) HasVersion(key string, version string) bool {
+	if len(version) == 0 {
+		versions, _ := s.ListVersions(key)
+		return len(versions) > 0
+	}
+	path, err := s.versionPath(key, version)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+// ReadVersion reads the given version of the key, an empty version reads the latest one.
+// The ID of the version that was read is returned as well, which is empty for an unversioned key.
+func (s *Store) ReadVersion(key string, version string) (string, int64, io.ReadCloser, error) {
+	if len(version) == 0 && !s.HasVersion(key, "") {
+		size, r, err := s.readStream(key)
+		return "", size, r, err
+	}
+	if len(version) == 0 {
+		latest, err := s.LatestVersion(key)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		version = latest.ID
+	}
+	path, err := s.versionPath(key, version)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	size, r, err := s.readFile(path)
+	return version, size, r, err
+}
+
+// LatestVersion returns the newest version of the key.
+func (s *Store) LatestVersion(key string) (VersionInfo, error) {
+	versions, err := s.ListVersions(key)
+	if err != nil {
+		return VersionInfo{}, err
+	}
+	if len(versions) == 0 {
+		return VersionInfo{}, fmt.Errorf("no versions of (%s): %w", key, os.ErrNotExist)
+	}
+	return versions[len(versions)-1], nil
+}
+
+func (s *Store) writeVersionKey(key string) error {
+	dir, err := s.versionsPath(key)
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("%s/%s", dir, versionKeyFile)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	return os.WriteFile(path, []byte(key), 0644)
+}
+
+// Keys returns every key that has versions in the store. The peers only ever see the hash of
+// a key, so the keys stored on behalf of the peers are listed as such.
+func (s *Store) Keys() ([]string, error) {
+	var keys []string
+	root := fmt.Sprintf("%s/%s", s.Root, s.ID)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || !strings.HasSuffix(d.Name(), versionsSuffix) {
+			return nil
+		}
+		b, err := os.ReadFile(filepath.Join(path, versionKeyFile))
+		if err == nil {
+			keys = append(keys, string(b))
+		}
+		return filepath.SkipDir
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	sort.Strings(keys)
+	return keys, err
+}
+
+// ListVersions returns the versions of the key, oldest first.
+func (s *Store) ListVersions(key string) ([]VersionInfo, error) {
+	dir, err := s.versionsPath(key)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]VersionInfo, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || ValidateVersionID(e.Name()) != nil {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		meta, err := s.ReadVersionMeta(key, e.Name())
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, VersionInfo{
+			ID:      e.Name(),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+			Meta:    meta,
+		})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].ID < versions[j].ID })
+	return versions, nil
+}
+
+// Siblings returns the versions of the key that were written concurrently, none of them has
+// seen the others so there is no telling which one the writer meant to keep. It returns
+// nothing when the latest version has overwritten every other version.
+func (s *Store) Siblings(key string) ([]VersionInfo, error) {
+	versions, err := s.ListVersions(key)
+	if err != nil {
+		return nil, err
+	}
+	siblings := SiblingVersions(versions)
+	if len(siblings) < 2 {
+		return nil, nil
+	}
+	return siblings, nil
+}
+
+// SiblingVersions returns the versions that are not overwritten by any other version. Versions
+// without metadata are treated as overwritten by every version that comes after them.
+func SiblingVersions(versions []VersionInfo) []VersionInfo {
+	var siblings []VersionInfo
+	for i, v := range versions {
+		overwritten := false
+		for j, other := range versions {
+			if i == j {
+				continue
+			}
+			if v.Meta == nil || other.Meta == nil {
+				overwritten = j > i
+			} else {
+				overwritten = v.Meta.Clock.Compare(other.Meta.Clock) == Before
+			}
+			if overwritten {
+				break
+			}
+		}
+		if !overwritten {
+			siblings = append(siblings, v)
+		}
+	}
+	return siblings
+}
+
+// DeleteVersion removes a single version of the key.
+func (s *Store) DeleteVersion(key string, version string) error {
+	path, err := s.versionPath(key, version)
+	if err != nil {
+		return err
+	}
+	metaPath, _ := s.versionMetaPath(key, version)
+	os.Remove(metaPath)
+	return os.Remove(path)
+}
+
+// PruneVersions removes the versions of the key that fall outside of the retention policy.
+// With KeepSiblings set the siblings are kept until a write resolves them.
+func (s *Store) PruneVersions(key string) error {
+	if !s.Versioning || (s.MaxVersions <= 0 && s.MaxVersionAge <= 0) {
+		return nil
+	}
+	versions, err := s.ListVersions(key)
+	if err != nil {
+		return err
+	}
+
+	keep := make(map[string]bool)
+	if s.KeepSiblings {
+		for _, v := range SiblingVersions(versions) {
+			keep[v.ID] = true
+		}
+	}
+
+	// The last version is the latest one and never pruned.
+	for i, v := range versions[:max(len(versions)-1, 0)] {
+		if keep[v.ID] {
+			continue
+		}
+		tooMany := s.MaxVersions > 0 && len(versions)-i > s.MaxVersions
+		tooOld := s.MaxVersionAge > 0 && time.Since(v.ModTime) > s.MaxVersionAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := s.DeleteVersion(key, v.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
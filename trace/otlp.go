@@ -0,0 +1,281 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OTLPExporterOpts configures an OTLPExporter, the zero values of the tuning options keep their
+// defaults.
+type OTLPExporterOpts struct {
+	// Endpoint is the URL the spans are posted to, as http://localhost:4318/v1/traces for an
+	// OpenTelemetry collector.
+	Endpoint string
+	// Service is the service.name of the spans, quantumsync by default.
+	Service string
+	// The spans are sent BatchSize at a time, at least every Interval. QueueSize is the number of
+	// spans kept waiting, the ones ending once it is full are dropped.
+	BatchSize int
+	Interval  time.Duration
+	QueueSize int
+	Client    *http.Client
+	// Logger gets the errors of the posts, nil drops them.
+	Logger *slog.Logger
+}
+
+// OTLPExporter sends the spans to an OpenTelemetry collector, or anything else speaking OTLP over
+// HTTP, encoded in JSON. The spans are queued and sent in batches in the background.
+type OTLPExporter struct {
+	OTLPExporterOpts
+	mu      sync.Mutex
+	queue   []*SpanData
+	dropped int
+	flushch chan struct{}
+	quitch  chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+func NewOTLPExporter(opts OTLPExporterOpts) *OTLPExporter {
+	if len(opts.Service) == 0 {
+		opts.Service = "quantumsync"
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 512
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 5 * time.Second
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 2048
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	e := &OTLPExporter{
+		OTLPExporterOpts: opts,
+		flushch:          make(chan struct{}, 1),
+		quitch:           make(chan struct{}),
+		done:             make(chan struct{}),
+	}
+	go e.loop()
+	return e
+}
+
+func (e *OTLPExporter) ExportSpan(span *SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.queue) >= e.QueueSize {
+		e.dropped++
+		return
+	}
+	e.queue = append(e.queue, span)
+	if len(e.queue) >= e.BatchSize {
+		select {
+		case e.flushch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Shutdown sends the spans still queued and stops the exporter, it gives up when the context is
+// done first.
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	e.once.Do(func() {
+		close(e.quitch)
+	})
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *OTLPExporter) loop() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.flushch:
+		case <-e.quitch:
+			e.flush()
+			return
+		}
+		e.flush()
+	}
+}
+
+// flush sends everything queued, a batch that failed is dropped.
+func (e *OTLPExporter) flush() {
+	for {
+		e.mu.Lock()
+		n := min(len(e.queue), e.BatchSize)
+		batch := e.queue[:n:n]
+		e.queue = e.queue[n:]
+		dropped := e.dropped
+		e.dropped = 0
+		e.mu.Unlock()
+
+		if dropped > 0 {
+			e.Logger.Warn("trace queue full, spans dropped", "spans", dropped)
+		}
+		if n == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil {
+			e.Logger.Warn("could not export spans", "endpoint", e.Endpoint, "spans", n, "err", err)
+		}
+	}
+}
+
+func (e *OTLPExporter) send(spans []*SpanData) error {
+	body, err := json.Marshal(otlpRequest(e.Service, spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.Client.Post(e.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered (%s)", resp.Status)
+	}
+	return nil
+}
+
+// The JSON encoding of an ExportTraceServiceRequest of OTLP, the IDs are in hex and the 64 bit
+// integers in strings.
+type (
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+)
+
+// The span kinds and status codes of OTLP.
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+	otlpStatusError  = 2
+)
+
+func otlpRequest(service string, spans []*SpanData) otlpTraces {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.SpanContext.TraceID.String(),
+			SpanID:            s.SpanContext.SpanID.String(),
+			Name:              s.Name,
+			Kind:              otlpKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attrs),
+		}
+		if s.Parent.SpanID.IsValid() {
+			span.ParentSpanID = s.Parent.SpanID.String()
+		}
+		// The spans started for a message of a peer are serving its request.
+		if s.Parent.Remote {
+			span.Kind = otlpKindServer
+		}
+		if len(s.Err) > 0 {
+			span.Status = otlpStatus{Code: otlpStatusError, Message: s.Err}
+		}
+		out = append(out, span)
+	}
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttributes([]slog.Attr{slog.String("service.name", service)})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/ashirwad-maker/quantumsync"},
+			Spans: out,
+		}},
+	}}}
+}
+
+// otlpAttributes converts the attributes, the groups are flattened into dotted keys.
+func otlpAttributes(attrs []slog.Attr) []otlpKeyValue {
+	var kvs []otlpKeyValue
+	for _, a := range attrs {
+		v := a.Value.Resolve()
+		var value otlpValue
+		switch v.Kind() {
+		case slog.KindGroup:
+			for _, kv := range otlpAttributes(v.Group()) {
+				kv.Key = a.Key + "." + kv.Key
+				kvs = append(kvs, kv)
+			}
+			continue
+		case slog.KindBool:
+			b := v.Bool()
+			value.BoolValue = &b
+		case slog.KindInt64:
+			i := strconv.FormatInt(v.Int64(), 10)
+			value.IntValue = &i
+		case slog.KindUint64:
+			i := strconv.FormatUint(v.Uint64(), 10)
+			value.IntValue = &i
+		case slog.KindFloat64:
+			f := v.Float64()
+			value.DoubleValue = &f
+		default:
+			str := v.String()
+			value.StringValue = &str
+		}
+		kvs = append(kvs, otlpKeyValue{Key: a.Key, Value: value})
+	}
+	return kvs
+}
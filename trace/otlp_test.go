@@ -0,0 +1,87 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	bodies := make(chan []byte, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("want a JSON post to /v1/traces have %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer collector.Close()
+
+	exporter := NewOTLPExporter(OTLPExporterOpts{
+		Endpoint: collector.URL + "/v1/traces",
+		Service:  "qs-test",
+		Interval: time.Hour,
+	})
+	tracer := NewTracer(TracerOpts{Exporter: exporter})
+	ctx, root := tracer.Start(context.Background(), "store", slog.Int64("bytes", 42), slog.Bool("repair", false))
+	_, child := tracer.Start(ctx, "broadcast", slog.Group("peer", slog.String("addr", ":4000")))
+	child.SetError(io.ErrUnexpectedEOF)
+	child.End()
+	root.End()
+
+	// The spans queued are sent on shutdown.
+	if err := exporter.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var req struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpKeyValue `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	select {
+	case body := <-bodies:
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatal("want the spans posted on shutdown")
+	}
+
+	rs := req.ResourceSpans[0]
+	if a := rs.Resource.Attributes[0]; a.Key != "service.name" || *a.Value.StringValue != "qs-test" {
+		t.Errorf("want the service name in the resource have %+v", a)
+	}
+	spans := rs.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("want 2 spans have %d", len(spans))
+	}
+	broadcast, store := spans[0], spans[1]
+	if broadcast.TraceID != store.TraceID || broadcast.ParentSpanID != store.SpanID || len(store.ParentSpanID) != 0 {
+		t.Errorf("want the broadcast a child of the store, have %+v and %+v", broadcast, store)
+	}
+	if len(store.TraceID) != 32 || len(store.SpanID) != 16 {
+		t.Errorf("want hex IDs have %s %s", store.TraceID, store.SpanID)
+	}
+	if broadcast.Status.Code != otlpStatusError || broadcast.Status.Message != io.ErrUnexpectedEOF.Error() {
+		t.Errorf("want the error in the status have %+v", broadcast.Status)
+	}
+	if a := broadcast.Attributes[0]; a.Key != "peer.addr" || *a.Value.StringValue != ":4000" {
+		t.Errorf("want the group flattened have %+v", a)
+	}
+	if a := store.Attributes[0]; *a.Value.IntValue != "42" {
+		t.Errorf("want the int attribute in a string have %+v", a)
+	}
+	if a := store.Attributes[1]; a.Value.BoolValue == nil || *a.Value.BoolValue {
+		t.Errorf("want the false bool attribute kept have %+v", a)
+	}
+}
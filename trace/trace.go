@@ -0,0 +1,158 @@
+// Package trace follows a request across the nodes. A Tracer starts the spans, timed steps of the
+// work like a disk write or the copy of a stream to a peer, and the SpanContext of the span a
+// message was sent from travels with it, so the spans of the peer handling it join the same trace.
+//
+// The spans started by NewTracer are handed to an Exporter once they end: the OTLPExporter sends
+// them to an OpenTelemetry collector, the Recorder keeps them in memory for the tests. Nop, the
+// default, records nothing but still passes the SpanContext it is given along.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// TraceID is shared by the spans of a trace, SpanID is of a single span. The zero IDs are invalid.
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (id TraceID) IsValid() bool  { return id != TraceID{} }
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+func (id SpanID) IsValid() bool  { return id != SpanID{} }
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+func newTraceID() TraceID {
+	var id TraceID
+	rand.Read(id[:])
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	rand.Read(id[:])
+	return id
+}
+
+// SpanContext identifies a span across the nodes, it is what the messages carry.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// Sampled is set on the traces that are recorded, the nodes down the line only record the
+	// spans of those.
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent formats the span context as the traceparent header of W3C Trace Context.
+func (sc SpanContext) Traceparent() string {
+	flags := 0
+	if sc.Sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, flags)
+}
+
+var ErrInvalidTraceparent = errors.New("invalid traceparent")
+
+// ParseTraceparent reads a traceparent header, as sent by the HTTP clients that are traced.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || parts[0] == "ff" || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, fmt.Errorf("%w (%s)", ErrInvalidTraceparent, s)
+	}
+	// Only version 00 is known, the later ones are read as far as they agree with it.
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, fmt.Errorf("%w (%s)", ErrInvalidTraceparent, s)
+	}
+	var flags [1]byte
+	_, err1 := hex.Decode(sc.TraceID[:], []byte(parts[1]))
+	_, err2 := hex.Decode(sc.SpanID[:], []byte(parts[2]))
+	_, err3 := hex.Decode(flags[:], []byte(parts[3]))
+	if err := errors.Join(err1, err2, err3); err != nil || !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("%w (%s)", ErrInvalidTraceparent, s)
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+// Tracer starts the spans.
+type Tracer interface {
+	// Start starts a span named name, a child of the span of ctx, or of the remote span put in it
+	// by ContextWithRemote. The span returned is in the context returned, End has to be called
+	// once it is done.
+	Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, Span)
+}
+
+// Span is a timed step of the work on a request.
+type Span interface {
+	SpanContext() SpanContext
+	SetAttributes(attrs ...slog.Attr)
+	// SetError marks the span as failed, a nil error is ignored.
+	SetError(err error)
+	End()
+}
+
+type (
+	spanKey   struct{}
+	remoteKey struct{}
+)
+
+// ContextWithSpan returns a context holding the span, the spans started with it are its children.
+func ContextWithSpan(ctx context.Context, span Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// ContextWithRemote returns a context whose spans are the children of a span on another node,
+// the one a message was sent from.
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// SpanFromContext returns the span of the context, one that records nothing when it has none.
+func SpanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		return span
+	}
+	return nopSpan{SpanContextFromContext(ctx)}
+}
+
+// SpanContextFromContext returns the span context to send along with the messages made in ctx,
+// zero when there is none.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		return span.SpanContext()
+	}
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+// Nop records nothing. Its spans have the span context of their parent, so a node without a
+// tracer does not break the traces going through it.
+var Nop Tracer = nopTracer{}
+
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, Span) {
+	return ctx, nopSpan{SpanContextFromContext(ctx)}
+}
+
+type nopSpan struct {
+	sc SpanContext
+}
+
+func (s nopSpan) SpanContext() SpanContext { return s.sc }
+func (nopSpan) SetAttributes(...slog.Attr) {}
+func (nopSpan) SetError(error)             {}
+func (nopSpan) End()                       {}
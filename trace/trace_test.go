@@ -0,0 +1,101 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+)
+
+func TestTracer(t *testing.T) {
+	rec := NewRecorder()
+	tracer := NewTracer(TracerOpts{Exporter: rec, Attrs: []slog.Attr{slog.String("node", ":3000")}})
+
+	ctx, root := tracer.Start(context.Background(), "store", slog.String("key", "abc"))
+	_, child := tracer.Start(ctx, "disk write")
+	child.SetError(errors.New("disk full"))
+	child.End()
+	child.End()
+	root.End()
+
+	spans := rec.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("want 2 spans have %d", len(spans))
+	}
+	write, store := spans[0], spans[1]
+	if !store.SpanContext.IsValid() || !store.SpanContext.Sampled || store.Parent.SpanID.IsValid() {
+		t.Errorf("want a new sampled trace for the root span, have %+v", store)
+	}
+	if write.SpanContext.TraceID != store.SpanContext.TraceID || write.Parent.SpanID != store.SpanContext.SpanID || write.Parent.Remote {
+		t.Errorf("want the disk write a local child of the store, have %+v", write)
+	}
+	if write.Err != "disk full" {
+		t.Errorf("want the error recorded have %q", write.Err)
+	}
+	if store.Attr("node").String() != ":3000" || store.Attr("key").String() != "abc" {
+		t.Errorf("want the attributes of the tracer and of the span, have %v", store.Attrs)
+	}
+	if store.End.Before(write.End) {
+		t.Error("want the spans ended in order")
+	}
+
+	// The span handling a message on the peer is a remote child of the one that sent it.
+	rec.Reset()
+	sent := store.SpanContext
+	_, remote := tracer.Start(ContextWithRemote(context.Background(), sent), "handle StoreFile")
+	remote.End()
+	handled := rec.Named("handle StoreFile")
+	if len(handled) != 1 || handled[0].SpanContext.TraceID != sent.TraceID || handled[0].Parent != (Parent{SpanID: sent.SpanID, Remote: true}) {
+		t.Errorf("want a remote child of %s, have %+v", sent.SpanID, handled)
+	}
+
+	// The traces that are not sampled are passed along without being recorded.
+	rec.Reset()
+	sent.Sampled = false
+	ctx, span := tracer.Start(ContextWithRemote(context.Background(), sent), "handle GetFile")
+	span.End()
+	if len(rec.Spans()) != 0 {
+		t.Error("want the spans of a trace that is not sampled dropped")
+	}
+	if sc := SpanContextFromContext(ctx); sc.TraceID != sent.TraceID || sc.Sampled {
+		t.Errorf("want the trace passed along unsampled, have %+v", sc)
+	}
+}
+
+func TestNop(t *testing.T) {
+	if sc := SpanContextFromContext(context.Background()); sc.IsValid() {
+		t.Errorf("want no span context in an empty context, have %+v", sc)
+	}
+	sent := SpanContext{TraceID: TraceID{1}, SpanID: SpanID{2}, Sampled: true}
+	ctx, span := Nop.Start(ContextWithRemote(context.Background(), sent), "store")
+	span.End()
+	if span.SpanContext() != sent || SpanContextFromContext(ctx) != sent || SpanFromContext(ctx).SpanContext() != sent {
+		t.Error("want the nop tracer to pass the span context along")
+	}
+}
+
+func TestTraceparent(t *testing.T) {
+	const header = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sc.Sampled || sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" {
+		t.Errorf("have %+v", sc)
+	}
+	if sc.Traceparent() != header {
+		t.Errorf("want %s have %s", header, sc.Traceparent())
+	}
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01",
+	} {
+		if _, err := ParseTraceparent(bad); !errors.Is(err, ErrInvalidTraceparent) {
+			t.Errorf("want %s for %q have %v", ErrInvalidTraceparent, bad, err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package trace
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// SpanData is a span that ended, as handed to the Exporter.
+type SpanData struct {
+	Name        string
+	SpanContext SpanContext
+	// Parent is the span this one is a child of, zero for the root of a trace.
+	Parent Parent
+	Start  time.Time
+	End    time.Time
+	Attrs  []slog.Attr
+	// Err is the error the span failed with, empty when it did not.
+	Err string
+}
+
+type Parent struct {
+	SpanID SpanID
+	// Remote is set when the parent is on another node, the one that sent the message.
+	Remote bool
+}
+
+// Attr returns the value of the attribute, the zero Value when the span does not have it.
+func (d *SpanData) Attr(key string) slog.Value {
+	for _, a := range d.Attrs {
+		if a.Key == key {
+			return a.Value
+		}
+	}
+	return slog.Value{}
+}
+
+// Exporter gets the spans of a tracer as they end, ExportSpan should not block.
+type Exporter interface {
+	ExportSpan(span *SpanData)
+}
+
+// TracerOpts configures the tracer returned by NewTracer.
+type TracerOpts struct {
+	Exporter Exporter
+	// Attrs are set on every span, like the node the tracer is on.
+	Attrs []slog.Attr
+}
+
+// NewTracer returns a tracer handing its spans to the exporter. A span is only recorded when its
+// trace is, the new traces all are.
+func NewTracer(opts TracerOpts) Tracer {
+	return &tracer{opts: opts}
+}
+
+type tracer struct {
+	opts TracerOpts
+}
+
+func (t *tracer) Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, Span) {
+	span := &span{
+		exporter: t.opts.Exporter,
+		data: SpanData{
+			Name:  name,
+			Start: time.Now(),
+			Attrs: append(append([]slog.Attr(nil), t.opts.Attrs...), attrs...),
+		},
+	}
+	psc := SpanContextFromContext(ctx)
+	_, local := ctx.Value(spanKey{}).(Span)
+	if psc.IsValid() {
+		span.data.SpanContext = SpanContext{TraceID: psc.TraceID, SpanID: newSpanID(), Sampled: psc.Sampled}
+		span.data.Parent = Parent{SpanID: psc.SpanID, Remote: !local}
+	} else {
+		span.data.SpanContext = SpanContext{TraceID: newTraceID(), SpanID: newSpanID(), Sampled: true}
+	}
+	return ContextWithSpan(ctx, span), span
+}
+
+type span struct {
+	exporter Exporter
+	mu       sync.Mutex
+	data     SpanData
+	ended    bool
+}
+
+func (s *span) SpanContext() SpanContext {
+	return s.data.SpanContext
+}
+
+func (s *span) SetAttributes(attrs ...slog.Attr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attrs = append(s.data.Attrs, attrs...)
+}
+
+func (s *span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Err = err.Error()
+}
+
+// End hands the span to the exporter, calling it again does nothing.
+func (s *span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+	if data.SpanContext.Sampled && s.exporter != nil {
+		s.exporter.ExportSpan(&data)
+	}
+}
+
+// Recorder keeps the spans in memory, it is meant for the tests.
+type Recorder struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+func (r *Recorder) ExportSpan(span *SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, *span)
+}
+
+// Spans returns the spans recorded, in the order they ended.
+func (r *Recorder) Spans() []SpanData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]SpanData(nil), r.spans...)
+}
+
+// Named returns the spans recorded with that name.
+func (r *Recorder) Named(name string) []SpanData {
+	var spans []SpanData
+	for _, span := range r.Spans() {
+		if span.Name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = nil
+}